@@ -5,122 +5,274 @@
 // | Action | Route | Description       | Payload                          | Output          |
 // |--------|-------|-------------------|----------------------------------|-----------------|
 // | POST   | /logs | Publish a log     | Log Message                      | Success message |
+// | POST   | /logs | Publish logs in bulk | json array or ndjson of Log Messages | Bulk summary |
 // | GET    | /logs | Fetch stored logs |                                  | Success message |
+// | GET    | /logs/stream | Stream new logs (websocket or server-sent events) | | Log Messages |
+// | GET    | /logs/stats | Count stored logs per interval | | Histogram |
+// | GET    | /redactions | Fetch redaction counts |                    | Counts per rule |
+// | GET    | /outputs/queues | Fetch output queue depths and drops |       | Queue stats per output |
+// | GET    | /metrics | Fetch prometheus metrics |                      | Prometheus text format |
+// | GET    | /retention | Report what the next cleanup would delete (dry run) | | Retention report |
+// | POST   | /outputs | Add a forwarding output | Output                  | Success message |
+// | GET    | /outputs | List forwarding outputs |                         | Outputs         |
+// | DELETE | /outputs | Remove a forwarding output (`?type=&endpoint=`) |  | Success message |
+//
+// With auth enabled, /logs requires an api key with the ingest (POST) or read
+// (GET) scope, and /redactions, /outputs, /metrics, and /retention the admin
+// scope.
 //
 package api
 
 import (
+	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
-	"regexp"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/gorilla/pat"
 	"github.com/jcelliott/lumber"
+
+	"github.com/r0h4n/log_agg/auth"
 	"github.com/r0h4n/log_agg/config"
+	"github.com/r0h4n/log_agg/metrics"
 	"github.com/r0h4n/log_agg/output"
+	"github.com/r0h4n/log_agg/query"
+	"github.com/r0h4n/log_agg/transform"
+)
+
+var (
+	// running servers, stopped by Shutdown
+	servers      []*http.Server
+	serversMutex sync.Mutex
+
+	// closed on shutdown, ending streams
+	shuttingDown = make(chan bool)
+	shutdownOnce sync.Once
 )
 
-// starts the web server with the log_agg functions
+// starts the web server with the log_agg functions. Returns nil once Shutdown
+// is called.
 func Start(input http.HandlerFunc) error {
+	serve, err := Listen(input)
+	if err != nil {
+		return err
+	}
+	return serve()
+}
+
+// Listen opens the web server's listener, returning the function serving it
+// (as Start does). The config is read before it returns, not while serving.
+func Listen(input http.HandlerFunc) (func() error, error) {
 	retriever := GenerateArchiveEndpoint(output.Archiver)
 
 	router := pat.New()
 
-	router.Post("/logs", handleRequest(input))
-	router.Get("/logs", handleRequest(retriever))
+	// routes are prefix matched, register /logs/stream and /logs/stats before
+	// /logs (and /outputs/queues before /outputs)
+	router.Get("/logs/stream", handleRequest(authorize(auth.ScopeRead, GenerateStreamEndpoint())))
+	router.Get("/logs/stats", handleRequest(authorize(auth.ScopeRead, GenerateStatsEndpoint(output.Archiver))))
+	router.Post("/logs", handleRequest(authorize(auth.ScopeIngest, input)))
+	router.Get("/logs", handleRequest(authorize(auth.ScopeRead, retriever)))
+	router.Get("/redactions", handleRequest(authorize(auth.ScopeAdmin, redactionCounts)))
+	router.Get("/outputs/queues", handleRequest(authorize(auth.ScopeAdmin, queueStats)))
+	router.Post("/outputs", handleRequest(authorize(auth.ScopeAdmin, addOutput)))
+	router.Get("/outputs", handleRequest(authorize(auth.ScopeAdmin, listOutputs)))
+	router.Delete("/outputs", handleRequest(authorize(auth.ScopeAdmin, removeOutput)))
+	router.Get("/metrics", handleRequest(authorize(auth.ScopeAdmin, metrics.Handler)))
+	router.Get("/retention", handleRequest(authorize(auth.ScopeAdmin, retentionDryRun)))
 
 	httpListener, err := net.Listen("tcp", config.ListenHttp)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	config.Log.Info("Api Listening on http://%s...", config.ListenHttp)
-	return http.Serve(httpListener, router)
+	listener, err := tlsListen(httpListener)
+	if err != nil {
+		httpListener.Close()
+		return nil, err
+	}
+
+	scheme := "http"
+	if config.TlsCert != "" {
+		scheme = "https"
+	}
+	server := &http.Server{Handler: router}
+	serversMutex.Lock()
+	servers = append(servers, server)
+	serversMutex.Unlock()
 
+	config.Log.Info("Api Listening on %s://%s...", scheme, config.ListenHttp)
+	return func() error {
+		err := server.Serve(listener)
+		if err == http.ErrServerClosed {
+			return nil
+		}
+		return err
+	}, nil
 }
 
 
+// Shutdown stops accepting requests, ends streams, and waits (until ctx is
+// done) for requests being handled to finish
+func Shutdown(ctx context.Context) error {
+	shutdownOnce.Do(func() { close(shuttingDown) })
+
+	serversMutex.Lock()
+	stopping := servers
+	servers = nil
+	serversMutex.Unlock()
+
+	var err error
+	for _, server := range stopping {
+		if serr := server.Shutdown(ctx); serr != nil {
+			err = serr
+		}
+	}
+	return err
+}
+
 // adds a bit of logging
 func handleRequest(fn http.HandlerFunc) http.HandlerFunc {
 	return func(rw http.ResponseWriter, req *http.Request) {
 		rw.Header().Set("Access-Control-Allow-Origin", config.CorsAllow)
-		rw.Header().Set("Access-Control-Allow-Methods", "GET, POST")
+		rw.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE")
+		rw.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
 
-		fn(rw, req)
+		w := &statusWriter{ResponseWriter: rw}
+		fn(w, req)
 
-		// must be after req returns
-		getStatus := func(trw http.ResponseWriter) string {
-			r, _ := regexp.Compile("status:([0-9]*)")
-			return r.FindStringSubmatch(fmt.Sprintf("%+v", trw))[1]
-		}
+		config.Log.Debug(`%s - [%s] %s %s %d(%d) - "User-Agent: %s"`,
+			req.RemoteAddr, req.Proto, req.Method, loggedURI(req),
+			w.status, w.written, // %d(%d)
+			req.Header.Get("User-Agent"))
+	}
+}
 
-		getWrote := func(trw http.ResponseWriter) string {
-			r, _ := regexp.Compile("written:([0-9]*)")
-			return r.FindStringSubmatch(fmt.Sprintf("%+v", trw))[1]
-		}
+// statusWriter records the status and bytes written for the request log
+type statusWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
 
-		config.Log.Debug(`%s - [%s] %s %s %s(%s) - "User-Agent: %s"`,
-			req.RemoteAddr, req.Proto, req.Method, req.RequestURI,
-			getStatus(rw), getWrote(rw), // %s(%s)
-			req.Header.Get("User-Agent"))
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
 	}
+	w.ResponseWriter.WriteHeader(status)
 }
 
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.written += int64(n)
+	return n, err
+}
 
-// generates the endpoint for fetching filtered logs
-func GenerateArchiveEndpoint(archive output.Output) http.HandlerFunc {
-	return func(res http.ResponseWriter, req *http.Request) {
-		// /logs?id=&type=app&start=0&end=0&limit=50
-		query := req.URL.Query()
+// Flush lets streams flush events
+func (w *statusWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
 
-		host := query.Get("id")
-		tag := query["tag"]
+// Hijack lets websockets take over the connection
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("Connection can't be hijacked")
+	}
+	w.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
 
-		kind := query.Get("type")
-		if kind == "" {
-			kind = config.LogType // "app"
-		}
-		start := query.Get("start")
-		if start == "" {
-			start = "0"
-		}
-		end := query.Get("end")
-		if end == "" {
-			end = "0"
-		}
-		limit := query.Get("limit")
-		if limit == "" {
-			limit = "100"
+// loggedURI is the request's uri, with any api key in it masked
+func loggedURI(req *http.Request) string {
+	query := req.URL.Query()
+	if _, ok := query["api_key"]; !ok {
+		return req.RequestURI
+	}
+	query.Set("api_key", "********")
+	u := *req.URL
+	u.RawQuery = query.Encode()
+	return u.RequestURI()
+}
+
+// requires an api key with the scope when auth is enabled. The key is passed
+// as `Authorization: Bearer <key>`, or the `api_key` query parameter for
+// clients that can't set headers (websockets, EventSource)
+func authorize(scope string, fn http.HandlerFunc) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if !config.Auth {
+			fn(res, req)
+			return
 		}
-		level := query.Get("level")
-		if level == "" {
-			level = "TRACE"
+
+		token := req.URL.Query().Get("api_key")
+		if header := req.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+			token = strings.TrimPrefix(header, "Bearer ")
 		}
-		config.Log.Trace("type: %s, start: %s, end: %s, limit: %s, level: %s, id: %s, tag: %s", kind, start, end, limit, level, host, tag)
-		logLevel := lumber.LvlInt(level)
-		realOffset, err := strconv.ParseInt(start, 0, 64)
+
+		key, err := auth.Lookup(token)
 		if err != nil {
-			res.WriteHeader(500)
-			res.Write([]byte("bad start offset"))
+			res.Header().Set("WWW-Authenticate", "Bearer")
+			res.WriteHeader(401)
+			res.Write([]byte(fmt.Sprintf("unauthorized - %s", err)))
+			return
+		}
+		if !key.Can(scope) {
+			res.WriteHeader(403)
+			res.Write([]byte(fmt.Sprintf("forbidden - key '%s' lacks the '%s' scope", key.Id, scope)))
 			return
 		}
-		realEnd, err := strconv.ParseInt(end, 0, 64)
+
+		fn(res, req.WithContext(auth.NewContext(req.Context(), key)))
+	}
+}
+
+// logFilter holds the `/logs` filters, which `/logs/stats` shares
+type logFilter struct {
+	kinds []string // tenant namespaced
+	host  string
+	tag   []string
+	start int64
+	end   int64
+	level int
+	q     *query.Query
+}
+
+// generates the endpoint for fetching filtered logs
+func GenerateArchiveEndpoint(archive output.Output) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		// /logs?id=&type=app&start=0&end=0&limit=50
+		filter, status, err := parseLogFilter(req)
 		if err != nil {
-			res.WriteHeader(500)
-			res.Write([]byte("bad end value"))
+			res.WriteHeader(status)
+			res.Write([]byte(err.Error()))
 			return
 		}
+		limit := req.URL.Query().Get("limit")
+		if limit == "" {
+			limit = "100"
+		}
+		config.Log.Trace("type: %s, start: %d, end: %d, limit: %s, level: %d, id: %s, tag: %s, q: %s",
+			filter.kinds, filter.start, filter.end, limit, filter.level, filter.host, filter.tag, filter.q)
 		realLimit, err := strconv.Atoi(limit)
 		if err != nil {
 			res.WriteHeader(500)
 			res.Write([]byte("bad limit"))
 			return
 		}
-		slices, err := archive.Slice(kind, host, tag, realOffset, realEnd, int64(realLimit), logLevel)
+		slices, err := sliceTypes(archive, filter, int64(realLimit))
 		if err != nil {
 			res.WriteHeader(500)
 			res.Write([]byte(err.Error()))
@@ -138,6 +290,221 @@ func GenerateArchiveEndpoint(archive output.Output) http.HandlerFunc {
 	}
 }
 
+// parseLogFilter reads the `/logs` filters from the request, or returns the
+// status to respond with and why
+func parseLogFilter(req *http.Request) (*logFilter, int, error) {
+	params := req.URL.Query()
+
+	filter := &logFilter{host: params.Get("id"), tag: params["tag"]}
+
+	kind := params.Get("type")
+	if kind == "" {
+		kind = config.LogType // "app"
+	}
+	start := params.Get("start")
+	if start == "" {
+		start = "0"
+	}
+	end := params.Get("end")
+	if end == "" {
+		end = "0"
+	}
+	level := params.Get("level")
+	if level == "" {
+		level = "TRACE"
+	}
+	if text := params.Get("q"); text != "" {
+		q, err := query.Parse(text)
+		if err != nil {
+			return nil, 400, fmt.Errorf("bad query - %s", err)
+		}
+		filter.q = q
+	}
+	// field.<path>=<expr> filters on fields, each must match
+	var fields []string
+	for key := range params {
+		if strings.HasPrefix(key, "field.") {
+			fields = append(fields, key)
+		}
+	}
+	sort.Strings(fields)
+	for _, key := range fields {
+		for _, expr := range params[key] {
+			q, err := query.ParseField(strings.TrimPrefix(key, "field."), expr)
+			if err != nil {
+				return nil, 400, fmt.Errorf("bad field filter - %s", err)
+			}
+			filter.q = filter.q.And(q)
+		}
+	}
+	// exact type terms in the query choose the types read, otherwise the
+	// type param does
+	filter.kinds = []string{kind}
+	if filter.q != nil {
+		if types, ok := filter.q.Types(); ok {
+			filter.kinds = types
+		}
+	}
+	// only the key's tenant's logs are visible
+	for i := range filter.kinds {
+		if err := output.ValidType(filter.kinds[i]); err != nil {
+			return nil, 400, fmt.Errorf("bad type - %s", err)
+		}
+		filter.kinds[i] = output.TenantType(auth.Tenant(req.Context()), filter.kinds[i])
+	}
+	filter.level = lumber.LvlInt(level)
+
+	var err error
+	if filter.start, err = strconv.ParseInt(start, 0, 64); err != nil {
+		return nil, 500, fmt.Errorf("bad start offset")
+	}
+	if filter.end, err = strconv.ParseInt(end, 0, 64); err != nil {
+		return nil, 500, fmt.Errorf("bad end value")
+	}
+
+	return filter, 0, nil
+}
+
+// sliceTypes slices the logs of each type, keeping the newest limit of them
+func sliceTypes(archive output.Output, filter *logFilter, limit int64) ([]log_agg.Message, error) {
+	if len(filter.kinds) == 1 {
+		return archive.Slice(filter.kinds[0], filter.host, filter.tag, filter.start, filter.end, limit, filter.level, filter.q)
+	}
+
+	messages := make([]log_agg.Message, 0)
+	for _, kind := range filter.kinds {
+		slice, err := archive.Slice(kind, filter.host, filter.tag, filter.start, filter.end, limit, filter.level, filter.q)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, slice...)
+	}
+
+	// ids sort as the records do (display newest last)
+	sort.SliceStable(messages, func(i, j int) bool { return messages[i].MessageId < messages[j].MessageId })
+	if limit >= 0 && int64(len(messages)) > limit {
+		messages = messages[int64(len(messages))-limit:]
+	}
+	return messages, nil
+}
+
+// returns how many matches each redaction rule has scrubbed
+func redactionCounts(res http.ResponseWriter, req *http.Request) {
+	body, err := json.Marshal(log_agg.RedactCounts())
+	if err != nil {
+		res.WriteHeader(500)
+		res.Write([]byte(err.Error()))
+		return
+	}
+
+	res.WriteHeader(200)
+	res.Write(append(body, byte('\n')))
+}
+
+// lists each output's queue depth and drops
+func queueStats(res http.ResponseWriter, req *http.Request) {
+	body, err := json.Marshal(log_agg.QueueStats())
+	if err != nil {
+		res.WriteHeader(500)
+		res.Write([]byte(err.Error()))
+		return
+	}
+
+	res.WriteHeader(200)
+	res.Write(append(body, byte('\n')))
+}
+
+// reports the retention rules and what the next cleanup would delete with them
+func retentionDryRun(res http.ResponseWriter, req *http.Request) {
+	expired, err := output.DryRun()
+	if err != nil {
+		res.WriteHeader(500)
+		res.Write([]byte(err.Error()))
+		return
+	}
+	if expired == nil {
+		expired = []output.Expiry{}
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"rules":    output.RetentionRules(),
+		"maxBytes": output.RetentionMaxBytes(),
+		"buckets":  expired,
+	})
+	if err != nil {
+		res.WriteHeader(500)
+		res.Write([]byte(err.Error()))
+		return
+	}
+
+	res.WriteHeader(200)
+	res.Write(append(body, byte('\n')))
+}
+
+// adds a forwarding output, persisting it so it is restored on restart
+func addOutput(res http.ResponseWriter, req *http.Request) {
+	o := log_agg.Output{}
+	err := parseBody(req, &o)
+	if err != nil {
+		res.WriteHeader(400)
+		res.Write([]byte(fmt.Sprintf("bad output - %s", err)))
+		return
+	}
+
+	err = output.AddForwarder(o)
+	if err != nil {
+		res.WriteHeader(400)
+		res.Write([]byte(err.Error()))
+		return
+	}
+
+	res.WriteHeader(200)
+	res.Write([]byte("success!\n"))
+}
+
+// lists the forwarding outputs (secrets are masked)
+func listOutputs(res http.ResponseWriter, req *http.Request) {
+	outputs := output.Forwarders()
+	for i := range outputs {
+		if outputs[i].AuthSecret != "" {
+			outputs[i].AuthSecret = "********"
+		}
+		// datadog's key is its api key, not a user
+		if outputs[i].Type == "datadog" && outputs[i].AuthKey != "" {
+			outputs[i].AuthKey = "********"
+		}
+	}
+
+	body, err := json.Marshal(outputs)
+	if err != nil {
+		res.WriteHeader(500)
+		res.Write([]byte(err.Error()))
+		return
+	}
+
+	res.WriteHeader(200)
+	res.Write(append(body, byte('\n')))
+}
+
+// removes the forwarding output matching the `type` and `endpoint` query params
+func removeOutput(res http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	o := log_agg.Output{
+		Type: query.Get("type"),
+		URI:  query.Get("endpoint"),
+	}
+
+	err := output.RemoveForwarder(o)
+	if err != nil {
+		res.WriteHeader(400)
+		res.Write([]byte(err.Error()))
+		return
+	}
+
+	res.WriteHeader(200)
+	res.Write([]byte("success!\n"))
+}
+
 // parses the request into v
 func parseBody(req *http.Request, v interface{}) error {
 
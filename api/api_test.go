@@ -2,20 +2,25 @@
 package api_test
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/gorilla/websocket"
 	"github.com/jcelliott/lumber"
 
 	"github.com/r0h4n/log_agg/api"
+	"github.com/r0h4n/log_agg/auth"
 	"github.com/r0h4n/log_agg/input"
 	"github.com/r0h4n/log_agg/config"
 	"github.com/r0h4n/log_agg/transform"
@@ -33,7 +38,12 @@ func TestMain(m *testing.M) {
 	initialize()
 
 	// start insecure api
-	go api.Start(input.InputHandler)
+	serve, err := api.Listen(input.InputHandler)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	go serve()
 	time.Sleep(time.Second)
 	<-time.After(time.Second)
 	rtn := m.Run()
@@ -84,7 +94,7 @@ func TestGetLogs(t *testing.T) {
 		t.Error(fmt.Errorf("Failed to unmarshal - %s", err))
 		t.FailNow()
 	}
-	if len(msg) != 1 || msg[0].Content != "test log" {
+	if len(msg) != 1 || msg[0].Content != "test log" || msg[0].MessageId == "" {
 		t.Errorf("%q doesn't match expected out", body)
 	}
 	_, err = rest("GET", "/logs", "")
@@ -109,6 +119,615 @@ func TestGetLogs(t *testing.T) {
 	}
 }
 
+// test bulk posting logs
+func TestBulkLogs(t *testing.T) {
+	ndjson := `{"id":"bulk-test","type":"bulk","message":"one"}
+{"id":"bulk-test","type":"bulk","message":"two"}
+
+{"id":"bulk-test","type":"bulk",
+{"id":"bulk-test","type":"bulk","message":"three"}
+`
+	body, err := rest("POST", "/logs", ndjson)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	summary := input.BulkSummary{}
+	if err = json.Unmarshal(body, &summary); err != nil || summary.Accepted != 3 || summary.Failed != 1 ||
+		len(summary.Results) != 4 || summary.Results[2].Line != 4 || summary.Results[2].Error == "" {
+		t.Errorf("%q doesn't match expected out", body)
+	}
+
+	body, err = rest("POST", "/logs", `[{"id":"bulk-test","type":"bulk","message":"four"}, {"id":"bulk-test","type":"bulk"}]`)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	summary = input.BulkSummary{}
+	if err = json.Unmarshal(body, &summary); err != nil || summary.Accepted != 1 || summary.Failed != 1 || summary.Results[1].Status != "failed" {
+		t.Errorf("%q doesn't match expected out", body)
+	}
+
+	_, err = rest("POST", "/logs", "[1, 2]")
+	if err == nil || !strings.Contains(err.Error(), "400") {
+		t.Errorf("bulk post of nothing valid is too forgiving - %v", err)
+	}
+
+	// a single post is held to the same rules as a bulk record
+	_, err = rest("POST", "/logs", `{"id":"bulk-test","type":"bulk"}`)
+	if err == nil || !strings.Contains(err.Error(), "400") {
+		t.Errorf("post without a message is too forgiving - %v", err)
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	body, err = rest("GET", "/logs?type=bulk", "")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	msgs := []log_agg.Message{}
+	if err = json.Unmarshal(body, &msgs); err != nil || len(msgs) != 4 || msgs[0].Content != "one" || msgs[3].Content != "four" {
+		t.Errorf("%q doesn't match expected out", body)
+	}
+}
+
+// test api keys, their scopes, and tenants
+func TestAuth(t *testing.T) {
+	config.Auth = true
+	defer func() { config.Auth = false }()
+
+	ingestA, _, err := auth.NewKey("team-a", []string{auth.ScopeIngest})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	readA, _, _ := auth.NewKey("team-a", []string{auth.ScopeRead})
+	readB, _, _ := auth.NewKey("team-b", []string{auth.ScopeRead})
+
+	// keyed request, returning the status
+	request := func(method, route, data, key string) (int, []byte) {
+		req, _ := http.NewRequest(method, fmt.Sprintf("http://%s%s", insecureHttp, route), strings.NewReader(data))
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		return res.StatusCode, body
+	}
+
+	post := `{"id":"auth-test","type":"auth","message":"tenant log","tenant":"team-b"}`
+	if status, _ := request("POST", "/logs", post, ""); status != 401 {
+		t.Errorf("post without a key got '%d'", status)
+	}
+	if status, _ := request("POST", "/logs", post, "bad"); status != 401 {
+		t.Errorf("post with a bad key got '%d'", status)
+	}
+	if status, _ := request("POST", "/logs", post, readA); status != 403 {
+		t.Errorf("post with a read key got '%d'", status)
+	}
+	if status, _ := request("GET", "/outputs", "", readA); status != 403 {
+		t.Errorf("outputs with a read key got '%d'", status)
+	}
+	if status, body := request("POST", "/logs", post, ingestA); status != 200 {
+		t.Errorf("post with an ingest key got '%d' - %q", status, body)
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	// the posted tenant is ignored for the key's
+	for key, count := range map[string]int{readA: 1, readB: 0} {
+		status, body := request("GET", "/logs?type=auth", "", key)
+		msgs := []log_agg.Message{}
+		if err = json.Unmarshal(body, &msgs); status != 200 || err != nil || len(msgs) != count {
+			t.Errorf("%d - %q doesn't match expected out", status, body)
+		}
+	}
+
+	// the query parameter works too
+	if status, _ := request("GET", "/logs?type=auth&api_key="+readA, "", ""); status != 200 {
+		t.Errorf("get with a key parameter got '%d'", status)
+	}
+
+	// types can't reach another tenant's, or the archive's own, buckets
+	for _, kind := range []string{"team-a/auth", "_files", "_config"} {
+		if status, body := request("GET", "/logs?type="+kind, "", readB); status != 400 {
+			t.Errorf("get of type '%s' got '%d' - %q", kind, status, body)
+		}
+		post := fmt.Sprintf(`{"id":"auth-test","type":%q,"message":"tenant log"}`, kind)
+		if status, body := request("POST", "/logs", post, ingestA); status != 400 {
+			t.Errorf("post of type '%s' got '%d' - %q", kind, status, body)
+		}
+	}
+}
+
+// test full-text search of logs
+func TestSearchLogs(t *testing.T) {
+	for _, content := range []string{"request timeout on db1", "Connection Reset by peer", "timeout reading header"} {
+		_, err := rest("POST", "/logs", fmt.Sprintf("{\"id\":\"search-test\",\"type\":\"search\",\"message\":%q}", content))
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	searches := map[string]int{
+		"timeout":                   2,
+		"TIMEOUT AND db1":           1,
+		"timeout NOT db1":           1,
+		"reset OR header":           2,
+		"\"reset by\"":              1,
+		"/^[a-z]+ timeout/":         1,
+		"conn*":                     1,
+		"(peer OR db1) AND request": 1,
+		"timeouts":                  0,
+	}
+	for q, count := range searches {
+		body, err := rest("GET", "/logs?type=search&q="+url.QueryEscape(q), "")
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		msgs := []log_agg.Message{}
+		if err = json.Unmarshal(body, &msgs); err != nil || len(msgs) != count {
+			t.Errorf("search %q - %q doesn't match expected out", q, body)
+		}
+	}
+
+	for _, q := range []string{"(timeout", "\"reset", "/[/", "timeout AND"} {
+		_, err := rest("GET", "/logs?type=search&q="+url.QueryEscape(q), "")
+		if err == nil || !strings.Contains(err.Error(), "400") {
+			t.Errorf("bad search %q is too forgiving - %v", q, err)
+		}
+	}
+}
+
+// test posting logs with fields and filtering on them
+func TestFieldLogs(t *testing.T) {
+	_, err := rest("POST", "/logs", `[{"type":"fields","message":"ok","status":200,"latency":0.02},
+		{"type":"fields","message":"failed","status":500,"latency":1.5,"user":{"id":"ann"}},
+		{"type":"fields","message":"failed again","status":503,"fields":{"user":{"id":"bob"}}}]`)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	filters := map[string]string{
+		"field.status=500":                     "failed",
+		"field.status=>=500":                   "failed,failed again",
+		"field.status=>=500&field.status=!503": "failed",
+		"field.latency=<1":                     "ok",
+		"field.user":                           "failed,failed again",
+		"field.user=!":                         "ok",
+		"field.user.id=bob":                    "failed again",
+		"field.user.id=>b&q=failed":            "failed again",
+		"field.status=404":                     "",
+	}
+	for filter, expected := range filters {
+		body, err := rest("GET", "/logs?type=fields&"+filter, "")
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		msgs := []log_agg.Message{}
+		if err = json.Unmarshal(body, &msgs); err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		var got []string
+		for i := range msgs {
+			got = append(got, msgs[i].Content)
+		}
+		if strings.Join(got, ",") != expected {
+			t.Errorf("%s - %q doesn't match expected out", filter, body)
+		}
+	}
+
+	// fields are returned as posted
+	body, _ := rest("GET", "/logs?type=fields&field.status=500", "")
+	if !strings.Contains(string(body), `"fields":{"latency":1.5,"status":500,"user":{"id":"ann"}}`) {
+		t.Errorf("%q doesn't match expected out", body)
+	}
+
+	if _, err = rest("GET", "/logs?type=fields&field.status=>=", ""); err == nil || !strings.Contains(err.Error(), "400") {
+		t.Errorf("bad field filter is too forgiving - %v", err)
+	}
+}
+
+
+// test querying logs with the query language
+func TestQueryLogs(t *testing.T) {
+	_, err := rest("POST", "/logs", `[{"id":"web-1","type":"qapp","tag":["http"],"priority":4,"message":"request timeout"},
+		{"id":"web-2","type":"qapp","tag":["health"],"priority":4,"message":"health check timeout"},
+		{"id":"db-1","type":"qapp","priority":2,"message":"slow query timeout"},
+		{"id":"web-1","type":"qdeploy","priority":3,"message":"deploy timeout","status":500}]`)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	queries := map[string]string{
+		`type:qapp AND id:web-* AND NOT tag:health AND priority>=3 AND "timeout"`: "request timeout",
+		`type:qapp AND (tag:health OR priority<warn)`:                             "health check timeout,slow query timeout",
+		`type:qapp OR type:qdeploy id:web-1`:                                      "request timeout,health check timeout,slow query timeout,deploy timeout",
+		`(type:qapp OR type:qdeploy) AND id:/^web-[0-9]$/ AND NOT tag:health`:     "request timeout,deploy timeout",
+		`type:qdeploy field.status>=500`:                                          "deploy timeout",
+		`type:qapp type:qdeploy`:                                                  "",
+	}
+	for q, expected := range queries {
+		body, err := rest("GET", "/logs?q="+url.QueryEscape(q), "")
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		msgs := []log_agg.Message{}
+		if err = json.Unmarshal(body, &msgs); err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		var got []string
+		for i := range msgs {
+			got = append(got, msgs[i].Content)
+		}
+		if strings.Join(got, ",") != expected {
+			t.Errorf("query %q - %q doesn't match expected out", q, body)
+		}
+	}
+
+	// the newest logs of every type are kept
+	body, _ := rest("GET", "/logs?limit=2&q="+url.QueryEscape("type:qapp OR type:qdeploy"), "")
+	if msgs := []log_agg.Message{}; json.Unmarshal(body, &msgs) != nil || len(msgs) != 2 || msgs[1].Content != "deploy timeout" {
+		t.Errorf("%q doesn't match expected out", body)
+	}
+
+	// syntax errors are reported with their position
+	res, err := http.Get(fmt.Sprintf("http://%s/logs?q=%s", insecureHttp, url.QueryEscape("type:qapp AND (id:web-1")))
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer res.Body.Close()
+	body, _ = ioutil.ReadAll(res.Body)
+	if res.StatusCode != 400 || string(body) != "bad query - Missing ')' for '(' at 14" {
+		t.Errorf("bad query got '%d' - %q", res.StatusCode, body)
+	}
+}
+
+// test counting logs per interval
+func TestStatsLogs(t *testing.T) {
+	_, err := rest("POST", "/logs", `[{"id":"web-1","type":"stats","tag":["http","slow"],"priority":4,"message":"failed"},
+		{"id":"web-1","type":"stats","tag":["http"],"priority":2,"message":"ok"},
+		{"id":"db-1","type":"stats","priority":4,"message":"failed"},
+		{"id":"web-1","type":"stats2","priority":4,"message":"failed"}]`)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	stats := map[string]string{
+		"type=stats":                              "3",
+		"type=stats&by=id":                        "3 db-1=1 web-1=2",
+		"type=stats&by=priority&level=warn":       "2 4=2",
+		"q=type:stats%20OR%20type:stats2&by=type": "4 stats=3 stats2=1",
+		"type=stats&by=id&q=failed":               "2 db-1=1 web-1=1",
+		"type=stats&by=tag":                       "3 =1 http=2 slow=1",
+		"type=none":                               "0",
+	}
+	for params, expected := range stats {
+		body, err := rest("GET", "/logs/stats?interval=1h&"+params, "")
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		hist := struct {
+			Interval int64
+			Groups   []string
+			Buckets  []struct {
+				Time   int64
+				Total  int64
+				Counts map[string]int64
+			}
+		}{}
+		if err = json.Unmarshal(body, &hist); err != nil || hist.Interval != int64(time.Hour) {
+			t.Errorf("%s - %q doesn't match expected out - %v", params, body, err)
+			continue
+		}
+
+		// the logs may straddle an hour
+		var total int64
+		groups := map[string]int64{}
+		for _, bucket := range hist.Buckets {
+			total += bucket.Total
+			for group, n := range bucket.Counts {
+				groups[group] += n
+			}
+		}
+		got := fmt.Sprint(total)
+		for _, group := range hist.Groups {
+			got += fmt.Sprintf(" %s=%d", group, groups[group])
+		}
+		if got != expected {
+			t.Errorf("%s - %q doesn't match expected out", params, body)
+		}
+	}
+
+	// a range without logs is every interval in it, empty
+	now := time.Now().UnixNano()
+	body, _ := rest("GET", fmt.Sprintf("/logs/stats?type=none&interval=1m&start=%d&end=%d", now, now-int64(time.Hour)), "")
+	if !strings.Contains(string(body), `"buckets":[{"time":`) || strings.Count(string(body), `"total":0`) < 60 {
+		t.Errorf("%q doesn't match expected out", body)
+	}
+
+	// a range up to the last representable time doesn't overflow
+	body, err = rest("GET", "/logs/stats?type=none&interval=1m&start=9223372036854775807&end=9223372036000000000", "")
+	if err != nil || strings.Count(string(body), `"total":0`) != 1 {
+		t.Errorf("%q doesn't match expected out - %v", body, err)
+	}
+
+	for _, params := range []string{"interval=0s", "interval=1", "by=host", "interval=1ns&end=1", "q=(failed",
+		"end=-9223372036854775807", "start=-1", "start=1&end=2"} {
+		if _, err := rest("GET", "/logs/stats?type=stats&"+params, ""); err == nil || !strings.Contains(err.Error(), "400") {
+			t.Errorf("bad stats %q are too forgiving - %v", params, err)
+		}
+	}
+}
+
+// test adding, listing, and removing forwarding outputs
+func TestOutputs(t *testing.T) {
+	received := make(chan log_agg.Message, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		msg := log_agg.Message{}
+		json.NewDecoder(req.Body).Decode(&msg)
+		received <- msg
+	}))
+	defer server.Close()
+
+	_, err := rest("POST", "/outputs", fmt.Sprintf(`{"type":"http","endpoint":"%s","key":"user","secret":"pass"}`, server.URL))
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	_, err = rest("POST", "/outputs", `{"type":"carrier-pigeon"}`)
+	if err == nil {
+		t.Error("bad output is too forgiving")
+	}
+
+	// outputs are listed with secrets masked
+	body, err := rest("GET", "/outputs", "")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	outputs := []log_agg.Output{}
+	if err = json.Unmarshal(body, &outputs); err != nil || len(outputs) != 1 || outputs[0].AuthSecret != "********" {
+		t.Errorf("%q doesn't match expected out", body)
+		t.FailNow()
+	}
+
+	// outputs are persisted
+	stored := []log_agg.Output{}
+	if err = output.Archiver.Get("_config", "outputs", &stored); err != nil || len(stored) != 1 || stored[0].AuthSecret != "pass" {
+		t.Errorf("%+v doesn't match expected stored outputs - %v", stored, err)
+	}
+
+	// logs are forwarded
+	_, err = rest("POST", "/logs", `{"id":"forward-test","type":"forward","message":"forwarded log"}`)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	select {
+	case msg := <-received:
+		if msg.Content != "forwarded log" {
+			t.Errorf("%+v doesn't match expected out", msg)
+		}
+	case <-time.After(time.Second):
+		t.Error("output received nothing")
+	}
+
+	// datadog's key is its api key, so it's masked too
+	dd := server.URL + "/datadog"
+	_, err = rest("POST", "/outputs", fmt.Sprintf(`{"type":"datadog","endpoint":"%s","key":"dd-api-key"}`, dd))
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	body, _ = rest("GET", "/outputs", "")
+	if strings.Contains(string(body), "dd-api-key") || !strings.Contains(string(body), `"key":"user"`) {
+		t.Errorf("%q doesn't match expected out", body)
+	}
+	if _, err = rest("DELETE", "/outputs?type=datadog&endpoint="+url.QueryEscape(dd), ""); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	// every output's queue is listed
+	body, err = rest("GET", "/outputs/queues", "")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	queues := map[string]log_agg.QueueStat{}
+	if err = json.Unmarshal(body, &queues); err != nil || queues["historical"].Policy != "block" || queues["forward-http-"+server.URL].Size != 1000 {
+		t.Errorf("%q doesn't match expected out", body)
+	}
+
+	_, err = rest("DELETE", "/outputs?type=http&endpoint="+url.QueryEscape(server.URL), "")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	_, err = rest("DELETE", "/outputs?type=http&endpoint="+url.QueryEscape(server.URL), "")
+	if err == nil {
+		t.Error("removing a missing output is too forgiving")
+	}
+	if err = output.Archiver.Get("_config", "outputs", &stored); err != nil || len(stored) != 0 {
+		t.Errorf("%+v doesn't match expected stored outputs - %v", stored, err)
+	}
+}
+
+// test scraping metrics of ingesting, archiving, and querying logs
+func TestMetrics(t *testing.T) {
+	_, err := rest("POST", "/logs", `{"id":"metrics-test","type":"metrics","priority":3,"message":"measured log"}`)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	time.Sleep(500 * time.Millisecond)
+	if _, err = rest("GET", "/logs?type=metrics", ""); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	body, err := rest("GET", "/metrics", "")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	for _, expected := range []string{
+		`log_agg_ingested_messages_total{input="http",type="metrics",priority="3"} 1`,
+		`log_agg_output_queue_depth{output="historical"} 0`,
+		`# TYPE log_agg_archive_write_seconds histogram`,
+		`# TYPE log_agg_archive_write_failures_total counter`,
+		`log_agg_archive_query_seconds_count `,
+		`log_agg_received_bytes_total{input="http"} `,
+		`log_agg_archive_size_bytes `,
+	} {
+		if !strings.Contains(string(body), expected) {
+			t.Errorf("metrics are missing '%s'", expected)
+		}
+	}
+
+	// clients choosing types and priorities don't add series without bound
+	var records []string
+	for i := 0; i < 110; i++ {
+		records = append(records, fmt.Sprintf(`{"type":"metrics-%d","priority":99,"message":"label"}`, i))
+	}
+	if _, err = rest("POST", "/logs", "["+strings.Join(records, ",")+"]"); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	body, _ = rest("GET", "/metrics", "")
+	if !strings.Contains(string(body), `log_agg_ingested_messages_total{input="http",type="_other",priority="_other"} `) ||
+		strings.Contains(string(body), `type="metrics-109"`) {
+		t.Errorf("ingested types aren't bounded")
+	}
+}
+
+// test the retention dry run
+func TestRetention(t *testing.T) {
+	body, err := rest("GET", "/retention", "")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	var report struct {
+		Rules   map[string]map[string]interface{} `json:"rules"`
+		Buckets []output.Expiry                   `json:"buckets"`
+	}
+	if err = json.Unmarshal(body, &report); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if report.Rules["app"]["age"] != "336h0m0s" || report.Buckets == nil {
+		t.Errorf("%q doesn't match expected out", body)
+	}
+
+	// nothing is old enough to be deleted
+	for _, e := range report.Buckets {
+		if e.Records == 0 || e.Deleted != 0 {
+			t.Errorf("%+v doesn't match expected out", e)
+		}
+	}
+}
+
+// test streaming new logs as server-sent events
+func TestStreamEvents(t *testing.T) {
+	res, err := http.Get(fmt.Sprintf("http://%s/logs/stream?type=stream&id=sse-test", insecureHttp))
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer res.Body.Close()
+
+	reader := bufio.NewReader(res.Body)
+	// wait until subscribed
+	if line, err := reader.ReadString('\n'); err != nil || line != ": subscribed\n" {
+		t.Errorf("%q doesn't match expected out - %v", line, err)
+		t.FailNow()
+	}
+
+	_, err = rest("POST", "/logs", `{"id":"other","type":"stream","message":"filtered log"}`)
+	if err == nil {
+		_, err = rest("POST", "/logs", `{"id":"sse-test","type":"stream","message":"streamed log"}`)
+	}
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	var line string
+	for line == "" || line == "\n" {
+		if line, err = reader.ReadString('\n'); err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+	}
+	msg := log_agg.Message{}
+	if !strings.HasPrefix(line, "data: ") || json.Unmarshal([]byte(line[6:]), &msg) != nil || msg.Content != "streamed log" {
+		t.Errorf("%q doesn't match expected out", line)
+	}
+}
+
+// test streaming new logs over a websocket
+func TestStreamWebsocket(t *testing.T) {
+	conn, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://%s/logs/stream?type=stream&tag=ws", insecureHttp), nil)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer conn.Close()
+	// subscription happens after the upgrade
+	time.Sleep(100 * time.Millisecond)
+
+	_, err = rest("POST", "/logs", `{"id":"ws-test","tag":["ws"],"type":"stream","message":"websocket log"}`)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	msg := log_agg.Message{}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if err = conn.ReadJSON(&msg); err != nil || msg.Content != "websocket log" {
+		t.Errorf("%+v doesn't match expected out - %v", msg, err)
+	}
+
+	// only origins cors allows may upgrade
+	cors := config.CorsAllow
+	config.CorsAllow = "https://logs.example.com"
+	defer func() { config.CorsAllow = cors }()
+	for origin, allowed := range map[string]bool{"https://logs.example.com": true, "https://evil.example.com": false, "": true} {
+		header := http.Header{}
+		if origin != "" {
+			header.Set("Origin", origin)
+		}
+		conn, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://%s/logs/stream?type=stream", insecureHttp), header)
+		if (err == nil) != allowed {
+			t.Errorf("upgrade from '%s' - %v", origin, err)
+		}
+		if conn != nil {
+			conn.Close()
+		}
+	}
+}
 
 // hit api and return response body
 func rest(method, route, data string) ([]byte, error) {
@@ -138,6 +757,8 @@ func initialize() {
 	http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
 	insecureHttp = "0.0.0.0:2234"
 	config.ListenHttp = "0.0.0.0:2234"
+	config.ListenUdp = "0.0.0.0:2235"
+	config.ListenTcp = "0.0.0.0:2235"
 	config.DbAddress = "boltdb:///tmp/apiTest/log_agg.bolt"
 	config.Log = lumber.NewConsoleLogger(lumber.LvlInt("ERROR"))
 
@@ -0,0 +1,203 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/r0h4n/log_agg/config"
+	"github.com/r0h4n/log_agg/output"
+)
+
+// most intervals a histogram may have
+const maxIntervals = 10000
+
+type (
+	// histogram is the response of `/logs/stats`, logs counted per interval
+	histogram struct {
+		Interval int64             `json:"interval"` // nanoseconds
+		By       string            `json:"by,omitempty"`
+		Groups   []string          `json:"groups,omitempty"` // every group counted, sorted
+		Buckets  []histogramBucket `json:"buckets"`          // every interval in the range, oldest first
+	}
+
+	histogramBucket struct {
+		Time   int64            `json:"time"` // start of the interval (unix epoch nanoseconds)
+		Total  int64            `json:"total"`
+		Counts map[string]int64 `json:"counts,omitempty"` // by group, zero for groups without any
+	}
+)
+
+// GenerateStatsEndpoint generates the endpoint counting logs per interval,
+// filtered like `/logs` and optionally grouped
+func GenerateStatsEndpoint(archive output.Output) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		// /logs/stats?type=app&interval=1m&by=id&start=0&end=0
+		filter, status, err := parseLogFilter(req)
+		if err != nil {
+			res.WriteHeader(status)
+			res.Write([]byte(err.Error()))
+			return
+		}
+
+		params := req.URL.Query()
+		text := params.Get("interval")
+		if text == "" {
+			text = "1m"
+		}
+		interval, err := time.ParseDuration(text)
+		if err != nil || interval <= 0 {
+			res.WriteHeader(400)
+			res.Write([]byte(fmt.Sprintf("bad interval - '%s' isn't a positive duration (30s, 5m, 1h)", text)))
+			return
+		}
+		// start is the newest time counted, end the oldest
+		if filter.start < 0 || filter.end < 0 || (filter.start != 0 && filter.end > filter.start) {
+			res.WriteHeader(400)
+			res.Write([]byte(fmt.Sprintf("bad range - start %d and end %d aren't an end before (or at) a start after the epoch", filter.start, filter.end)))
+			return
+		}
+		by := params.Get("by")
+		if !output.CountBy[by] {
+			res.WriteHeader(400)
+			res.Write([]byte(fmt.Sprintf("bad by - '%s' isn't id, tag, type, or priority", by)))
+			return
+		}
+		config.Log.Trace("type: %s, start: %d, end: %d, interval: %s, by: %s, level: %d, id: %s, tag: %s, q: %s",
+			filter.kinds, filter.start, filter.end, interval, by, filter.level, filter.host, filter.tag, filter.q)
+
+		// a range that's too many intervals is refused before counting it (the
+		// range reaches at least to now without a start)
+		if filter.end != 0 {
+			last := time.Now().UnixNano()
+			if filter.start != 0 {
+				last = filter.start
+			}
+			if _, err := intervals(filter.end, last, int64(interval)); err != nil {
+				res.WriteHeader(400)
+				res.Write([]byte(fmt.Sprintf("bad interval - %s", err)))
+				return
+			}
+		}
+
+		counts := output.Counts{}
+		for _, kind := range filter.kinds {
+			kindCounts, err := archive.Count(kind, filter.host, filter.tag, filter.start, filter.end, int64(interval), filter.level, filter.q, by)
+			if err != nil {
+				res.WriteHeader(500)
+				res.Write([]byte(err.Error()))
+				return
+			}
+			for utime, counted := range kindCounts {
+				counts.Add(utime, counted.Total)
+				for group, n := range counted.Groups {
+					counts.AddGroup(utime, group, n)
+				}
+			}
+		}
+
+		hist, err := newHistogram(counts, filter, int64(interval), by)
+		if err != nil {
+			res.WriteHeader(400)
+			res.Write([]byte(fmt.Sprintf("bad interval - %s", err)))
+			return
+		}
+		body, err := json.Marshal(hist)
+		if err != nil {
+			res.WriteHeader(500)
+			res.Write([]byte(err.Error()))
+			return
+		}
+
+		res.WriteHeader(200)
+		res.Write(append(body, byte('\n')))
+	}
+}
+
+// newHistogram lays counts out over every interval in the filter's range (or,
+// without one, from the first interval counted to the last)
+func newHistogram(counts output.Counts, filter *logFilter, interval int64, by string) (*histogram, error) {
+	hist := &histogram{Interval: interval, By: by, Buckets: []histogramBucket{}}
+
+	first, last := int64(math.MaxInt64), int64(math.MinInt64)
+	seen := map[string]bool{}
+	for utime, counted := range counts {
+		if utime < first {
+			first = utime
+		}
+		if utime > last {
+			last = utime
+		}
+		for group := range counted.Groups {
+			if !seen[group] {
+				seen[group] = true
+				hist.Groups = append(hist.Groups, group)
+			}
+		}
+	}
+	switch {
+	case filter.start != 0:
+		last = output.IntervalStart(filter.start, interval)
+	case filter.end != 0:
+		// up to now, or logs dated after it
+		if now := output.IntervalStart(time.Now().UnixNano(), interval); now > last {
+			last = now
+		}
+	}
+	if filter.end != 0 {
+		first = output.IntervalStart(filter.end, interval)
+	}
+	if first > last {
+		return hist, nil
+	}
+
+	n, err := intervals(first, last, interval)
+	if err != nil {
+		return nil, err
+	}
+
+	if by == "" {
+		hist.Groups = nil
+	}
+	sort.Strings(hist.Groups)
+	for i := int64(0); i < n; i++ {
+		utime := first + i*interval
+		bucket := histogramBucket{Time: utime}
+		if by != "" {
+			bucket.Counts = make(map[string]int64, len(hist.Groups))
+			for _, group := range hist.Groups {
+				bucket.Counts[group] = 0
+			}
+		}
+		if counted, ok := counts[utime]; ok {
+			bucket.Total = counted.Total
+			if by != "" {
+				for group, n := range counted.Groups {
+					bucket.Counts[group] = n
+				}
+			}
+		}
+		hist.Buckets = append(hist.Buckets, bucket)
+	}
+
+	return hist, nil
+}
+
+// intervals returns the number of intervals from the one first is in to the one
+// last is in, erroring if it's more than maxIntervals
+func intervals(first, last, interval int64) (int64, error) {
+	first, last = output.IntervalStart(first, interval), output.IntervalStart(last, interval)
+	if first > last {
+		return 0, nil
+	}
+
+	// the span can be more than an int64 holds, but not a uint64
+	n := (uint64(last)-uint64(first))/uint64(interval) + 1
+	if n > maxIntervals {
+		return 0, fmt.Errorf("%s from %d to %d is more than %d intervals", time.Duration(interval), first, last, maxIntervals)
+	}
+	return int64(n), nil
+}
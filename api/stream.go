@@ -0,0 +1,238 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/jcelliott/lumber"
+
+	"github.com/r0h4n/log_agg/auth"
+	"github.com/r0h4n/log_agg/config"
+	"github.com/r0h4n/log_agg/transform"
+)
+
+// number of messages buffered per subscriber before new ones are dropped
+const streamBuffer = 256
+
+var (
+	// counter used to give each subscriber a unique output tag
+	subscribers uint64
+
+	upgrader = websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		CheckOrigin:     checkOrigin,
+	}
+)
+
+type (
+	// streamFilter holds the `/logs` style filters of a subscriber
+	streamFilter struct {
+		tenant string
+		kind   string
+		host   string
+		tag    []string
+		level  int
+	}
+
+	// subscriber is a temporary output feeding a single stream
+	subscriber struct {
+		filter   streamFilter
+		messages chan log_agg.Message
+		dropped  uint64
+	}
+)
+
+// checkOrigin allows websocket upgrades from the origins config.CorsAllow
+// does, as browsers don't apply cors to them. Requests without an origin (not
+// from a browser) or from the api's own are always allowed.
+func checkOrigin(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" || config.CorsAllow == "*" || origin == config.CorsAllow {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, req.Host)
+}
+
+// GenerateStreamEndpoint generates the endpoint that streams new logs as they
+// arrive, over a websocket if requested, otherwise as server-sent events
+func GenerateStreamEndpoint() http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		// /logs/stream?id=&type=app&tag=&level=
+		query := req.URL.Query()
+
+		level := query.Get("level")
+		if level == "" {
+			level = "TRACE"
+		}
+		filter := streamFilter{
+			tenant: auth.Tenant(req.Context()),
+			kind:   query.Get("type"),
+			host:   query.Get("id"),
+			tag:    query["tag"],
+			level:  lumber.LvlInt(level),
+		}
+		if filter.kind == "" {
+			filter.kind = config.LogType
+		}
+
+		if strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+			streamWebsocket(res, req, filter)
+			return
+		}
+		streamEvents(res, req, filter)
+	}
+}
+
+// subscribe registers a temporary output for the filter. The returned func
+// removes it.
+func subscribe(filter streamFilter) (*subscriber, func()) {
+	sub := &subscriber{
+		filter:   filter,
+		messages: make(chan log_agg.Message, streamBuffer),
+	}
+	tag := fmt.Sprintf("stream-%d", atomic.AddUint64(&subscribers, 1))
+
+	log_agg.AddOutput(tag, sub.write)
+	config.Log.Debug("Stream subscriber '%s' added", tag)
+
+	return sub, func() {
+		log_agg.RemoveOutput(tag)
+		config.Log.Debug("Stream subscriber '%s' removed (%d messages dropped)", tag, atomic.LoadUint64(&sub.dropped))
+	}
+}
+
+// write queues matching messages without ever blocking the other outputs
+func (s *subscriber) write(msg log_agg.Message) {
+	if !s.filter.matches(msg) {
+		return
+	}
+
+	select {
+	case s.messages <- msg:
+	default:
+		atomic.AddUint64(&s.dropped, 1)
+	}
+}
+
+func (f streamFilter) matches(msg log_agg.Message) bool {
+	if msg.Tenant != f.tenant || msg.Type != f.kind || msg.Priority < f.level {
+		return false
+	}
+	if f.host != "" && msg.Id != f.host {
+		return false
+	}
+	if len(f.tag) == 0 {
+		return true
+	}
+	for x := range msg.Tag {
+		for y := range f.tag {
+			if f.tag[y] == "" || msg.Tag[x] == f.tag[y] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// streams messages as server-sent events
+func streamEvents(res http.ResponseWriter, req *http.Request, filter streamFilter) {
+	flusher, ok := res.(http.Flusher)
+	if !ok {
+		res.WriteHeader(500)
+		res.Write([]byte("streaming unsupported"))
+		return
+	}
+
+	sub, unsubscribe := subscribe(filter)
+	defer unsubscribe()
+
+	res.Header().Set("Content-Type", "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.WriteHeader(200)
+	res.Write([]byte(": subscribed\n\n"))
+	flusher.Flush()
+
+	keepalive := time.NewTicker(30 * time.Second)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case <-shuttingDown:
+			return
+		case <-keepalive.C:
+			res.Write([]byte(": keepalive\n\n"))
+			flusher.Flush()
+		case msg := <-sub.messages:
+			msg.Raw = nil
+			body, err := json.Marshal(msg)
+			if err != nil {
+				config.Log.Error("Stream failed to marshal message - %s", err)
+				continue
+			}
+			_, err = res.Write([]byte(fmt.Sprintf("data: %s\n\n", body)))
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// streams messages as json websocket messages
+func streamWebsocket(res http.ResponseWriter, req *http.Request, filter streamFilter) {
+	conn, err := upgrader.Upgrade(res, req, nil)
+	if err != nil {
+		// upgrader already responded
+		config.Log.Debug("Stream websocket upgrade failed - %s", err)
+		return
+	}
+	defer conn.Close()
+
+	sub, unsubscribe := subscribe(filter)
+	defer unsubscribe()
+
+	// the client never sends anything meaningful, but reading is needed to
+	// notice it going away
+	closed := make(chan bool)
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	keepalive := time.NewTicker(30 * time.Second)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-closed:
+			return
+		case <-shuttingDown:
+			conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "shutting down"), time.Now().Add(time.Second))
+			return
+		case <-keepalive.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second)); err != nil {
+				return
+			}
+		case msg := <-sub.messages:
+			msg.Raw = nil
+			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := conn.WriteJSON(msg); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package api
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	"github.com/r0h4n/log_agg/config"
+)
+
+// how long file changes must settle before certificates are reloaded (a
+// certificate and key are rarely written at once)
+const reloadDelay = 100 * time.Millisecond
+
+// certReloader holds the api's tls config, rebuilding it when the
+// certificate, key, or client ca files change
+type certReloader struct {
+	certFile      string
+	keyFile       string
+	caFile        string
+	requireClient bool
+
+	mutex  sync.RWMutex
+	config *tls.Config
+}
+
+// tlsListen wraps the listener with tls if a certificate is configured
+func tlsListen(listener net.Listener) (net.Listener, error) {
+	if config.TlsCert == "" && config.TlsKey == "" {
+		if config.TlsClientCA != "" {
+			return nil, fmt.Errorf("tls-client-ca requires tls-cert and tls-key")
+		}
+		if config.TlsRequireClient {
+			return nil, fmt.Errorf("tls-require-client requires tls-cert, tls-key, and tls-client-ca")
+		}
+		return listener, nil
+	}
+	if config.TlsCert == "" || config.TlsKey == "" {
+		return nil, fmt.Errorf("tls-cert and tls-key must be set together")
+	}
+	if config.TlsRequireClient && config.TlsClientCA == "" {
+		return nil, fmt.Errorf("tls-require-client requires tls-client-ca")
+	}
+
+	reloader := &certReloader{
+		certFile:      config.TlsCert,
+		keyFile:       config.TlsKey,
+		caFile:        config.TlsClientCA,
+		requireClient: config.TlsRequireClient,
+	}
+	err := reloader.reload()
+	if err != nil {
+		return nil, err
+	}
+	err = reloader.watch()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to watch certificates - %s", err)
+	}
+
+	return tls.NewListener(listener, &tls.Config{GetConfigForClient: reloader.getConfig}), nil
+}
+
+// reload reads the files, keeping the current config if any are bad
+func (r *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("Failed to load certificate - %s", err)
+	}
+
+	c := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if r.caFile != "" {
+		ca, err := ioutil.ReadFile(r.caFile)
+		if err != nil {
+			return fmt.Errorf("Failed to load client ca - %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return fmt.Errorf("Failed to load client ca - no certificates in '%s'", r.caFile)
+		}
+
+		c.ClientCAs = pool
+		c.ClientAuth = tls.VerifyClientCertIfGiven
+		if r.requireClient {
+			c.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	r.mutex.Lock()
+	r.config = c
+	r.mutex.Unlock()
+	return nil
+}
+
+func (r *certReloader) getConfig(*tls.ClientHelloInfo) (*tls.Config, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.config, nil
+}
+
+// watch reloads the certificates when their files change. The directories are
+// watched so files replaced by a rename (or a symlink swap, as with
+// kubernetes secrets) are noticed.
+func (r *certReloader) watch() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	dirs := map[string]bool{}
+	for _, file := range []string{r.certFile, r.keyFile, r.caFile} {
+		if file != "" {
+			dirs[filepath.Dir(file)] = true
+		}
+	}
+	for dir := range dirs {
+		if err = watcher.Add(dir); err != nil {
+			watcher.Close()
+			return err
+		}
+	}
+
+	reload := func() {
+		if err := r.reload(); err != nil {
+			config.Log.Error("Failed to reload api certificates, keeping the current ones - %s", err)
+			return
+		}
+		config.Log.Info("Api certificates reloaded")
+	}
+
+	go func() {
+		var timer *time.Timer
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if event.Op == fsnotify.Chmod {
+					continue
+				}
+				if timer == nil {
+					timer = time.AfterFunc(reloadDelay, reload)
+				} else {
+					timer.Reset(reloadDelay)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				config.Log.Error("Certificate watch failed - %s", err)
+			}
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,177 @@
+package api_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/r0h4n/log_agg/api"
+	"github.com/r0h4n/log_agg/config"
+	"github.com/r0h4n/log_agg/input"
+	"github.com/r0h4n/log_agg/transform"
+)
+
+// test serving the api over tls, identifying clients by certificate, and
+// reloading certificates
+func TestTLS(t *testing.T) {
+	dir := "/tmp/apiTest/tls"
+	os.MkdirAll(dir, 0755)
+
+	ca, caKey := newCert(t, "test-ca", nil, nil)
+	writePem(t, dir+"/ca.pem", "CERTIFICATE", ca.Raw)
+	server, serverKey := newCert(t, "log_agg", ca, caKey)
+	writeKeyPair(t, dir, server, serverKey)
+	client, clientKey := newCert(t, "client-a", ca, caKey)
+
+	listen := config.ListenHttp
+	config.ListenHttp = "127.0.0.1:2236"
+	config.TlsCert = dir + "/cert.pem"
+	config.TlsKey = dir + "/key.pem"
+	config.TlsClientCA = dir + "/ca.pem"
+	serve, err := api.Listen(input.InputHandler)
+	config.ListenHttp, config.TlsCert, config.TlsKey, config.TlsClientCA = listen, "", "", ""
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	go serve()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	clientKeyDer, _ := x509.MarshalECPrivateKey(clientKey)
+	clientPair, err := tls.X509KeyPair(
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: client.Raw}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: clientKeyDer}))
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	// new connection per request, to see reloaded certificates
+	newClient := func(certs ...tls.Certificate) *http.Client {
+		return &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: roots, ServerName: "127.0.0.1", Certificates: certs},
+			DisableKeepAlives: true,
+		}}
+	}
+
+	// the client certificate's cn is the id
+	res, err := newClient(clientPair).Post("https://127.0.0.1:2236/logs", "application/json",
+		strings.NewReader(`{"id":"spoofed","type":"tls","message":"mutual tls"}`))
+	if err != nil || res.StatusCode != 200 {
+		t.Errorf("post over mutual tls failed - %v", err)
+		t.FailNow()
+	}
+	res.Body.Close()
+
+	// clients without a certificate are still allowed
+	res, err = newClient().Post("https://127.0.0.1:2236/logs", "application/json",
+		strings.NewReader(`{"id":"anonymous","type":"tls","message":"tls"}`))
+	if err != nil || res.StatusCode != 200 {
+		t.Errorf("post over tls failed - %v", err)
+		t.FailNow()
+	}
+	res.Body.Close()
+	time.Sleep(500 * time.Millisecond)
+
+	res, err = newClient().Get("https://127.0.0.1:2236/logs?type=tls")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	msgs := []log_agg.Message{}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err = json.Unmarshal(body, &msgs); err != nil || len(msgs) != 2 || msgs[0].Id != "client-a" || msgs[1].Id != "anonymous" {
+		t.Errorf("%q doesn't match expected out", body)
+	}
+
+	// replaced certificates are served to new connections
+	reloaded, reloadedKey := newCert(t, "reloaded", ca, caKey)
+	writeKeyPair(t, dir, reloaded, reloadedKey)
+	time.Sleep(time.Second)
+
+	res, err = newClient().Get("https://127.0.0.1:2236/logs?type=tls")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	res.Body.Close()
+	if cn := res.TLS.PeerCertificates[0].Subject.CommonName; cn != "reloaded" {
+		t.Errorf("served certificate '%s' wasn't reloaded", cn)
+	}
+
+	// requiring client certificates without a ca to verify them fails to start
+	config.ListenHttp = "127.0.0.1:2237"
+	config.TlsCert, config.TlsKey, config.TlsRequireClient = dir+"/cert.pem", dir+"/key.pem", true
+	_, err = api.Listen(input.InputHandler)
+	config.ListenHttp, config.TlsCert, config.TlsKey, config.TlsRequireClient = listen, "", "", false
+	if err == nil || !strings.Contains(err.Error(), "tls-client-ca") {
+		t.Errorf("tls-require-client without tls-client-ca is too forgiving - %v", err)
+	}
+}
+
+// creates a certificate signed by parent (self signed if nil)
+func newCert(t *testing.T, cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return cert, key
+}
+
+func writeKeyPair(t *testing.T, dir string, cert *x509.Certificate, key *ecdsa.PrivateKey) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	writePem(t, dir+"/key.pem", "EC PRIVATE KEY", der)
+	writePem(t, dir+"/cert.pem", "CERTIFICATE", cert.Raw)
+}
+
+func writePem(t *testing.T, file, kind string, der []byte) {
+	err := ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0600)
+	if err != nil {
+		t.Error(fmt.Errorf("Failed to write '%s' - %s", file, err))
+		t.FailNow()
+	}
+}
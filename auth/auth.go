@@ -0,0 +1,201 @@
+// Package auth manages the api keys that authenticate api requests. Every key
+// is bound to a tenant whose logs are archived apart from other tenants'.
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/r0h4n/log_agg/output"
+)
+
+type (
+	// Key is an api key. Only a hash of its token is stored.
+	Key struct {
+		Id      string    `json:"id"`     // public identifier, used to remove the key
+		Tenant  string    `json:"tenant"` // tenant whose logs the key posts and reads ("" is the default tenant)
+		Scopes  []string  `json:"scopes"`
+		Created time.Time `json:"created"`
+	}
+
+	contextKey struct{}
+)
+
+const (
+	ScopeIngest = "ingest" // post logs
+	ScopeRead   = "read"   // get and stream logs
+	ScopeAdmin  = "admin"  // manage outputs and view redaction counts (not tenant specific)
+)
+
+var (
+	// Scopes are the valid key scopes
+	Scopes = []string{ScopeIngest, ScopeRead, ScopeAdmin}
+
+	// tenants name archive buckets, so keep them simple
+	tenantName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*$`)
+
+	// serializes changes to the stored keys
+	keysMutex sync.Mutex
+)
+
+// NewKey creates and stores a key for the tenant, returning its token (which
+// can't be recovered later)
+func NewKey(tenant string, scopes []string) (string, Key, error) {
+	if tenant != "" && !tenantName.MatchString(tenant) {
+		return "", Key{}, fmt.Errorf("Bad tenant '%s' - use letters, digits, '.', '_' and '-'", tenant)
+	}
+	if len(scopes) == 0 {
+		return "", Key{}, fmt.Errorf("Missing scope - one of %s", strings.Join(Scopes, ", "))
+	}
+	for _, scope := range scopes {
+		if !validScope(scope) {
+			return "", Key{}, fmt.Errorf("Bad scope '%s' - one of %s", scope, strings.Join(Scopes, ", "))
+		}
+	}
+
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return "", Key{}, fmt.Errorf("Failed to generate token - %s", err)
+	}
+	token := hex.EncodeToString(random)
+	hash := hashToken(token)
+
+	key := Key{
+		Id:      hash[:12],
+		Tenant:  tenant,
+		Scopes:  scopes,
+		Created: time.Now().UTC(),
+	}
+
+	keysMutex.Lock()
+	defer keysMutex.Unlock()
+
+	keys, err := load()
+	if err != nil {
+		return "", Key{}, err
+	}
+	keys[hash] = key
+
+	if err = output.Archiver.Save("_config", "keys", keys); err != nil {
+		return "", Key{}, err
+	}
+	return token, key, nil
+}
+
+// Keys returns the stored keys, oldest first
+func Keys() ([]Key, error) {
+	keys, err := load()
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]Key, 0, len(keys))
+	for _, key := range keys {
+		list = append(list, key)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Created.Equal(list[j].Created) {
+			return list[i].Id < list[j].Id
+		}
+		return list[i].Created.Before(list[j].Created)
+	})
+	return list, nil
+}
+
+// RemoveKey removes the key with the id
+func RemoveKey(id string) error {
+	keysMutex.Lock()
+	defer keysMutex.Unlock()
+
+	keys, err := load()
+	if err != nil {
+		return err
+	}
+
+	for hash, key := range keys {
+		if key.Id == id {
+			delete(keys, hash)
+			return output.Archiver.Save("_config", "keys", keys)
+		}
+	}
+	return fmt.Errorf("No key '%s'", id)
+}
+
+// Lookup returns the key of the token
+func Lookup(token string) (*Key, error) {
+	if token == "" {
+		return nil, fmt.Errorf("Missing api key")
+	}
+
+	keys, err := load()
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok := keys[hashToken(token)]
+	if !ok {
+		return nil, fmt.Errorf("Bad api key")
+	}
+	return &key, nil
+}
+
+// Can reports whether the key has the scope
+func (k Key) Can(scope string) bool {
+	for i := range k.Scopes {
+		if k.Scopes[i] == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// NewContext returns a copy of ctx carrying the request's key
+func NewContext(ctx context.Context, key *Key) context.Context {
+	return context.WithValue(ctx, contextKey{}, key)
+}
+
+// FromContext returns the request's key, if any
+func FromContext(ctx context.Context) *Key {
+	key, _ := ctx.Value(contextKey{}).(*Key)
+	return key
+}
+
+// Tenant returns the tenant of the request's key ("" without one)
+func Tenant(ctx context.Context) string {
+	if key := FromContext(ctx); key != nil {
+		return key.Tenant
+	}
+	return ""
+}
+
+// load reads the stored keys, by token hash
+func load() (map[string]Key, error) {
+	keys := map[string]Key{}
+	err := output.Archiver.Get("_config", "keys", &keys)
+	if err != nil && !strings.Contains(err.Error(), "No value found") && !strings.Contains(err.Error(), "No bucket found") {
+		return nil, fmt.Errorf("Failed to load keys - %s", err)
+	}
+	return keys, nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func validScope(scope string) bool {
+	for i := range Scopes {
+		if Scopes[i] == scope {
+			return true
+		}
+	}
+	return false
+}
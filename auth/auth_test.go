@@ -0,0 +1,97 @@
+// auth_test tests creating, looking up, and removing api keys
+package auth_test
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/jcelliott/lumber"
+
+	"github.com/r0h4n/log_agg/auth"
+	"github.com/r0h4n/log_agg/config"
+	"github.com/r0h4n/log_agg/output"
+)
+
+func TestMain(m *testing.M) {
+	// clean test dir
+	os.RemoveAll("/tmp/authTest")
+
+	config.Log = lumber.NewConsoleLogger(lumber.LvlInt("ERROR"))
+	config.DbAddress = "boltdb:///tmp/authTest/log_agg.bolt"
+	archive, err := output.OpenArchive()
+	if err != nil {
+		os.Exit(1)
+	}
+	output.Archiver = archive
+
+	rtn := m.Run()
+
+	archive.Close()
+	// clean test dir
+	os.RemoveAll("/tmp/authTest")
+
+	os.Exit(rtn)
+}
+
+// Test creating and looking up keys
+func TestKeys(t *testing.T) {
+	// no keys yet
+	if _, err := auth.Lookup("nothing"); err == nil {
+		t.Error("lookup without keys is too forgiving")
+	}
+
+	token, key, err := auth.NewKey("team-a", []string{auth.ScopeIngest})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	_, _, err = auth.NewKey("", []string{auth.ScopeRead, auth.ScopeAdmin})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	found, err := auth.Lookup(token)
+	if err != nil || found.Id != key.Id || found.Tenant != "team-a" || !found.Can(auth.ScopeIngest) || found.Can(auth.ScopeRead) {
+		t.Errorf("%+v doesn't match expected out - %v", found, err)
+	}
+	if _, err = auth.Lookup(token + "0"); err == nil {
+		t.Error("lookup of a bad key is too forgiving")
+	}
+
+	ctx := auth.NewContext(context.Background(), found)
+	if auth.Tenant(ctx) != "team-a" || auth.Tenant(context.Background()) != "" {
+		t.Errorf("context tenant '%s' doesn't match expected out", auth.Tenant(ctx))
+	}
+
+	keys, err := auth.Keys()
+	if err != nil || len(keys) != 2 || keys[0].Id != key.Id {
+		t.Errorf("%+v doesn't match expected out - %v", keys, err)
+	}
+
+	if err = auth.RemoveKey(key.Id); err != nil {
+		t.Error(err)
+	}
+	if err = auth.RemoveKey(key.Id); err == nil {
+		t.Error("removing a missing key is too forgiving")
+	}
+	if _, err = auth.Lookup(token); err == nil {
+		t.Error("lookup of a removed key is too forgiving")
+	}
+}
+
+// Test bad keys aren't created
+func TestBadKeys(t *testing.T) {
+	bad := map[string][]string{
+		"team/a": []string{auth.ScopeRead},
+		"_team":  []string{auth.ScopeRead},
+		"team-b": []string{"write"},
+		"team-c": nil,
+	}
+	for tenant, scopes := range bad {
+		if _, _, err := auth.NewKey(tenant, scopes); err == nil {
+			t.Errorf("key for '%s' %q is too forgiving", tenant, scopes)
+		}
+	}
+}
@@ -2,6 +2,8 @@
 package config
 
 import (
+	"encoding/json"
+	"fmt"
 	"path/filepath"
 
 	"github.com/jcelliott/lumber"
@@ -12,36 +14,159 @@ import (
 var (
 	// inputs
 	ListenHttp = "0.0.0.0:6360" // address the api and http log inputs listen on
+	ListenUdp  = "0.0.0.0:514"  // address the udp syslog input listens on
+	ListenTcp  = "0.0.0.0:6361" // address the tcp syslog input listens on
+
+	// gelf (graylog) inputs, disabled when empty
+	ListenGelfUdp = "" // address the udp gelf input listens on (chunked, gzip or zlib compressed)
+	ListenGelfTcp = "" // address the tcp gelf input listens on (null byte delimited)
+
+	// fluentd forward input (docker's fluentd log driver, fluent-bit), disabled when empty
+	ListenForward = "" // address the tcp forward (msgpack) input listens on
+
+	// raw tcp inputs
+	RawTcp []RawTcpConfig // listeners for json or plain text logs '[{"address":"0.0.0.0:6362","framing":"newline"}]' (config file only)
+
+	// api tls (certificates are reloaded when their files change)
+	TlsCert          = ""    // certificate file, serves the api over https when set with TlsKey
+	TlsKey           = ""    // private key file of TlsCert
+	TlsClientCA      = ""    // ca file to verify client certificates with, a verified client's cn becomes its logs' id
+	TlsRequireClient = false // reject clients without a certificate verified by TlsClientCA
+
+	// file inputs
+	Files []FileConfig // files to tail '[{"path":"/var/log/app/*.log","type":"app"}]' (config file only)
 
 	// outputs
-	DbAddress  = "boltdb:///var/db/log_agg.bolt" // database address
+	DbAddress   = "boltdb:///var/db/log_agg.bolt" // database address
+	SearchIndex = false                           // keep an inverted word index of message content (boltdb only)
+	Forwarders  []map[string]string               // third party outputs '[{"type":"papertrail","endpoint":"logs.papertrailapp.com:1234"}]' (config file only)
+
+	// archive size (boltdb only)
+	ArchiveMaxBytes     = ""  // bytes of logs to keep in all ("10GB"), the oldest of any type are expired past it
+	ArchiveCompactRatio = 0.5 // compact the db file once this fraction of it is free after expiring (0 never)
+
+	// output queues
+	QueueSize     = 1000                    // messages each output may have queued before QueuePolicy applies
+	QueuePolicy   = "block"                 // what to do with messages for a full queue (block, drop-oldest, drop-newest, spill)
+	QueueSpillDir = "/var/db/log_agg-spill" // directory queues with the spill policy overflow to
+	Queues        map[string]QueueConfig    // size and policy per output tag '{"historical":{"policy":"spill"}}' (config file only)
 
 	// other
+	Auth      = false          // require an api key (see `log_agg keys`) for every api route
 	CorsAllow = "*"            // sets `Access-Control-Allow-Origin` header
-	LogKeep   = `{"app":"2w"}` // LogType and expire (X(m)in, (h)our,  (d)ay, (w)eek, (y)ear) (1, 10, 100 == keep up to that many) // todo: maybe map[string]interface
+	LogKeep   = `{"app":"2w"}` // LogType and retention rule, an age (X(s)ec, (m)in, (h)our, (d)ay, (w)eek, (y)ear), a count (1, 10, 100 == keep up to that many), or both '{"age":"2w","max":1000,"maxBytes":"1GB"}' ("*" applies to unlisted types)
 	LogType   = "app"          // default incoming log type when not set
 	LogLevel  = "info"         // level which log_agg will log at
 	Log       lumber.Logger    // logger to write logs
 	Version   = false          // whether or not to print version info and exit
 	CleanFreq = 60             // how often to clean log database
+	// how long shutdown waits for requests and outputs to finish (seconds)
+	ShutdownTimeout = 10
+
+	// transform
+	RedactRegex []RedactRule      // ordered rules used to scrub messages before they are output (config file only)
+	Processors  []ProcessorConfig // ordered processors applied to messages before they are output (config file only)
+	Multiline   []MultilineConfig // combine consecutive messages (stack traces) into one before they're processed (config file only)
 )
 
+// ProcessorConfig defines a built-in transform processor. Kind is one of
+// "set", "rename", "delete", "route" or "drop"; it only applies to messages
+// whose fields match every regex in Match
+type ProcessorConfig struct {
+	Name  string            `mapstructure:"name"`
+	Kind  string            `mapstructure:"kind"`
+	Field string            `mapstructure:"field"` // field to set, rename, or delete
+	Value string            `mapstructure:"value"` // value to set
+	To    string            `mapstructure:"to"`    // field to rename to, or type to route to
+	Match map[string]string `mapstructure:"match"` // field name to regex
+}
+
+// MultilineConfig combines consecutive messages with the same id and tags,
+// whose fields match every regex in Match, into one event (a stack trace). An
+// event carries on with every line not matching Start or, set instead, with
+// each line matching Continue.
+type MultilineConfig struct {
+	Match    map[string]string `mapstructure:"match"`     // field name to regex
+	Start    string            `mapstructure:"start"`     // regex of an event's first line
+	Continue string            `mapstructure:"continue"`  // regex of an event's following lines
+	Timeout  string            `mapstructure:"timeout"`   // how long an event waits for its next line (defaults to "1s")
+	MaxBytes int               `mapstructure:"max-bytes"` // longest event (defaults to 64KB), a line past it starts a new one
+}
+
+// RawTcpConfig defines a tcp listener for logs framed by newlines ("newline"),
+// octet counts ("octet", as in "10 a log line") or null bytes ("null"). Each
+// frame is a json message or, failing that, the content of one. Id, Type and
+// Tag are set on logs without them, unless the connection's handshake sets its
+// own.
+type RawTcpConfig struct {
+	Address   string `mapstructure:"address"`
+	Framing   string `mapstructure:"framing"`   // defaults to "newline"
+	Id        string `mapstructure:"id"`        // id of the logs
+	Type      string `mapstructure:"type"`      // type of the logs (defaults to LogType)
+	Tag       string `mapstructure:"tag"`       // tag of the logs (none if empty)
+	Handshake bool   `mapstructure:"handshake"` // a connection's first frame is a json object of its id, type and tag
+}
+
+// FileConfig defines files tailed as logs, every line of a file matching Path
+// (a glob, wildcards in directories are expanded on start) becomes a message.
+// Id and Tag are templates ("$1", "${name}") expanded with Pattern's groups
+// matched against the file's path.
+type FileConfig struct {
+	Path    string `mapstructure:"path"`
+	Type    string `mapstructure:"type"`    // type of the logs (defaults to LogType)
+	Pattern string `mapstructure:"pattern"` // regex of the path (defaults to one with groups "dir", "file", and "name", the file without extension)
+	Id      string `mapstructure:"id"`      // id of the logs (defaults to "${name}")
+	Tag     string `mapstructure:"tag"`     // tag of the logs (none if empty)
+}
+
+// QueueConfig overrides QueueSize and QueuePolicy for an output's queue
+type QueueConfig struct {
+	Size   int    `mapstructure:"size"`
+	Policy string `mapstructure:"policy"`
+}
+
+// RedactRule defines a named regex whose matches get replaced (`$1` style
+// templates are expanded) in a message's content, raw, and optionally tags
+type RedactRule struct {
+	Name    string `mapstructure:"name"`
+	Regex   string `mapstructure:"regex"`
+	Replace string `mapstructure:"replace"`
+	Tag     bool   `mapstructure:"tag"`
+}
+
 // AddFlags adds cli flags to log_agg
 func AddFlags(cmd *cobra.Command) {
 	// inputs
 	cmd.Flags().StringVarP(&ListenHttp, "listen-http", "a", ListenHttp, "API listen address (same endpoint for http log collection)")
+	cmd.Flags().StringVarP(&ListenUdp, "listen-udp", "u", ListenUdp, "Syslog udp listen address")
+	cmd.Flags().StringVarP(&ListenTcp, "listen-tcp", "t", ListenTcp, "Syslog tcp listen address")
+	cmd.Flags().StringVar(&ListenGelfUdp, "listen-gelf-udp", ListenGelfUdp, "GELF udp listen address (disabled if empty)")
+	cmd.Flags().StringVar(&ListenGelfTcp, "listen-gelf-tcp", ListenGelfTcp, "GELF tcp listen address (disabled if empty)")
+	cmd.Flags().StringVar(&ListenForward, "listen-forward", ListenForward, "Fluentd forward protocol tcp listen address (disabled if empty)")
+	cmd.Flags().StringVar(&TlsCert, "tls-cert", TlsCert, "Certificate file to serve the API over https with")
+	cmd.Flags().StringVar(&TlsKey, "tls-key", TlsKey, "Private key file of the tls-cert")
+	cmd.Flags().StringVar(&TlsClientCA, "tls-client-ca", TlsClientCA, "CA file to verify API client certificates with (a client's CN becomes its logs' id)")
+	cmd.Flags().BoolVar(&TlsRequireClient, "tls-require-client", TlsRequireClient, "Require API clients to present a certificate verified by tls-client-ca")
 
 	// outputs
 	cmd.Flags().StringVarP(&DbAddress, "db-address", "d", DbAddress, "Log storage address")
+	cmd.Flags().BoolVar(&SearchIndex, "search-index", SearchIndex, "Keep a word index of log content to speed up searches (boltdb only)")
+	cmd.Flags().StringVar(&ArchiveMaxBytes, "archive-max-bytes", ArchiveMaxBytes, "Bytes of logs to keep in all, expiring the oldest of any type past it ('10GB') (boltdb only)")
+	cmd.Flags().Float64Var(&ArchiveCompactRatio, "archive-compact-ratio", ArchiveCompactRatio, "Compact the archive once this fraction of it is free after expiring logs (0 never) (boltdb only)")
+	cmd.Flags().IntVar(&QueueSize, "queue-size", QueueSize, "Messages each output may have queued before the queue-policy applies")
+	cmd.Flags().StringVar(&QueuePolicy, "queue-policy", QueuePolicy, "What to do with messages for a full output queue (block|drop-oldest|drop-newest|spill)")
+	cmd.Flags().StringVar(&QueueSpillDir, "queue-spill-dir", QueueSpillDir, "Directory output queues with the spill policy overflow to")
 
 	// other
+	cmd.Flags().BoolVar(&Auth, "auth", Auth, "Require an api key for every api route (manage keys with 'log_agg keys')")
 	cmd.Flags().StringVarP(&CorsAllow, "cors-allow", "C", CorsAllow, "Sets the 'Access-Control-Allow-Origin' header")
-	cmd.Flags().StringVarP(&LogKeep, "log-keep", "k", LogKeep, "Age or number of logs to keep per type '{\"app\":\"2w\", \"deploy\": 10}' (int or X(m)in, (h)our,  (d)ay, (w)eek, (y)ear)")
+	cmd.Flags().StringVarP(&LogKeep, "log-keep", "k", LogKeep, "Age or number of logs to keep per type '{\"app\":\"2w\", \"deploy\": 10}' (int or X(m)in, (h)our,  (d)ay, (w)eek, (y)ear, or an object of age, max, and maxBytes)")
 	cmd.Flags().StringVarP(&LogLevel, "log-level", "l", LogLevel, "Level at which to log")
 	cmd.Flags().StringVarP(&LogType, "log-type", "L", LogType, "Default type to apply to incoming logs (commonly used: app|deploy)")
 	cmd.Flags().BoolVarP(&Version, "version", "v", Version, "Print version info and exit")
 	cmd.Flags().IntVar(&CleanFreq, "clean-frequency", CleanFreq, "How often to clean log database")
 	cmd.Flags().MarkHidden("clean-frequency")
+	cmd.Flags().IntVar(&ShutdownTimeout, "shutdown-timeout", ShutdownTimeout, "Seconds to wait on shutdown for requests and outputs to finish")
 
 	Log = lumber.NewConsoleLogger(lumber.LvlInt("ERROR"))
 }
@@ -54,11 +179,28 @@ func ReadConfigFile(configFile string) error {
 
 	// Set defaults to whatever might be there already
 	viper.SetDefault("listen-http", ListenHttp)
+	viper.SetDefault("listen-udp", ListenUdp)
+	viper.SetDefault("listen-tcp", ListenTcp)
+	viper.SetDefault("listen-gelf-udp", ListenGelfUdp)
+	viper.SetDefault("listen-gelf-tcp", ListenGelfTcp)
+	viper.SetDefault("listen-forward", ListenForward)
+	viper.SetDefault("tls-cert", TlsCert)
+	viper.SetDefault("tls-key", TlsKey)
+	viper.SetDefault("tls-client-ca", TlsClientCA)
+	viper.SetDefault("tls-require-client", TlsRequireClient)
 	viper.SetDefault("db-address", DbAddress)
+	viper.SetDefault("search-index", SearchIndex)
+	viper.SetDefault("archive-max-bytes", ArchiveMaxBytes)
+	viper.SetDefault("archive-compact-ratio", ArchiveCompactRatio)
+	viper.SetDefault("queue-size", QueueSize)
+	viper.SetDefault("queue-policy", QueuePolicy)
+	viper.SetDefault("queue-spill-dir", QueueSpillDir)
+	viper.SetDefault("auth", Auth)
 	viper.SetDefault("cors-allow", CorsAllow)
 	viper.SetDefault("log-keep", LogKeep)
 	viper.SetDefault("log-level", LogLevel)
 	viper.SetDefault("log-type", LogType)
+	viper.SetDefault("shutdown-timeout", ShutdownTimeout)
 
 	filename := filepath.Base(configFile)
 	viper.SetConfigName(filename[:len(filename)-len(filepath.Ext(filename))])
@@ -71,11 +213,66 @@ func ReadConfigFile(configFile string) error {
 
 	// Set values. Config file will override commandline
 	ListenHttp = viper.GetString("listen-http")
+	ListenUdp = viper.GetString("listen-udp")
+	ListenTcp = viper.GetString("listen-tcp")
+	ListenGelfUdp = viper.GetString("listen-gelf-udp")
+	ListenGelfTcp = viper.GetString("listen-gelf-tcp")
+	ListenForward = viper.GetString("listen-forward")
+	TlsCert = viper.GetString("tls-cert")
+	TlsKey = viper.GetString("tls-key")
+	TlsClientCA = viper.GetString("tls-client-ca")
+	TlsRequireClient = viper.GetBool("tls-require-client")
 	DbAddress = viper.GetString("db-address")
+	SearchIndex = viper.GetBool("search-index")
+	ArchiveMaxBytes = viper.GetString("archive-max-bytes")
+	ArchiveCompactRatio = viper.GetFloat64("archive-compact-ratio")
+	QueueSize = viper.GetInt("queue-size")
+	QueuePolicy = viper.GetString("queue-policy")
+	QueueSpillDir = viper.GetString("queue-spill-dir")
+	Auth = viper.GetBool("auth")
 	CorsAllow = viper.GetString("cors-allow")
-	LogKeep = viper.GetString("log-keep")
+	// log-keep may be a json string, or an object in the config file
+	switch keep := viper.Get("log-keep").(type) {
+	case string:
+		LogKeep = keep
+	default:
+		data, err := json.Marshal(keep)
+		if err != nil {
+			return fmt.Errorf("Bad log-keep - %s", err)
+		}
+		LogKeep = string(data)
+	}
 	LogLevel = viper.GetString("log-level")
 	LogType = viper.GetString("log-type")
+	ShutdownTimeout = viper.GetInt("shutdown-timeout")
+
+	if err = viper.UnmarshalKey("raw-tcp", &RawTcp); err != nil {
+		return fmt.Errorf("Bad raw-tcp - %s", err)
+	}
+
+	if err = viper.UnmarshalKey("files", &Files); err != nil {
+		return fmt.Errorf("Bad files - %s", err)
+	}
+
+	if err = viper.UnmarshalKey("forwarders", &Forwarders); err != nil {
+		return fmt.Errorf("Bad forwarders - %s", err)
+	}
+
+	if err = viper.UnmarshalKey("queues", &Queues); err != nil {
+		return fmt.Errorf("Bad queues - %s", err)
+	}
+
+	if err = viper.UnmarshalKey("redact-regex", &RedactRegex); err != nil {
+		return fmt.Errorf("Bad redact-regex - %s", err)
+	}
+
+	if err = viper.UnmarshalKey("processors", &Processors); err != nil {
+		return fmt.Errorf("Bad processors - %s", err)
+	}
+
+	if err = viper.UnmarshalKey("multiline", &Multiline); err != nil {
+		return fmt.Errorf("Bad multiline - %s", err)
+	}
 
 	return nil
 }
@@ -0,0 +1,346 @@
+package input
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	"github.com/r0h4n/log_agg/config"
+	"github.com/r0h4n/log_agg/output"
+	"github.com/r0h4n/log_agg/transform"
+)
+
+const (
+	// longest line read from a file, longer ones are split
+	maxFileLine = 1024 * 1024
+
+	// bytes at the start of a file checkpointed to tell whether it's still
+	// the same file on restart
+	fileHeadSize = 256
+)
+
+var (
+	// how often files are checked without an event (missed events, or
+	// filesystems without notifications), and their offsets saved
+	filePoll       = 5 * time.Second
+	fileCheckpoint = time.Second
+
+	// groups the file's path is matched with when not configured
+	defaultFilePattern = regexp.MustCompile(`^(?:(?P<dir>.*)/)?(?P<file>(?P<name>[^/]*?)(?:\.[^./]*)?)$`)
+)
+
+type (
+	// fileTailer tails the files matching a FileConfig's glob
+	fileTailer struct {
+		config  config.FileConfig
+		pattern *regexp.Regexp
+		watcher *fsnotify.Watcher
+		files   map[string]*tailedFile // by path
+		moved   []*tailedFile          // renamed (or removed) files, read until the next poll
+	}
+
+	// tailedFile is an open file and the offset of its next line
+	tailedFile struct {
+		path    string
+		file    *os.File
+		offset  int64
+		pending []byte // read past offset, without a newline yet
+		saved   bool   // offset is checkpointed
+		movedAt time.Time
+	}
+
+	// fileOffset is a file's checkpoint
+	fileOffset struct {
+		Offset int64  `json:"offset"`
+		Head   []byte `json:"head"` // the file's first bytes (up to fileHeadSize, and offset)
+	}
+)
+
+// FileStart tails the files matching c.Path, starting with those that already
+// exist. Files are read from their checkpointed offset, or from the start. The
+// returned closer stops tailing (as does Close).
+func FileStart(c config.FileConfig) (io.Closer, error) {
+	if _, err := filepath.Match(c.Path, ""); err != nil || c.Path == "" {
+		return nil, fmt.Errorf("Bad file path '%s'", c.Path)
+	}
+
+	t := &fileTailer{config: c, pattern: defaultFilePattern, files: map[string]*tailedFile{}}
+	if t.config.Type == "" {
+		t.config.Type = config.LogType
+	}
+	if t.config.Id == "" {
+		t.config.Id = "${name}"
+	}
+	if c.Pattern != "" {
+		var err error
+		if t.pattern, err = regexp.Compile(c.Pattern); err != nil {
+			return nil, fmt.Errorf("Bad file pattern '%s' - %s", c.Pattern, err)
+		}
+	}
+
+	// watch the directories, so new and rotated files are noticed
+	dirs, err := filepath.Glob(filepath.Dir(c.Path))
+	if err != nil || len(dirs) == 0 {
+		return nil, fmt.Errorf("No directories match '%s'", filepath.Dir(c.Path))
+	}
+	if t.watcher, err = fsnotify.NewWatcher(); err != nil {
+		return nil, err
+	}
+	for _, dir := range dirs {
+		if err = t.watcher.Add(dir); err != nil {
+			t.watcher.Close()
+			return nil, fmt.Errorf("Failed to watch '%s' - %s", dir, err)
+		}
+	}
+
+	if !startReader(t) {
+		return nil, fmt.Errorf("Inputs are closed")
+	}
+	go t.run()
+
+	return t, nil
+}
+
+// Close stops tailing, the files are read to their end and checkpointed first
+func (t *fileTailer) Close() error {
+	return t.watcher.Close()
+}
+
+func (t *fileTailer) run() {
+	defer stopReader(t)
+
+	poll := time.NewTicker(filePoll)
+	defer poll.Stop()
+	checkpoint := time.NewTicker(fileCheckpoint)
+	defer checkpoint.Stop()
+
+	t.scan()
+	for {
+		select {
+		case event, ok := <-t.watcher.Events:
+			if !ok {
+				t.stop()
+				return
+			}
+			t.handle(event)
+		case err, ok := <-t.watcher.Errors:
+			if ok {
+				config.Log.Error("File watch failed - %s", err)
+			}
+		case <-poll.C:
+			t.scan()
+		case <-checkpoint.C:
+			t.checkpoint()
+		}
+	}
+}
+
+// scan opens new files matching the glob and reads every file
+func (t *fileTailer) scan() {
+	paths, _ := filepath.Glob(t.config.Path)
+	for _, path := range paths {
+		if t.files[path] == nil {
+			t.open(path)
+		}
+	}
+	for _, f := range t.files {
+		t.read(f)
+	}
+
+	// renamed files are kept open a poll in case they were renamed to a
+	// matching path
+	moved := t.moved[:0]
+	for _, f := range t.moved {
+		t.read(f)
+		if time.Since(f.movedAt) < filePoll {
+			moved = append(moved, f)
+			continue
+		}
+		f.file.Close()
+	}
+	t.moved = moved
+}
+
+func (t *fileTailer) handle(event fsnotify.Event) {
+	path := filepath.Clean(event.Name)
+	if match, _ := filepath.Match(t.config.Path, path); !match {
+		return
+	}
+
+	f := t.files[path]
+	switch {
+	case event.Op&(fsnotify.Rename|fsnotify.Remove) != 0:
+		// read what was written before it moved, a new file may take its place
+		if f != nil {
+			t.read(f)
+			delete(t.files, path)
+			f.movedAt = time.Now()
+			t.moved = append(t.moved, f)
+			output.Archiver.Save("_files", path, fileOffset{})
+		}
+	case f == nil:
+		t.open(path)
+	default:
+		t.read(f)
+	}
+}
+
+// open starts tailing the file at path. A renamed file that is being tailed
+// carries on from its offset, others from their checkpoint, or the start.
+func (t *fileTailer) open(path string) {
+	info, err := os.Stat(path)
+	if err != nil || info.IsDir() {
+		return
+	}
+
+	for i, f := range t.moved {
+		if moved, err := f.file.Stat(); err == nil && os.SameFile(info, moved) {
+			t.moved = append(t.moved[:i], t.moved[i+1:]...)
+			f.path, f.saved = path, false
+			t.files[path] = f
+			t.read(f)
+			return
+		}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		config.Log.Error("Failed to open '%s' - %s", path, err)
+		return
+	}
+	f := &tailedFile{path: path, file: file}
+
+	saved := fileOffset{}
+	if err = output.Archiver.Get("_files", path, &saved); err == nil && saved.Offset > 0 && saved.Offset <= info.Size() {
+		head := make([]byte, len(saved.Head))
+		if _, err = file.ReadAt(head, 0); err == nil && bytes.Equal(head, saved.Head) {
+			f.offset, f.saved = saved.Offset, true
+		}
+	}
+	if _, err = file.Seek(f.offset, io.SeekStart); err != nil {
+		config.Log.Error("Failed to seek '%s' - %s", path, err)
+		file.Close()
+		return
+	}
+
+	config.Log.Debug("Tailing '%s' from %d", path, f.offset)
+	t.files[path] = f
+	t.read(f)
+}
+
+// read writes the file's new lines as messages
+func (t *fileTailer) read(f *tailedFile) {
+	// truncated (copytruncate rotation), start over
+	if info, err := f.file.Stat(); err == nil && info.Size() < f.offset+int64(len(f.pending)) {
+		config.Log.Debug("'%s' was truncated, reading from the start", f.path)
+		f.offset, f.pending, f.saved = 0, nil, false
+		if _, err = f.file.Seek(0, io.SeekStart); err != nil {
+			config.Log.Error("Failed to seek '%s' - %s", f.path, err)
+			return
+		}
+	}
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := f.file.Read(buf)
+		if n > 0 {
+			received("file", n)
+			f.pending = append(f.pending, buf[:n]...)
+			t.lines(f)
+		}
+		if err != nil {
+			if err != io.EOF {
+				config.Log.Error("Failed to read '%s' - %s", f.path, err)
+			}
+			return
+		}
+	}
+}
+
+// lines writes the pending complete lines (and overlong ones)
+func (t *fileTailer) lines(f *tailedFile) {
+	for {
+		end := bytes.IndexByte(f.pending, '\n')
+		size := end + 1
+		if end < 0 {
+			if len(f.pending) < maxFileLine {
+				return
+			}
+			end, size = maxFileLine, maxFileLine
+		}
+
+		line := bytes.TrimRight(f.pending[:end], "\r")
+		if len(line) > 0 {
+			msg := t.message(f.path, line)
+			ingested("file", msg)
+			log_agg.WriteMessage(msg)
+		}
+		f.pending = f.pending[size:]
+		f.offset += int64(size)
+		f.saved = false
+	}
+}
+
+// message makes a message of a line, with the id and tag of its path
+func (t *fileTailer) message(path string, line []byte) log_agg.Message {
+	pattern := t.pattern
+	match := pattern.FindStringSubmatchIndex(path)
+	if match == nil {
+		pattern, match = defaultFilePattern, defaultFilePattern.FindStringSubmatchIndex(path)
+	}
+
+	msg := log_agg.Message{
+		Id:       string(pattern.ExpandString(nil, t.config.Id, path, match)),
+		Type:     t.config.Type,
+		Priority: 2,
+		Content:  string(line),
+	}
+	if tag := string(pattern.ExpandString(nil, t.config.Tag, path, match)); tag != "" {
+		msg.Tag = []string{tag}
+	}
+	msg.Time = time.Now()
+	msg.UTime = msg.Time.UnixNano()
+
+	return msg
+}
+
+// checkpoint saves the offsets that changed
+func (t *fileTailer) checkpoint() {
+	for _, f := range t.files {
+		if f.saved {
+			continue
+		}
+
+		head := make([]byte, fileHeadSize)
+		if f.offset < fileHeadSize {
+			head = head[:f.offset]
+		}
+		n, _ := f.file.ReadAt(head, 0)
+		if err := output.Archiver.Save("_files", f.path, fileOffset{Offset: f.offset, Head: head[:n]}); err != nil {
+			config.Log.Error("Failed to checkpoint '%s' - %s", f.path, err)
+			continue
+		}
+		f.saved = true
+	}
+}
+
+// stop reads the files to their end, checkpoints, and closes them
+func (t *fileTailer) stop() {
+	for _, f := range t.moved {
+		t.read(f)
+		f.file.Close()
+	}
+	for _, f := range t.files {
+		t.read(f)
+	}
+	t.checkpoint()
+	for _, f := range t.files {
+		f.file.Close()
+	}
+}
@@ -0,0 +1,301 @@
+package input
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/r0h4n/log_agg/config"
+	"github.com/r0h4n/log_agg/output"
+	"github.com/r0h4n/log_agg/transform"
+)
+
+// largest forward message (or decompressed chunk of packed events) we will
+// accept, and about the most memory either may decode into
+const maxForwardMessage = 16 * 1024 * 1024
+
+// receivedReader counts the bytes an input reads
+type receivedReader struct {
+	r     io.Reader
+	input string
+}
+
+// ForwardStart starts a fluentd forward protocol (msgpack over tcp) listener
+// on address. Message, Forward, PackedForward and CompressedPackedForward
+// modes are accepted, and chunks acknowledged when asked to.
+func ForwardStart(address string) error {
+	serverSocket, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	if !startReader(serverSocket) {
+		return fmt.Errorf("Inputs are closed")
+	}
+
+	go func() {
+		defer stopReader(serverSocket)
+		for {
+			conn, err := serverSocket.Accept()
+			if err != nil {
+				if !isClosing() {
+					config.Log.Error("Forward tcp accept failed - %s", err)
+				}
+				return
+			}
+			if !startReader(conn) {
+				return
+			}
+			go func() {
+				defer stopReader(conn)
+				handleForwardConnection(conn)
+			}()
+		}
+	}()
+
+	return nil
+}
+
+// reads forward messages from a tcp connection until it is closed, or sends
+// one that's bad (which isn't acknowledged, so the client may retry)
+func handleForwardConnection(conn net.Conn) {
+	defer conn.Close()
+
+	d := &msgpackDecoder{r: bufio.NewReader(receivedReader{r: conn, input: "forward"})}
+	for {
+		entry, err := d.decode(maxForwardMessage)
+		if err != nil {
+			if err != io.EOF {
+				config.Log.Debug("Forward connection closed - %s", err)
+			}
+			return
+		}
+
+		msgs, chunk, err := parseForward(entry)
+		if err != nil {
+			config.Log.Debug("Forward connection closed, bad message - %s", err)
+			return
+		}
+		if len(msgs) > 0 {
+			ingested("forward", msgs...)
+			log_agg.WriteMessages(msgs)
+		}
+
+		// acknowledge once the messages are queued for the outputs
+		if chunk != "" {
+			ack := appendMsgpackString([]byte{0x81, 0xa3, 'a', 'c', 'k'}, chunk)
+			if _, err = conn.Write(ack); err != nil {
+				config.Log.Debug("Forward connection closed - %s", err)
+				return
+			}
+		}
+	}
+}
+
+// parseForward converts a forward message, [tag, time, record, option] (Message
+// mode), [tag, [[time, record], ...], option] (Forward mode), or [tag, packed
+// events, option] (PackedForward mode, gzipped when option's "compressed" is
+// "gzip"), into messages. It also returns the option's "chunk", if any, to be
+// acknowledged.
+func parseForward(entry interface{}) ([]log_agg.Message, string, error) {
+	fields, ok := entry.([]interface{})
+	if !ok || len(fields) < 2 {
+		return nil, "", fmt.Errorf("Not an array of a tag and events")
+	}
+	tag, ok := msgpackString(fields[0])
+	if !ok {
+		return nil, "", fmt.Errorf("Bad tag")
+	}
+
+	var events []interface{}
+	var option interface{}
+	switch second := fields[1].(type) {
+	case []interface{}:
+		events = second
+		if len(fields) > 2 {
+			option = fields[2]
+		}
+	case []byte, string:
+		if len(fields) > 2 {
+			option = fields[2]
+		}
+		packed, _ := msgpackString(second)
+		var err error
+		if events, err = unpackForward([]byte(packed), option); err != nil {
+			return nil, "", err
+		}
+	default:
+		if len(fields) < 3 {
+			return nil, "", fmt.Errorf("Missing record")
+		}
+		events = []interface{}{[]interface{}{fields[1], fields[2]}}
+		if len(fields) > 3 {
+			option = fields[3]
+		}
+	}
+
+	var chunk string
+	if options, ok := option.(map[string]interface{}); ok {
+		chunk, _ = msgpackString(options["chunk"])
+	}
+
+	msgs := make([]log_agg.Message, 0, len(events))
+	for i := range events {
+		event, ok := events[i].([]interface{})
+		if !ok || len(event) < 2 {
+			return nil, "", fmt.Errorf("Event %d isn't an array of a time and record", i)
+		}
+		record, ok := event[1].(map[string]interface{})
+		if !ok {
+			return nil, "", fmt.Errorf("Event %d's record isn't a map", i)
+		}
+		msgs = append(msgs, forwardMessage(tag, event[0], record))
+	}
+
+	return msgs, chunk, nil
+}
+
+// unpackForward decodes the events packed in a PackedForward message
+func unpackForward(packed []byte, option interface{}) ([]interface{}, error) {
+	var r io.Reader = bytes.NewReader(packed)
+	if options, ok := option.(map[string]interface{}); ok {
+		switch compressed, _ := msgpackString(options["compressed"]); compressed {
+		case "", "text":
+		case "gzip":
+			gz, err := gzip.NewReader(r)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to decompress - %s", err)
+			}
+			defer gz.Close()
+			data, err := ioutil.ReadAll(io.LimitReader(gz, maxForwardMessage+1))
+			if err != nil {
+				return nil, fmt.Errorf("Failed to decompress - %s", err)
+			}
+			if len(data) > maxForwardMessage {
+				return nil, fmt.Errorf("Decompressed events longer than %d bytes", maxForwardMessage)
+			}
+			r = bytes.NewReader(data)
+		default:
+			return nil, fmt.Errorf("Unknown compression '%s'", compressed)
+		}
+	}
+
+	// the events share a budget, as they share their message
+	var events []interface{}
+	d := &msgpackDecoder{r: r, budget: maxForwardMessage}
+	for {
+		event, err := d.value(0)
+		if err == io.EOF {
+			return events, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Bad packed events - %s", err)
+		}
+		events = append(events, event)
+	}
+}
+
+// forwardMessage converts an event into a message. The fluentd tag becomes
+// the message's tag, and the record's "message" (or docker's "log") its
+// content. A record's "id" (or "host", or docker's "container_name"), "type"
+// (if valid) and "priority" are used as such, the rest are kept as fields.
+func forwardMessage(tag string, eventTime interface{}, record map[string]interface{}) log_agg.Message {
+	msg := log_agg.Message{Type: config.LogType, Priority: 2}
+	if tag != "" {
+		msg.Tag = []string{tag}
+	}
+
+	fields := log_agg.Fields{}
+	for key, value := range record {
+		record[key] = jsonValue(value)
+		fields[key] = record[key]
+	}
+	take := func(keys ...string) string {
+		for _, key := range keys {
+			if s, ok := fields[key].(string); ok && s != "" {
+				delete(fields, key)
+				return s
+			}
+		}
+		return ""
+	}
+
+	// docker's lines end with their newline
+	msg.Content = strings.TrimRight(take("message", "log"), "\r\n")
+	msg.Id = strings.TrimPrefix(take("id", "host", "container_name"), "/")
+	// a bad type is kept as a field, the log as the default type
+	if kind, ok := fields["type"].(string); ok && output.ValidType(kind) == nil {
+		msg.Type = kind
+		delete(fields, "type")
+	}
+	if priority, ok := fields["priority"].(float64); ok && priority >= 0 && priority <= 5 && priority == math.Trunc(priority) {
+		msg.Priority = int(priority)
+		delete(fields, "priority")
+	}
+	if len(fields) > 0 {
+		msg.Fields = fields
+	}
+	// records without a message are kept whole as the content too
+	if msg.Content == "" {
+		content, _ := json.Marshal(record)
+		msg.Content = string(content)
+	}
+
+	switch t := eventTime.(type) {
+	case time.Time:
+		msg.Time = t
+	case float64:
+		sec, frac := math.Modf(t)
+		msg.Time = time.Unix(int64(sec), int64(frac*1e9))
+	}
+	if msg.Time.IsZero() || msg.Time.Unix() <= 0 {
+		msg.Time = time.Now()
+	}
+	msg.UTime = msg.Time.UnixNano()
+
+	return msg
+}
+
+// jsonValue converts a decoded msgpack value into what json would decode it
+// as (binary as strings, event times as their unix epoch in seconds)
+func jsonValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case []byte:
+		return string(v)
+	case time.Time:
+		return float64(v.UnixNano()) / 1e9
+	case []interface{}:
+		for i := range v {
+			v[i] = jsonValue(v[i])
+		}
+	case map[string]interface{}:
+		for key := range v {
+			v[key] = jsonValue(v[key])
+		}
+	}
+	return value
+}
+
+// msgpackString returns a msgpack str, or bin, as a string
+func msgpackString(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case []byte:
+		return string(v), true
+	}
+	return "", false
+}
+
+func (r receivedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	received(r.input, n)
+	return n, err
+}
@@ -0,0 +1,392 @@
+package input
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/r0h4n/log_agg/config"
+	"github.com/r0h4n/log_agg/transform"
+)
+
+const (
+	// largest udp datagram
+	maxGelfDatagram = 64 * 1024
+
+	// largest gelf message (reassembled and decompressed) we will accept
+	maxGelfMessage = 1024 * 1024
+
+	// chunks a gelf message may be split into, and the header each starts with
+	// (magic, message id, sequence number, sequence count)
+	maxGelfChunks   = 128
+	gelfChunkHeader = 12
+
+	// most messages waiting for their chunks (the oldest are dropped past it),
+	// and the bytes each is counted as holding before its chunks' (its entry,
+	// and a slice header per chunk)
+	maxGelfPending      = 4096
+	gelfPendingOverhead = 256
+	gelfPartOverhead    = 24
+)
+
+var (
+	// how long chunks wait for the rest of their message, and the most bytes
+	// all waiting chunks may hold (the oldest messages are dropped past it)
+	gelfChunkTimeout = 5 * time.Second
+	gelfChunkBudget  = 16 * 1024 * 1024
+
+	gelfChunkMagic = []byte{0x1e, 0x0f}
+)
+
+type (
+	// gelfChunks reassembles chunked gelf messages
+	gelfChunks struct {
+		mutex    sync.Mutex              // guards the rest, expire runs on a timer
+		messages map[string]*gelfChunked // by message id
+		order    *list.List              // of *gelfChunked, oldest first
+		bytes    int                     // held by waiting messages, with their overhead
+	}
+
+	// gelfChunked is a message waiting for its chunks
+	gelfChunked struct {
+		id      string
+		parts   [][]byte
+		count   int // parts received
+		bytes   int
+		started time.Time
+		elem    *list.Element // in order
+	}
+)
+
+// GelfUDPStart starts a udp gelf listener on address
+func GelfUDPStart(address string) error {
+	udpAddress, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.ListenUDP("udp", udpAddress)
+	if err != nil {
+		return err
+	}
+	if !startReader(conn) {
+		return fmt.Errorf("Inputs are closed")
+	}
+
+	chunks := newGelfChunks()
+	done := make(chan struct{})
+	go chunks.expireEvery(gelfChunkTimeout/5, done)
+
+	go func() {
+		defer stopReader(conn)
+		defer close(done)
+		buf := make([]byte, maxGelfDatagram)
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				if !isClosing() {
+					config.Log.Error("Gelf udp read failed - %s", err)
+				}
+				return
+			}
+			received("gelf-udp", n)
+
+			datagram := make([]byte, n)
+			copy(datagram, buf[:n])
+			if bytes.HasPrefix(datagram, gelfChunkMagic) {
+				datagram, err = chunks.add(datagram, time.Now())
+				if err != nil {
+					config.Log.Debug("Dropped gelf chunk - %s", err)
+				}
+				if datagram == nil {
+					continue
+				}
+			}
+			writeGelf("gelf-udp", datagram)
+		}
+	}()
+
+	return nil
+}
+
+// GelfTCPStart starts a tcp gelf listener on address
+func GelfTCPStart(address string) error {
+	serverSocket, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	if !startReader(serverSocket) {
+		return fmt.Errorf("Inputs are closed")
+	}
+
+	go func() {
+		defer stopReader(serverSocket)
+		for {
+			conn, err := serverSocket.Accept()
+			if err != nil {
+				if !isClosing() {
+					config.Log.Error("Gelf tcp accept failed - %s", err)
+				}
+				return
+			}
+			if !startReader(conn) {
+				return
+			}
+			go func() {
+				defer stopReader(conn)
+				handleGelfConnection(conn)
+			}()
+		}
+	}()
+
+	return nil
+}
+
+// reads null byte delimited messages from a tcp connection until it is closed
+func handleGelfConnection(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	for {
+		frame, err := readGelfFrame(r)
+		if len(frame) > 0 {
+			received("gelf-tcp", len(frame))
+			writeGelf("gelf-tcp", frame)
+		}
+		if err != nil {
+			if err != io.EOF {
+				config.Log.Debug("Gelf tcp connection closed - %s", err)
+			}
+			return
+		}
+	}
+}
+
+// readGelfFrame reads up to the next null byte, dropping the whitespace some
+// clients send around it
+func readGelfFrame(r *bufio.Reader) ([]byte, error) {
+	frame, err := readDelimited(r, 0, maxGelfMessage)
+	return bytes.TrimSpace(frame), err
+}
+
+// writeGelf decompresses and writes a gelf message
+func writeGelf(input string, payload []byte) {
+	payload, err := decompressGelf(payload)
+	if err != nil {
+		config.Log.Debug("Dropped gelf message - %s", err)
+		return
+	}
+
+	msg := parseGelf(payload)
+	ingested(input, msg)
+	log_agg.WriteMessage(msg)
+}
+
+// decompressGelf inflates gzip or zlib payloads, others are returned as-is
+func decompressGelf(payload []byte) ([]byte, error) {
+	var r io.ReadCloser
+	var err error
+	switch {
+	case len(payload) > 1 && payload[0] == 0x1f && payload[1] == 0x8b:
+		r, err = gzip.NewReader(bytes.NewReader(payload))
+	case len(payload) > 1 && payload[0]&0x0f == 8 && (int(payload[0])<<8|int(payload[1]))%31 == 0:
+		r, err = zlib.NewReader(bytes.NewReader(payload))
+	default:
+		return payload, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decompress - %s", err)
+	}
+	defer r.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(r, maxGelfMessage+1))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decompress - %s", err)
+	}
+	if len(data) > maxGelfMessage {
+		return nil, fmt.Errorf("Decompressed message longer than %d bytes", maxGelfMessage)
+	}
+	return data, nil
+}
+
+// parseGelf converts a gelf message into a message, falling back to storing
+// the payload as-is if it isn't gelf. The host becomes the id, the full (or
+// short) message the content, the facility a tag, and additional ("_") and
+// unknown attributes fields.
+func parseGelf(payload []byte) log_agg.Message {
+	msg, err := parseGelfAttributes(payload)
+	if err != nil {
+		config.Log.Trace("Failed to parse gelf - %s", err)
+		msg = log_agg.Message{
+			Content:  string(payload),
+			Priority: 2,
+			Tag:      []string{"gelf-raw"},
+		}
+	}
+
+	msg.Raw = payload
+	msg.Type = config.LogType
+	msg.Time = time.Now()
+	msg.UTime = msg.Time.UnixNano()
+
+	return msg
+}
+
+func parseGelfAttributes(payload []byte) (log_agg.Message, error) {
+	// gelf's default level is 1 (alert)
+	msg := log_agg.Message{Priority: syslogSeverity[1]}
+
+	var attributes map[string]interface{}
+	if err := json.Unmarshal(payload, &attributes); err != nil {
+		return msg, err
+	}
+
+	var short, full string
+	for key, value := range attributes {
+		switch key {
+		case "version", "timestamp":
+			// the time is when it's received, as for other inputs
+		case "host":
+			msg.Id, _ = value.(string)
+		case "short_message":
+			short, _ = value.(string)
+		case "full_message":
+			full, _ = value.(string)
+		case "level":
+			// a bad level keeps the default
+			if level, ok := value.(float64); ok && level >= 0 && level < float64(len(syslogSeverity)) {
+				msg.Priority = syslogSeverity[int(level)]
+			}
+		case "facility":
+			if facility, ok := value.(string); ok && facility != "" {
+				msg.Tag = []string{facility}
+			}
+		default:
+			if key = strings.TrimPrefix(key, "_"); key == "" {
+				continue
+			}
+			if msg.Fields == nil {
+				msg.Fields = log_agg.Fields{}
+			}
+			msg.Fields[key] = value
+		}
+	}
+
+	msg.Content = full
+	if full == "" {
+		msg.Content = short
+	}
+	if msg.Content == "" {
+		return msg, fmt.Errorf("Missing gelf short_message")
+	}
+
+	return msg, nil
+}
+
+func newGelfChunks() *gelfChunks {
+	return &gelfChunks{messages: map[string]*gelfChunked{}, order: list.New()}
+}
+
+// add adds a chunk of a message, returning the message once it has every chunk
+func (c *gelfChunks) add(chunk []byte, now time.Time) ([]byte, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.expire(now)
+
+	if len(chunk) < gelfChunkHeader {
+		return nil, fmt.Errorf("Truncated chunk header")
+	}
+	id, seq, total, data := string(chunk[2:10]), int(chunk[10]), int(chunk[11]), chunk[gelfChunkHeader:]
+	if total == 0 || total > maxGelfChunks || seq >= total {
+		return nil, fmt.Errorf("Bad chunk %d of %d", seq, total)
+	}
+	if total == 1 {
+		return data, nil
+	}
+
+	m := c.messages[id]
+	if m == nil {
+		m = &gelfChunked{id: id, parts: make([][]byte, total), started: now}
+		m.bytes = gelfPendingOverhead + total*gelfPartOverhead
+		c.bytes += m.bytes
+		c.messages[id] = m
+		m.elem = c.order.PushBack(m)
+	}
+	switch {
+	case len(m.parts) != total:
+		c.remove(m)
+		return nil, fmt.Errorf("Chunk %d of %d of a message of %d chunks", seq, total, len(m.parts))
+	case m.parts[seq] != nil:
+		// resent
+		return nil, nil
+	case m.bytes+len(data) > maxGelfMessage+gelfPendingOverhead+total*gelfPartOverhead:
+		c.remove(m)
+		return nil, fmt.Errorf("Chunked message longer than %d bytes", maxGelfMessage)
+	}
+
+	m.parts[seq] = data
+	m.count++
+	m.bytes += len(data)
+	c.bytes += len(data)
+
+	// make room, dropping the oldest messages
+	for c.bytes > gelfChunkBudget || len(c.messages) > maxGelfPending {
+		oldest := c.order.Front().Value.(*gelfChunked)
+		c.remove(oldest)
+		if oldest == m {
+			return nil, fmt.Errorf("Chunks over the %d byte budget", gelfChunkBudget)
+		}
+		config.Log.Debug("Dropped gelf message of %d chunks with %d, over the budget", len(oldest.parts), oldest.count)
+	}
+
+	if m.count < total {
+		return nil, nil
+	}
+	c.remove(m)
+	return bytes.Join(m.parts, nil), nil
+}
+
+// expireEvery expires messages every interval, so they don't wait on another
+// chunk arriving, until done is closed
+func (c *gelfChunks) expireEvery(interval time.Duration, done chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			c.mutex.Lock()
+			c.expire(now)
+			c.mutex.Unlock()
+		}
+	}
+}
+
+// expire drops the messages whose chunks have waited gelfChunkTimeout
+func (c *gelfChunks) expire(now time.Time) {
+	for c.order.Len() > 0 {
+		oldest := c.order.Front().Value.(*gelfChunked)
+		if now.Sub(oldest.started) < gelfChunkTimeout {
+			return
+		}
+		c.remove(oldest)
+		config.Log.Debug("Dropped gelf message of %d chunks with %d, timed out", len(oldest.parts), oldest.count)
+	}
+}
+
+func (c *gelfChunks) remove(m *gelfChunked) {
+	delete(c.messages, m.id)
+	c.bytes -= m.bytes
+	c.order.Remove(m.elem)
+}
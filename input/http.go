@@ -1,17 +1,40 @@
 package input
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"mime"
 	"net/http"
 	"strings"
 	"time"
 
+	"github.com/r0h4n/log_agg/auth"
 	"github.com/r0h4n/log_agg/config"
+	"github.com/r0h4n/log_agg/output"
 	"github.com/r0h4n/log_agg/transform"
 )
 
+type (
+	// BulkResult is the outcome of one record of a bulk post
+	BulkResult struct {
+		Line   int    `json:"line"`            // line (ndjson) or position (json array) of the record, from 1
+		Status string `json:"status"`          // "ok" or "failed"
+		Error  string `json:"error,omitempty"` // why the record failed
+	}
+
+	// BulkSummary is the response to a bulk post
+	BulkSummary struct {
+		Accepted int          `json:"accepted"`
+		Failed   int          `json:"failed"`
+		Results  []BulkResult `json:"results"`
+	}
+)
+
 // GenerateHttpInput creates and returns an http handler that can be dropped into the api.
+// A body holding a json array or newline delimited json (ndjson) is a bulk
+// post, its records are written together and a BulkSummary returned.
 func GenerateHttpInput() http.HandlerFunc {
 	return func(res http.ResponseWriter, req *http.Request) {
 		body, err := ioutil.ReadAll(req.Body)
@@ -19,6 +42,12 @@ func GenerateHttpInput() http.HandlerFunc {
 			res.WriteHeader(500)
 			return
 		}
+		received("http", len(body))
+
+		if records, ok := bulkRecords(req, body); ok {
+			writeBulk(res, req, records)
+			return
+		}
 
 		var msg log_agg.Message
 		err = json.Unmarshal(body, &msg)
@@ -35,16 +64,133 @@ func GenerateHttpInput() http.HandlerFunc {
 			msg.Tag = []string{"http-raw"}
 		}
 
-		if msg.Type == "" {
-			msg.Type = config.LogType
-		}
-		msg.Time = time.Now()
-		msg.UTime = msg.Time.UnixNano()
-
 		// config.Log.Trace("Message: %q", msg)
+		msg = stamp(msg, req)
+		if err = validate(msg); err != nil {
+			res.WriteHeader(400)
+			res.Write([]byte(err.Error()))
+			return
+		}
+		ingested("http", msg)
 		log_agg.WriteMessage(msg)
 
 		res.WriteHeader(200)
 		res.Write([]byte("success!\n"))
 	}
 }
+
+// stamp sets the message's time, tenant, and default type. The tenant is
+// always that of the request's api key, and the id that of a verified client
+// certificate, if any.
+func stamp(msg log_agg.Message, req *http.Request) log_agg.Message {
+	msg.Tenant = auth.Tenant(req.Context())
+	if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 {
+		if cn := req.TLS.VerifiedChains[0][0].Subject.CommonName; cn != "" {
+			msg.Id = cn
+		}
+	}
+	if msg.Type == "" {
+		msg.Type = config.LogType
+	}
+	msg.Time = time.Now()
+	msg.UTime = msg.Time.UnixNano()
+	return msg
+}
+
+// validate checks a posted message (single or bulk) can be archived
+func validate(msg log_agg.Message) error {
+	if msg.Content == "" {
+		return fmt.Errorf("missing message")
+	}
+	return output.ValidType(msg.Type)
+}
+
+// bulkRecords splits a bulk post into its records (blank ndjson lines are
+// nil). ndjson is detected by content type, or by a body of several lines
+// that isn't a single json object.
+func bulkRecords(req *http.Request, body []byte) ([][]byte, bool) {
+	trimmed := bytes.TrimSpace(body)
+
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		var records []json.RawMessage
+		if err := json.Unmarshal(trimmed, &records); err != nil {
+			// not an array of json values, keep as a raw message
+			return nil, false
+		}
+		lines := make([][]byte, len(records))
+		for i := range records {
+			lines[i] = records[i]
+		}
+		return lines, true
+	}
+
+	contentType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	switch contentType {
+	case "application/x-ndjson", "application/ndjson", "application/jsonl":
+	default:
+		if len(trimmed) == 0 || trimmed[0] != '{' || !bytes.Contains(trimmed, []byte("\n")) || json.Valid(trimmed) {
+			return nil, false
+		}
+	}
+
+	lines := bytes.Split(body, []byte("\n"))
+	// drop the final newline's empty line
+	if len(lines) > 1 && len(bytes.TrimSpace(lines[len(lines)-1])) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	for i := range lines {
+		if len(bytes.TrimSpace(lines[i])) == 0 {
+			lines[i] = nil
+		}
+	}
+	return lines, true
+}
+
+// writeBulk writes every valid record and responds with the results
+func writeBulk(res http.ResponseWriter, req *http.Request, records [][]byte) {
+	summary := BulkSummary{Results: make([]BulkResult, 0, len(records))}
+	msgs := make([]log_agg.Message, 0, len(records))
+
+	for i := range records {
+		if records[i] == nil {
+			continue
+		}
+
+		result := BulkResult{Line: i + 1, Status: "ok"}
+		var msg log_agg.Message
+		err := json.Unmarshal(records[i], &msg)
+		if err == nil {
+			msg = stamp(msg, req)
+			err = validate(msg)
+		}
+		if err != nil {
+			result.Status = "failed"
+			result.Error = err.Error()
+			summary.Failed++
+		} else {
+			msgs = append(msgs, msg)
+			summary.Accepted++
+		}
+		summary.Results = append(summary.Results, result)
+	}
+
+	if len(msgs) > 0 {
+		ingested("http", msgs...)
+		log_agg.WriteMessages(msgs)
+	}
+
+	body, err := json.Marshal(summary)
+	if err != nil {
+		res.WriteHeader(500)
+		res.Write([]byte(err.Error()))
+		return
+	}
+
+	// only fail the request if nothing was accepted
+	if summary.Accepted == 0 && summary.Failed > 0 {
+		res.WriteHeader(400)
+	} else {
+		res.WriteHeader(200)
+	}
+	res.Write(append(body, '\n'))
+}
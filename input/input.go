@@ -1,20 +1,97 @@
-// Package input initializes http servers for collecting logs.
+// Package input initializes http, syslog, gelf, fluentd forward and raw tcp
+// servers, and file tailers, for collecting logs.
 package input
 
 import (
+	"io"
 	"net/http"
+	"strconv"
+	"sync"
 
 	"github.com/r0h4n/log_agg/config"
+	"github.com/r0h4n/log_agg/metrics"
+	"github.com/r0h4n/log_agg/transform"
 )
 
+// most types the ingested messages metric is labeled with
+const maxTypeLabels = 100
+
 var (
 	// InputHandler handles the posting of logs via http. It is passed to
 	// the api on start.
 	InputHandler http.HandlerFunc
+
+	// listeners and connections being read, closed by Close
+	readers      = map[io.Closer]bool{}
+	readersMutex sync.Mutex
+	readersGroup sync.WaitGroup
+	closing      bool
+
+	// types ingested messages are counted by, past maxTypeLabels the rest are
+	// counted as "_other" (types are chosen by clients, so unbounded)
+	typeLabels      = map[string]bool{}
+	typeLabelsMutex sync.Mutex
+
+	ingestedMessages = metrics.NewCounter("log_agg_ingested_messages_total", "Messages read by the inputs, by input, type and priority", "input", "type", "priority")
+	receivedBytes    = metrics.NewCounter("log_agg_received_bytes_total", "Bytes read by the inputs, by input", "input")
 )
 
-// Init initializes the http server, if configured
+// Init initializes the http, syslog, gelf, forward and raw tcp servers and
+// file tailers, if configured
 func Init() error {
+	if config.ListenUdp != "" {
+		err := SyslogUDPStart(config.ListenUdp)
+		if err != nil {
+			return err
+		}
+		config.Log.Info("Input listening on syslog udp://%s...", config.ListenUdp)
+	}
+
+	if config.ListenTcp != "" {
+		err := SyslogTCPStart(config.ListenTcp)
+		if err != nil {
+			return err
+		}
+		config.Log.Info("Input listening on syslog tcp://%s...", config.ListenTcp)
+	}
+
+	if config.ListenGelfUdp != "" {
+		err := GelfUDPStart(config.ListenGelfUdp)
+		if err != nil {
+			return err
+		}
+		config.Log.Info("Input listening on gelf udp://%s...", config.ListenGelfUdp)
+	}
+
+	if config.ListenGelfTcp != "" {
+		err := GelfTCPStart(config.ListenGelfTcp)
+		if err != nil {
+			return err
+		}
+		config.Log.Info("Input listening on gelf tcp://%s...", config.ListenGelfTcp)
+	}
+
+	if config.ListenForward != "" {
+		err := ForwardStart(config.ListenForward)
+		if err != nil {
+			return err
+		}
+		config.Log.Info("Input listening on fluentd forward tcp://%s...", config.ListenForward)
+	}
+
+	for _, raw := range config.RawTcp {
+		if err := RawTCPStart(raw); err != nil {
+			return err
+		}
+		config.Log.Info("Input listening on raw tcp://%s...", raw.Address)
+	}
+
+	for _, file := range config.Files {
+		if _, err := FileStart(file); err != nil {
+			return err
+		}
+		config.Log.Info("Input tailing %s...", file.Path)
+	}
 
 	if config.ListenHttp != "" {
 		InputHandler = GenerateHttpInput()
@@ -23,3 +100,82 @@ func Init() error {
 
 	return nil
 }
+
+// Close stops every input (the http input stops with the api), returning once
+// the messages being read have been written
+func Close() {
+	readersMutex.Lock()
+	closing = true
+	for reader := range readers {
+		reader.Close()
+	}
+	readersMutex.Unlock()
+
+	readersGroup.Wait()
+}
+
+// startReader registers a listener or connection to be closed by Close. It
+// returns false, closing reader, if Close was already called.
+func startReader(reader io.Closer) bool {
+	readersMutex.Lock()
+	defer readersMutex.Unlock()
+
+	if closing {
+		reader.Close()
+		return false
+	}
+	readers[reader] = true
+	readersGroup.Add(1)
+	return true
+}
+
+// stopReader unregisters a reader once it is done
+func stopReader(reader io.Closer) {
+	readersMutex.Lock()
+	delete(readers, reader)
+	readersMutex.Unlock()
+
+	readersGroup.Done()
+}
+
+// isClosing reports whether Close was called (so read errors are expected)
+func isClosing() bool {
+	readersMutex.Lock()
+	defer readersMutex.Unlock()
+	return closing
+}
+
+// ingested counts the messages an input read and received counts their bytes,
+// before they are written
+func ingested(input string, msgs ...log_agg.Message) {
+	for i := range msgs {
+		ingestedMessages.Inc(input, typeLabel(msgs[i].Type), priorityLabel(msgs[i].Priority))
+	}
+}
+
+// typeLabel is the type's label, the first maxTypeLabels types seen get their
+// own ("_" can't start a type, so "_other" isn't one)
+func typeLabel(kind string) string {
+	typeLabelsMutex.Lock()
+	defer typeLabelsMutex.Unlock()
+
+	if !typeLabels[kind] {
+		if len(typeLabels) >= maxTypeLabels {
+			return "_other"
+		}
+		typeLabels[kind] = true
+	}
+	return kind
+}
+
+// priorityLabel is the priority's label, those out of range are "_other"
+func priorityLabel(priority int) string {
+	if priority < 0 || priority > 5 {
+		return "_other"
+	}
+	return strconv.Itoa(priority)
+}
+
+func received(input string, n int) {
+	receivedBytes.Add(float64(n), input)
+}
@@ -1,14 +1,21 @@
-// input_test tests the syslog inputs
+// input_test tests the syslog and file inputs
 // (http input is tested in api_test)
 package input_test
 
 import (
 	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 
@@ -91,6 +98,485 @@ func TestGetLogs(t *testing.T) {
 	}
 }
 
+// test syslog over udp (rfc3164)
+func TestSyslogUDP(t *testing.T) {
+	conn, err := net.Dial("udp", config.ListenUdp)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("<11>Mar  7 15:48:57 udp-host nginx[1234]: udp test log"))
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	time.Sleep(time.Second)
+
+	msg, err := getLogs("/logs?type=app&id=udp-host")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if len(msg) != 1 || msg[0].Content != "udp test log" || msg[0].Priority != 4 {
+		t.Errorf("%+v doesn't match expected out", msg)
+		t.FailNow()
+	}
+	if len(msg[0].Tag) != 2 || msg[0].Tag[0] != "nginx" || msg[0].Tag[1] != "1234" {
+		t.Errorf("%q doesn't match expected tags", msg[0].Tag)
+	}
+}
+
+// test syslog over tcp (rfc5424, newline and octet-counted framing)
+func TestSyslogTCP(t *testing.T) {
+	conn, err := net.Dial("tcp", config.ListenTcp)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	first := "<165>1 2003-10-11T22:14:15.003Z tcp-host evntslog - ID47 [exampleSDID@32473 iut=\"3\" eventID=\"1011\"] first tcp log\n"
+	second := "<14>1 2003-10-11T22:14:16.003Z tcp-host myapp 8710 - - second tcp log"
+	_, err = conn.Write([]byte(fmt.Sprintf("%s%d %s", first, len(second), second)))
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	conn.Close()
+	time.Sleep(time.Second)
+
+	msg, err := getLogs("/logs?type=app&id=tcp-host")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if len(msg) != 2 || msg[0].Content != "first tcp log" || msg[1].Content != "second tcp log" {
+		t.Errorf("%+v doesn't match expected out", msg)
+		t.FailNow()
+	}
+	if msg[0].Priority != 2 || len(msg[0].Tag) != 1 || msg[0].Tag[0] != "evntslog" {
+		t.Errorf("%+v doesn't match expected out", msg[0])
+	}
+	if len(msg[1].Tag) != 2 || msg[1].Tag[0] != "myapp" || msg[1].Tag[1] != "8710" {
+		t.Errorf("%q doesn't match expected tags", msg[1].Tag)
+	}
+}
+
+// test an endless syslog line closes the connection, rather than being buffered
+func TestSyslogTCPLong(t *testing.T) {
+	conn, err := net.Dial("tcp", config.ListenTcp)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer conn.Close()
+
+	if _, err = conn.Write(bytes.Repeat([]byte("x"), 100*1024)); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	if nerr, ok := err.(net.Error); err == nil || ok && nerr.Timeout() {
+		t.Errorf("Connection wasn't closed - %v", err)
+	}
+}
+
+// test gelf over udp (chunked, gzip and zlib compressed)
+func TestGelfUDP(t *testing.T) {
+	conn, err := net.Dial("udp", config.ListenGelfUdp)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer conn.Close()
+
+	// a gzipped message in 3 chunks, sent out of order and one twice
+	compressed := &bytes.Buffer{}
+	gz := gzip.NewWriter(compressed)
+	gz.Write([]byte(`{"version":"1.1","host":"gelf-udp","short_message":"chunked","full_message":"chunked gelf log\n\tat Main.java:3","level":3,"facility":"billing","_user_id":42,"_request":{"path":"/pay"}}`))
+	gz.Close()
+	payload := compressed.Bytes()
+	size := len(payload)/3 + 1
+	var chunks [][]byte
+	for i := 0; i < 3; i++ {
+		end := (i + 1) * size
+		if end > len(payload) {
+			end = len(payload)
+		}
+		chunk := append([]byte{0x1e, 0x0f, 1, 2, 3, 4, 5, 6, 7, 8, byte(i), 3}, payload[i*size:end]...)
+		chunks = append(chunks, chunk)
+	}
+
+	zlibbed := &bytes.Buffer{}
+	zw := zlib.NewWriter(zlibbed)
+	zw.Write([]byte(`{"version":"1.1","host":"gelf-udp","short_message":"zlib gelf log","level":6}`))
+	zw.Close()
+
+	for _, datagram := range [][]byte{chunks[2], chunks[0], chunks[2], zlibbed.Bytes(), chunks[1]} {
+		if _, err = conn.Write(datagram); err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(time.Second)
+
+	msg, err := getLogs("/logs?type=app&id=gelf-udp")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if len(msg) != 2 || msg[0].Content != "zlib gelf log" || msg[0].Priority != 2 {
+		t.Errorf("%+v doesn't match expected out", msg)
+		t.FailNow()
+	}
+	if msg[1].Content != "chunked gelf log\n\tat Main.java:3" || msg[1].Priority != 4 || len(msg[1].Tag) != 1 || msg[1].Tag[0] != "billing" {
+		t.Errorf("%+v doesn't match expected out", msg[1])
+	}
+	if path, _ := msg[1].Fields.Lookup("request.path"); msg[1].Fields["user_id"] != 42.0 || path != "/pay" {
+		t.Errorf("%+v doesn't match expected fields", msg[1].Fields)
+	}
+}
+
+// test gelf over tcp (null byte delimited)
+func TestGelfTCP(t *testing.T) {
+	conn, err := net.Dial("tcp", config.ListenGelfTcp)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	_, err = conn.Write([]byte("{\"version\":\"1.1\",\"host\":\"gelf-tcp\",\"short_message\":\"first tcp gelf\",\"level\":0}\x00" +
+		"{\"version\":\"1.1\",\"host\":\"gelf-tcp\",\"short_message\":\"second tcp gelf\"}\n\x00"))
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	conn.Close()
+	time.Sleep(time.Second)
+
+	msg, err := getLogs("/logs?type=app&id=gelf-tcp")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if len(msg) != 2 || msg[0].Content != "first tcp gelf" || msg[1].Content != "second tcp gelf" {
+		t.Errorf("%+v doesn't match expected out", msg)
+		t.FailNow()
+	}
+	// level defaults to 1 (alert)
+	if msg[0].Priority != 5 || msg[1].Priority != 5 {
+		t.Errorf("%+v doesn't match expected out", msg)
+	}
+}
+
+// test raw tcp (newline framing with a handshake, and octet-counted framing)
+func TestRawTCP(t *testing.T) {
+	conn, err := net.Dial("tcp", "127.0.0.1:4237")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	_, err = conn.Write([]byte("{\"id\":\"raw-host\",\"tag\":[\"worker\"]}\n" +
+		"plain text log\r\n\n" +
+		"{\"message\":\"json log\",\"priority\":4,\"tenant\":\"other\",\"job\":7}\n" +
+		"{\"message\":\"namespaced log\",\"type\":\"other/app\"}\n" +
+		"unterminated log"))
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	conn.Close()
+
+	conn, err = net.Dial("tcp", "127.0.0.1:4238")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	first, second := "octet log\nwith a newline", `{"id":"raw-json","message":"octet json log"}`
+	_, err = conn.Write([]byte(fmt.Sprintf("%d %s%d %s\n", len(first), first, len(second), second)))
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	conn.Close()
+
+	// a handshake of a bad type closes the connection
+	conn, err = net.Dial("tcp", "127.0.0.1:4237")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	_, err = conn.Write([]byte("{\"id\":\"raw-bad\",\"type\":\"_files\"}\n"))
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Connection wasn't closed - %v", err)
+	}
+	conn.Close()
+	time.Sleep(time.Second)
+
+	msg, err := getLogs("/logs?type=app&id=raw-host")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if len(msg) != 3 || msg[0].Content != "plain text log" || msg[1].Content != "json log" || msg[2].Content != "unterminated log" {
+		t.Errorf("%+v doesn't match expected out", msg)
+		t.FailNow()
+	}
+	if strings.Join(msg[0].Tag, ",") != "worker,tcp-raw" || msg[0].Priority != 2 {
+		t.Errorf("%+v doesn't match expected out", msg[0])
+	}
+	if strings.Join(msg[1].Tag, ",") != "worker" || msg[1].Priority != 4 || msg[1].Tenant != "" || msg[1].Fields["job"] != 7.0 {
+		t.Errorf("%+v doesn't match expected out", msg[1])
+	}
+
+	msg, err = getLogs("/logs?type=app&id=raw-octet")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if len(msg) != 1 || msg[0].Content != first || strings.Join(msg[0].Tag, ",") != "tcp-raw" {
+		t.Errorf("%+v doesn't match expected out", msg)
+	}
+	msg, err = getLogs("/logs?type=app&id=raw-json")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if len(msg) != 1 || msg[0].Content != "octet json log" || len(msg[0].Tag) != 0 {
+		t.Errorf("%+v doesn't match expected out", msg)
+	}
+}
+
+// test the fluentd forward protocol (message, forward, and compressed packed
+// forward modes, with acks)
+func TestForward(t *testing.T) {
+	conn, err := net.Dial("tcp", config.ListenForward)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer conn.Close()
+
+	eventTime := time.Unix(1500000000, 250)
+	docker := map[string]interface{}{"container_id": "abc123", "container_name": "/fwd-web", "source": "stdout", "log": "docker log\n"}
+	packed := &bytes.Buffer{}
+	gz := gzip.NewWriter(packed)
+	gz.Write(msgpack([]interface{}{1500000002, map[string]interface{}{"host": "fwd-host", "message": "packed log", "priority": 4, "type": "other/app"}}))
+	gz.Write(msgpack([]interface{}{1500000003, map[string]interface{}{"host": "fwd-host", "status": 500}}))
+	gz.Close()
+
+	entries := [][]interface{}{
+		{"docker.web", eventTime, docker, map[string]interface{}{"chunk": "c1"}},
+		{"app", []interface{}{
+			[]interface{}{1500000001, map[string]interface{}{"id": "fwd-host", "message": []byte("forward log"), "type": "fwd"}},
+		}},
+		{"app", packed.Bytes(), map[string]interface{}{"compressed": "gzip", "size": 2, "chunk": "c2"}},
+	}
+	for i, entry := range entries {
+		if _, err = conn.Write(msgpack(entry)); err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		if i == 1 {
+			continue
+		}
+		// {"ack": chunk}
+		ack := make([]byte, 8)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err = io.ReadFull(conn, ack); err != nil || string(ack) != fmt.Sprintf("\x81\xa3ack\xa2c%d", i/2+1) {
+			t.Errorf("%q doesn't match expected ack - %v", ack, err)
+		}
+	}
+	time.Sleep(time.Second)
+
+	msg, err := getLogs("/logs?type=app&id=fwd-web")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if len(msg) != 1 || msg[0].Content != "docker log" || msg[0].UTime != eventTime.UnixNano() || strings.Join(msg[0].Tag, ",") != "docker.web" {
+		t.Errorf("%+v doesn't match expected out", msg)
+		t.FailNow()
+	}
+	if msg[0].Fields["source"] != "stdout" || msg[0].Fields["container_id"] != "abc123" || msg[0].Fields["log"] != nil {
+		t.Errorf("%+v doesn't match expected fields", msg[0].Fields)
+	}
+
+	msg, err = getLogs("/logs?type=fwd&id=fwd-host")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if len(msg) != 1 || msg[0].Content != "forward log" || msg[0].UTime != 1500000001*int64(time.Second) {
+		t.Errorf("%+v doesn't match expected out", msg)
+	}
+
+	msg, err = getLogs("/logs?type=app&id=fwd-host")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if len(msg) != 2 || msg[0].Content != "packed log" || msg[0].Priority != 4 || msg[1].Content != `{"host":"fwd-host","status":500}` || msg[1].Fields["status"] != 500.0 {
+		t.Errorf("%+v doesn't match expected out", msg)
+		t.FailNow()
+	}
+	// a bad type is kept as a field
+	if msg[0].Fields["type"] != "other/app" {
+		t.Errorf("%+v doesn't match expected fields", msg[0].Fields)
+	}
+}
+
+// test a small forward message that would decode into far more memory is refused
+func TestForwardBudget(t *testing.T) {
+	conn, err := net.Dial("tcp", config.ListenForward)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer conn.Close()
+
+	// an array of 8M nils, 8MB encoded but many times that decoded
+	if _, err = conn.Write([]byte{0xdd, 0x00, 0x80, 0x00, 0x00, 0xc0, 0xc0}); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Connection wasn't closed - %v", err)
+	}
+}
+
+// msgpack encodes a value for a forward client
+func msgpack(value interface{}) []byte {
+	size := func(kind byte, n int) []byte {
+		return []byte{kind, byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)}
+	}
+	switch v := value.(type) {
+	case int:
+		b := make([]byte, 9)
+		b[0] = 0xd3
+		binary.BigEndian.PutUint64(b[1:], uint64(v))
+		return b
+	case string:
+		return append(size(0xdb, len(v)), v...)
+	case []byte:
+		return append(size(0xc6, len(v)), v...)
+	case time.Time:
+		b := []byte{0xd7, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(b[2:], uint32(v.Unix()))
+		binary.BigEndian.PutUint32(b[6:], uint32(v.Nanosecond()))
+		return b
+	case []interface{}:
+		b := size(0xdd, len(v))
+		for i := range v {
+			b = append(b, msgpack(v[i])...)
+		}
+		return b
+	case map[string]interface{}:
+		b := size(0xdf, len(v))
+		for key := range v {
+			b = append(append(b, msgpack(key)...), msgpack(v[key])...)
+		}
+		return b
+	}
+	return []byte{0xc0}
+}
+
+// test tailing files through rotation, truncation, and a restart
+func TestFileInput(t *testing.T) {
+	dir := "/tmp/syslogTest/files"
+	os.MkdirAll(dir, 0755)
+	path := dir + "/web-prod.log"
+	appendFile := func(path, lines string) {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		f.WriteString(lines)
+		f.Close()
+	}
+
+	// existing lines are read from the start
+	appendFile(path, "one\ntwo\n")
+	file := config.FileConfig{Path: dir + "/*.log", Type: "filetest", Pattern: `/(?P<app>[a-z]+)-(?P<env>[a-z]+)\.log$`, Id: "${app}", Tag: "$env"}
+	tailer, err := input.FileStart(file)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	// lines are written once they're complete
+	appendFile(path, "three\npart")
+	time.Sleep(200 * time.Millisecond)
+	appendFile(path, "ial\nfour\n")
+
+	// rotated by a rename, then by truncating
+	os.Rename(path, path+".1")
+	appendFile(path, "five\n")
+	time.Sleep(200 * time.Millisecond)
+	os.Truncate(path, 0)
+	appendFile(path, "six\n")
+	time.Sleep(200 * time.Millisecond)
+
+	// lines written while stopped are read on restart, once
+	tailer.Close()
+	time.Sleep(200 * time.Millisecond)
+	appendFile(path, "seven\n")
+	if tailer, err = input.FileStart(file); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer tailer.Close()
+	time.Sleep(time.Second)
+
+	msgs, err := getLogs("/logs?type=filetest")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	var lines []string
+	for _, msg := range msgs {
+		lines = append(lines, msg.Content)
+		if msg.Id != "web" || len(msg.Tag) != 1 || msg.Tag[0] != "prod" {
+			t.Errorf("%+v doesn't match expected id and tag", msg)
+		}
+	}
+	sort.Strings(lines)
+	if strings.Join(lines, " ") != "five four one partial seven six three two" {
+		t.Errorf("%q doesn't match expected out", lines)
+	}
+
+	if _, err = input.FileStart(config.FileConfig{Path: "/tmp/syslogTest/missing/*.log"}); err == nil {
+		t.Error("missing directory is too forgiving")
+	}
+}
+
+// get logs from the api
+func getLogs(route string) ([]log_agg.Message, error) {
+	body, err := rest("GET", route, "")
+	if err != nil {
+		return nil, err
+	}
+
+	msg := []log_agg.Message{}
+	err = json.Unmarshal(body, &msg)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal - %s", err)
+	}
+
+	return msg, nil
+}
+
 // hit api and return response body
 func rest(method, route, data string) ([]byte, error) {
 	body := bytes.NewBuffer([]byte(data))
@@ -115,6 +601,15 @@ func rest(method, route, data string) ([]byte, error) {
 // manually configure and start internals
 func initialize() {
 	config.ListenHttp = "0.0.0.0:4234"
+	config.ListenUdp = "0.0.0.0:4235"
+	config.ListenTcp = "0.0.0.0:4235"
+	config.ListenGelfUdp = "0.0.0.0:4236"
+	config.ListenGelfTcp = "0.0.0.0:4236"
+	config.ListenForward = "0.0.0.0:4239"
+	config.RawTcp = []config.RawTcpConfig{
+		{Address: "0.0.0.0:4237", Tag: "raw", Handshake: true},
+		{Address: "0.0.0.0:4238", Framing: "octet", Id: "raw-octet"},
+	}
 	config.DbAddress = "boltdb:///tmp/syslogTest/log_agg.bolt"
 	config.Log = lumber.NewConsoleLogger(lumber.LvlInt("ERROR"))
 
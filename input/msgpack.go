@@ -0,0 +1,273 @@
+package input
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+const (
+	// deepest nesting of arrays and maps decoded
+	maxMsgpackDepth = 64
+
+	// bytes charged per array element (an interface value) and map entry (its
+	// key, value and share of the map), on top of their data
+	msgpackElementCost = 16
+	msgpackEntryCost   = 64
+)
+
+// msgpackDecoder decodes msgpack values within a budget, which every value is
+// charged roughly the memory it takes (not just its encoded bytes, a 1 byte
+// element takes many more decoded). Numbers decode as float64 (as from json),
+// strings as string, binary as []byte, maps as map[string]interface{}, and
+// the fluentd EventTime extension (type 0) as time.Time. Other extensions
+// decode as nil.
+type msgpackDecoder struct {
+	r      io.Reader
+	budget int
+	buf    [8]byte
+}
+
+// decode reads the next value, which may use up to max bytes
+func (d *msgpackDecoder) decode(max int) (interface{}, error) {
+	d.budget = max
+	return d.value(0)
+}
+
+func (d *msgpackDecoder) value(depth int) (interface{}, error) {
+	if depth > maxMsgpackDepth {
+		return nil, fmt.Errorf("Msgpack nested deeper than %d", maxMsgpackDepth)
+	}
+	b, err := d.read(1)
+	if err != nil {
+		return nil, err
+	}
+	v, err := d.typed(b[0], depth)
+	return v, unexpected(err)
+}
+
+// typed reads the rest of a value of type c
+func (d *msgpackDecoder) typed(c byte, depth int) (interface{}, error) {
+	switch {
+	case c <= 0x7f:
+		return float64(c), nil
+	case c >= 0xe0:
+		return float64(int8(c)), nil
+	case c >= 0x80 && c <= 0x8f:
+		return d.object(int(c&0x0f), depth)
+	case c >= 0x90 && c <= 0x9f:
+		return d.array(int(c&0x0f), depth)
+	case c >= 0xa0 && c <= 0xbf:
+		return d.str(int(c & 0x1f))
+	}
+
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := d.length(c - 0xc4)
+		if err != nil {
+			return nil, err
+		}
+		return d.bytes(n)
+	case 0xc7, 0xc8, 0xc9:
+		n, err := d.length(c - 0xc7)
+		if err != nil {
+			return nil, err
+		}
+		return d.ext(n)
+	case 0xca:
+		v, err := d.uint(4)
+		return float64(math.Float32frombits(uint32(v))), err
+	case 0xcb:
+		v, err := d.uint(8)
+		return math.Float64frombits(v), err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		v, err := d.uint(1 << (c - 0xcc))
+		return float64(v), err
+	case 0xd0:
+		v, err := d.uint(1)
+		return float64(int8(v)), err
+	case 0xd1:
+		v, err := d.uint(2)
+		return float64(int16(v)), err
+	case 0xd2:
+		v, err := d.uint(4)
+		return float64(int32(v)), err
+	case 0xd3:
+		v, err := d.uint(8)
+		return float64(int64(v)), err
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return d.ext(1 << (c - 0xd4))
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.length(c - 0xd9)
+		if err != nil {
+			return nil, err
+		}
+		return d.str(n)
+	case 0xdc, 0xdd:
+		n, err := d.length(c - 0xdc + 1)
+		if err != nil {
+			return nil, err
+		}
+		return d.array(n, depth)
+	case 0xde, 0xdf:
+		n, err := d.length(c - 0xde + 1)
+		if err != nil {
+			return nil, err
+		}
+		return d.object(n, depth)
+	}
+	return nil, fmt.Errorf("Bad msgpack type 0x%x", c)
+}
+
+// length reads a 1, 2, or 4 byte length (size 0, 1, or 2)
+func (d *msgpackDecoder) length(size byte) (int, error) {
+	v, err := d.uint(1 << size)
+	return int(v), err
+}
+
+func (d *msgpackDecoder) uint(n int) (uint64, error) {
+	b, err := d.read(n)
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	for i := range b {
+		v = v<<8 | uint64(b[i])
+	}
+	return v, nil
+}
+
+func (d *msgpackDecoder) str(n int) (string, error) {
+	b, err := d.bytes(n)
+	return string(b), err
+}
+
+func (d *msgpackDecoder) bytes(n int) ([]byte, error) {
+	if err := d.spend(n); err != nil {
+		return nil, err
+	}
+	b := make([]byte, n)
+	_, err := io.ReadFull(d.r, b)
+	return b, unexpected(err)
+}
+
+func (d *msgpackDecoder) ext(n int) (interface{}, error) {
+	kind, err := d.read(1)
+	if err != nil {
+		return nil, err
+	}
+	extType := int8(kind[0])
+	data, err := d.bytes(n)
+	if err != nil || extType != 0 {
+		return nil, err
+	}
+	if len(data) != 8 {
+		return nil, fmt.Errorf("Bad msgpack event time of %d bytes", len(data))
+	}
+	return time.Unix(int64(binary.BigEndian.Uint32(data)), int64(binary.BigEndian.Uint32(data[4:]))), nil
+}
+
+func (d *msgpackDecoder) array(n int, depth int) ([]interface{}, error) {
+	if err := d.spendEach(n, msgpackElementCost); err != nil {
+		return nil, err
+	}
+	values := make([]interface{}, 0, minInt(n, 1024))
+	for i := 0; i < n; i++ {
+		v, err := d.value(depth + 1)
+		if err != nil {
+			return nil, unexpected(err)
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+func (d *msgpackDecoder) object(n int, depth int) (map[string]interface{}, error) {
+	if err := d.spendEach(n, msgpackEntryCost); err != nil {
+		return nil, err
+	}
+	values := make(map[string]interface{}, minInt(n, 1024))
+	for i := 0; i < n; i++ {
+		key, err := d.value(depth + 1)
+		if err != nil {
+			return nil, unexpected(err)
+		}
+		v, err := d.value(depth + 1)
+		if err != nil {
+			return nil, unexpected(err)
+		}
+		switch k := key.(type) {
+		case string:
+			values[k] = v
+		case []byte:
+			values[string(k)] = v
+		default:
+			values[fmt.Sprint(k)] = v
+		}
+	}
+	return values, nil
+}
+
+// read reads n (up to 8) bytes
+func (d *msgpackDecoder) read(n int) ([]byte, error) {
+	if err := d.spend(n); err != nil {
+		return nil, err
+	}
+	_, err := io.ReadFull(d.r, d.buf[:n])
+	return d.buf[:n], err
+}
+
+func (d *msgpackDecoder) spend(n int) error {
+	if n > d.budget {
+		return fmt.Errorf("Msgpack value longer than allowed")
+	}
+	d.budget -= n
+	return nil
+}
+
+// spendEach spends cost for each of n values
+func (d *msgpackDecoder) spendEach(n, cost int) error {
+	if n > d.budget/cost {
+		return fmt.Errorf("Msgpack value longer than allowed")
+	}
+	d.budget -= n * cost
+	return nil
+}
+
+// a value cut short is unexpected, only the end between values is an EOF
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// appendMsgpackString encodes s as a msgpack str
+func appendMsgpackString(b []byte, s string) []byte {
+	switch n := len(s); {
+	case n < 32:
+		b = append(b, 0xa0|byte(n))
+	case n < 1<<8:
+		b = append(b, 0xd9, byte(n))
+	case n < 1<<16:
+		b = append(b, 0xda, byte(n>>8), byte(n))
+	default:
+		b = append(b, 0xdb, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	return append(b, s...)
+}
@@ -0,0 +1,212 @@
+package input
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/r0h4n/log_agg/config"
+	"github.com/r0h4n/log_agg/output"
+	"github.com/r0h4n/log_agg/transform"
+)
+
+// maximum size of a raw tcp frame we will accept
+const maxRawFrame = 1024 * 1024
+
+// RawTCPStart starts a tcp listener for json or plain text logs, framed as
+// configured
+func RawTCPStart(c config.RawTcpConfig) error {
+	switch c.Framing {
+	case "":
+		c.Framing = "newline"
+	case "newline", "octet", "null":
+	default:
+		return fmt.Errorf("Bad raw-tcp framing '%s'", c.Framing)
+	}
+	if c.Type == "" {
+		c.Type = config.LogType
+	}
+	if err := output.ValidType(c.Type); err != nil {
+		return fmt.Errorf("Bad raw-tcp type - %s", err)
+	}
+
+	serverSocket, err := net.Listen("tcp", c.Address)
+	if err != nil {
+		return err
+	}
+	if !startReader(serverSocket) {
+		return fmt.Errorf("Inputs are closed")
+	}
+
+	go func() {
+		defer stopReader(serverSocket)
+		for {
+			conn, err := serverSocket.Accept()
+			if err != nil {
+				if !isClosing() {
+					config.Log.Error("Raw tcp accept failed - %s", err)
+				}
+				return
+			}
+			if !startReader(conn) {
+				return
+			}
+			go func() {
+				defer stopReader(conn)
+				handleRawConnection(conn, c)
+			}()
+		}
+	}()
+
+	return nil
+}
+
+// reads frames from a tcp connection until it is closed
+func handleRawConnection(conn net.Conn, c config.RawTcpConfig) {
+	defer conn.Close()
+
+	defaults := log_agg.Message{Id: c.Id, Type: c.Type}
+	if c.Tag != "" {
+		defaults.Tag = []string{c.Tag}
+	}
+	handshake := c.Handshake
+
+	r := bufio.NewReader(conn)
+	for {
+		frame, err := readRawFrame(r, c.Framing)
+		if len(bytes.TrimSpace(frame)) > 0 {
+			received("raw-tcp", len(frame))
+			if handshake {
+				handshake = false
+				if defaults, err = rawHandshake(frame, defaults); err != nil {
+					config.Log.Debug("Raw tcp connection from %s closed - %s", conn.RemoteAddr(), err)
+					return
+				}
+				continue
+			}
+			msg, err := parseRaw(frame, defaults)
+			if err != nil {
+				config.Log.Debug("Dropped raw tcp message - %s", err)
+				continue
+			}
+			ingested("raw-tcp", msg)
+			log_agg.WriteMessage(msg)
+		}
+		if err != nil {
+			if err != io.EOF {
+				config.Log.Debug("Raw tcp connection closed - %s", err)
+			}
+			return
+		}
+	}
+}
+
+// readRawFrame reads a single frame, newline or null terminated, or octet
+// counted ("10 a log line")
+func readRawFrame(r *bufio.Reader, framing string) ([]byte, error) {
+	switch framing {
+	case "null":
+		return readDelimited(r, 0, maxRawFrame)
+	case "octet":
+		length, err := readDelimited(r, ' ', 16)
+		if err != nil {
+			return nil, err
+		}
+		// frames may be followed by a newline
+		size, err := strconv.Atoi(string(bytes.TrimLeft(length, "\r\n")))
+		if err != nil || size < 0 || size > maxRawFrame {
+			return nil, fmt.Errorf("Bad raw frame length %q", length)
+		}
+		frame := make([]byte, size)
+		if _, err = io.ReadFull(r, frame); err != nil {
+			return nil, err
+		}
+		return frame, nil
+	}
+
+	frame, err := readDelimited(r, '\n', maxRawFrame)
+	return bytes.TrimRight(frame, "\r"), err
+}
+
+// readDelimited reads up to the next delim, returning the frame without it (or
+// what was read before an error)
+func readDelimited(r *bufio.Reader, delim byte, max int) ([]byte, error) {
+	var frame []byte
+	for {
+		part, err := r.ReadSlice(delim)
+		frame = append(frame, part...)
+		if err == nil {
+			frame = frame[:len(frame)-1]
+		}
+		if len(frame) > max {
+			return nil, fmt.Errorf("Frame longer than %d bytes", max)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		return frame, err
+	}
+}
+
+// rawHandshake reads a connection's handshake, a json object of the id, type
+// and tag of its logs, which replace the defaults it sets
+func rawHandshake(frame []byte, defaults log_agg.Message) (log_agg.Message, error) {
+	var handshake log_agg.Message
+	if err := json.Unmarshal(frame, &handshake); err != nil {
+		return defaults, fmt.Errorf("Bad handshake - %s", err)
+	}
+
+	if handshake.Id != "" {
+		defaults.Id = handshake.Id
+	}
+	if handshake.Type != "" {
+		if err := output.ValidType(handshake.Type); err != nil {
+			return defaults, fmt.Errorf("Bad handshake - %s", err)
+		}
+		defaults.Type = handshake.Type
+	}
+	if len(handshake.Tag) > 0 {
+		defaults.Tag = handshake.Tag
+	}
+	return defaults, nil
+}
+
+// parseRaw converts a frame into a message, falling back to storing the frame
+// as the content if it isn't a json message. The defaults are set on messages
+// without an id, type or tags. Messages of a bad type are refused.
+func parseRaw(frame []byte, defaults log_agg.Message) (log_agg.Message, error) {
+	var msg log_agg.Message
+	trimmed := bytes.TrimSpace(frame)
+	if trimmed[0] != '{' || json.Unmarshal(trimmed, &msg) != nil || msg.Content == "" {
+		// keep frame as "message" and make up priority
+		msg = log_agg.Message{
+			Content:  string(frame),
+			Priority: 2,
+			Tag:      append(defaults.Tag[:len(defaults.Tag):len(defaults.Tag)], "tcp-raw"),
+		}
+	}
+
+	if msg.Id == "" {
+		msg.Id = defaults.Id
+	}
+	if msg.Type == "" {
+		msg.Type = defaults.Type
+	}
+	if err := output.ValidType(msg.Type); err != nil {
+		return msg, err
+	}
+	if len(msg.Tag) == 0 {
+		msg.Tag = defaults.Tag
+	}
+	// raw tcp has no api keys to set a tenant by
+	msg.Tenant = ""
+	msg.Time = time.Now()
+	msg.UTime = msg.Time.UnixNano()
+
+	return msg, nil
+}
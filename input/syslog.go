@@ -0,0 +1,336 @@
+package input
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/r0h4n/log_agg/config"
+	"github.com/r0h4n/log_agg/transform"
+)
+
+// maximum size of a syslog frame we will accept over tcp
+const maxSyslogFrame = 64 * 1024
+
+// syslog severities (0-7) mapped onto log_agg priorities (0(trace)-5(fatal))
+var syslogSeverity = []int{5, 5, 5, 4, 3, 2, 2, 1}
+
+// SyslogUDPStart starts a udp syslog listener on address
+func SyslogUDPStart(address string) error {
+	udpAddress, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.ListenUDP("udp", udpAddress)
+	if err != nil {
+		return err
+	}
+	if !startReader(conn) {
+		return fmt.Errorf("Inputs are closed")
+	}
+
+	go func() {
+		defer stopReader(conn)
+		buf := make([]byte, maxSyslogFrame)
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				if !isClosing() {
+					config.Log.Error("Syslog udp read failed - %s", err)
+				}
+				return
+			}
+
+			frame := make([]byte, n)
+			copy(frame, buf[:n])
+			received("syslog-udp", n)
+			msg := parseSyslog(frame)
+			ingested("syslog-udp", msg)
+			log_agg.WriteMessage(msg)
+		}
+	}()
+
+	return nil
+}
+
+// SyslogTCPStart starts a tcp syslog listener on address
+func SyslogTCPStart(address string) error {
+	serverSocket, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	if !startReader(serverSocket) {
+		return fmt.Errorf("Inputs are closed")
+	}
+
+	go func() {
+		defer stopReader(serverSocket)
+		for {
+			conn, err := serverSocket.Accept()
+			if err != nil {
+				if !isClosing() {
+					config.Log.Error("Syslog tcp accept failed - %s", err)
+				}
+				return
+			}
+			if !startReader(conn) {
+				return
+			}
+			go func() {
+				defer stopReader(conn)
+				handleSyslogConnection(conn)
+			}()
+		}
+	}()
+
+	return nil
+}
+
+// reads frames from a tcp connection until it is closed
+func handleSyslogConnection(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	for {
+		frame, err := readSyslogFrame(r)
+		if len(frame) > 0 {
+			received("syslog-tcp", len(frame))
+			msg := parseSyslog(frame)
+			ingested("syslog-tcp", msg)
+			log_agg.WriteMessage(msg)
+		}
+		if err != nil {
+			if err != io.EOF {
+				config.Log.Debug("Syslog tcp connection closed - %s", err)
+			}
+			return
+		}
+	}
+}
+
+// readSyslogFrame reads a single frame, supporting both octet-counting
+// ("27 <34>1 ...") and newline delimited framing (rfc6587)
+func readSyslogFrame(r *bufio.Reader) ([]byte, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	// non-transparent framing
+	if first[0] < '0' || first[0] > '9' {
+		frame, err := readDelimited(r, '\n', maxSyslogFrame)
+		return bytes.TrimRight(frame, "\r\n\x00"), err
+	}
+
+	// octet-counting
+	length, err := readDelimited(r, ' ', 16)
+	if err != nil {
+		return nil, err
+	}
+	size, err := strconv.Atoi(string(length))
+	if err != nil || size < 0 || size > maxSyslogFrame {
+		return nil, fmt.Errorf("Bad syslog frame length %q", length)
+	}
+
+	frame := make([]byte, size)
+	if _, err = io.ReadFull(r, frame); err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(frame, "\r\n\x00"), nil
+}
+
+// parseSyslog converts a raw syslog frame into a message, falling back to
+// storing the frame as-is if it is neither rfc5424 nor rfc3164
+func parseSyslog(frame []byte) log_agg.Message {
+	frame = bytes.TrimRight(frame, "\r\n\x00")
+
+	msg, err := parseRFC5424(frame)
+	if err != nil {
+		msg, err = parseRFC3164(frame)
+	}
+	if err != nil {
+		config.Log.Trace("Failed to parse syslog - %s", err)
+		msg = log_agg.Message{
+			Content:  string(frame),
+			Priority: 2,
+			Tag:      []string{"syslog-raw"},
+		}
+	}
+
+	msg.Raw = frame
+	msg.Type = config.LogType
+	msg.Time = time.Now()
+	msg.UTime = msg.Time.UnixNano()
+
+	return msg
+}
+
+// parsePriority reads the "<PRI>" header and returns the log_agg priority
+// along with the remainder of the frame
+func parsePriority(frame []byte) (int, []byte, error) {
+	if len(frame) < 3 || frame[0] != '<' {
+		return 0, nil, fmt.Errorf("Missing priority")
+	}
+
+	end := bytes.IndexByte(frame, '>')
+	if end < 2 || end > 4 {
+		return 0, nil, fmt.Errorf("Bad priority")
+	}
+
+	pri, err := strconv.Atoi(string(frame[1:end]))
+	if err != nil || pri < 0 || pri > 191 {
+		return 0, nil, fmt.Errorf("Bad priority")
+	}
+
+	return syslogSeverity[pri%8], frame[end+1:], nil
+}
+
+// parseRFC5424 parses "<PRI>VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID SD [MSG]"
+func parseRFC5424(frame []byte) (log_agg.Message, error) {
+	msg := log_agg.Message{}
+
+	priority, rest, err := parsePriority(frame)
+	if err != nil {
+		return msg, err
+	}
+	msg.Priority = priority
+
+	if len(rest) < 2 || rest[0] < '1' || rest[0] > '9' {
+		return msg, fmt.Errorf("Missing rfc5424 version")
+	}
+
+	// version, timestamp, hostname, app-name, procid, msgid
+	fields := make([]string, 6)
+	for i := range fields {
+		sp := bytes.IndexByte(rest, ' ')
+		if sp < 1 {
+			return msg, fmt.Errorf("Truncated rfc5424 header")
+		}
+		fields[i] = string(rest[:sp])
+		rest = rest[sp+1:]
+	}
+	if _, err = strconv.Atoi(fields[0]); err != nil {
+		return msg, fmt.Errorf("Bad rfc5424 version")
+	}
+
+	rest, err = skipStructuredData(rest)
+	if err != nil {
+		return msg, err
+	}
+
+	msg.Id = nilValue(fields[2])
+	for _, tag := range []string{nilValue(fields[3]), nilValue(fields[4])} {
+		if tag != "" {
+			msg.Tag = append(msg.Tag, tag)
+		}
+	}
+	msg.Content = string(bytes.TrimPrefix(rest, []byte("\xEF\xBB\xBF")))
+
+	return msg, nil
+}
+
+// skipStructuredData steps over the rfc5424 STRUCTURED-DATA section,
+// returning what remains of the frame (the MSG)
+func skipStructuredData(rest []byte) ([]byte, error) {
+	if len(rest) == 0 {
+		return nil, fmt.Errorf("Missing rfc5424 structured data")
+	}
+
+	if rest[0] == '-' {
+		rest = rest[1:]
+	} else {
+		for len(rest) > 0 && rest[0] == '[' {
+			i, quoted := 1, false
+			for ; i < len(rest); i++ {
+				if rest[i] == '\\' && quoted {
+					i++
+					continue
+				}
+				if rest[i] == '"' {
+					quoted = !quoted
+				}
+				if rest[i] == ']' && !quoted {
+					break
+				}
+			}
+			if i >= len(rest) {
+				return nil, fmt.Errorf("Unterminated rfc5424 structured data")
+			}
+			rest = rest[i+1:]
+		}
+	}
+
+	if len(rest) > 0 {
+		if rest[0] != ' ' {
+			return nil, fmt.Errorf("Bad rfc5424 structured data")
+		}
+		rest = rest[1:]
+	}
+
+	return rest, nil
+}
+
+// parseRFC3164 parses "<PRI>Mmm dd hh:mm:ss HOSTNAME TAG[PID]: MSG"
+func parseRFC3164(frame []byte) (log_agg.Message, error) {
+	msg := log_agg.Message{}
+
+	priority, rest, err := parsePriority(frame)
+	if err != nil {
+		return msg, err
+	}
+	msg.Priority = priority
+
+	// timestamp and hostname are optional in practice (eg. when sent from a
+	// local process), only consume them if the timestamp is valid
+	if len(rest) > len(time.Stamp) && rest[len(time.Stamp)] == ' ' {
+		if _, err := time.Parse(time.Stamp, string(rest[:len(time.Stamp)])); err == nil {
+			rest = rest[len(time.Stamp)+1:]
+			if sp := bytes.IndexByte(rest, ' '); sp > 0 {
+				msg.Id = string(rest[:sp])
+				rest = rest[sp+1:]
+			}
+		}
+	}
+
+	// tag is at most 32 characters followed by '[' or ':'
+	for i := 0; i < len(rest) && i <= 32; i++ {
+		if rest[i] == ':' || rest[i] == '[' {
+			if i > 0 {
+				tag := string(rest[:i])
+				proc := rest[i:]
+				if proc[0] == '[' {
+					end := bytes.IndexByte(proc, ']')
+					if end < 0 || len(proc) < end+2 || proc[end+1] != ':' {
+						break
+					}
+					msg.Tag = []string{tag, string(proc[1:end])}
+					proc = proc[end+1:]
+				} else {
+					msg.Tag = []string{tag}
+				}
+				rest = bytes.TrimPrefix(proc[1:], []byte(" "))
+			}
+			break
+		}
+		if rest[i] == ' ' {
+			break
+		}
+	}
+
+	msg.Content = string(rest)
+
+	return msg, nil
+}
+
+// rfc5424 uses "-" as a nil value
+func nilValue(s string) string {
+	if s == "-" {
+		return ""
+	}
+	return s
+}
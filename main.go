@@ -8,26 +8,48 @@
 //
 //  Usage:
 //    log_agg [flags]
+//    log_agg keys [add|list|remove]
 //
 //
 //  Flags:
+//        --archive-compact-ratio float  Compact the archive once this fraction of it is free after expiring logs (0 never) (boltdb only) (default 0.5)
+//        --archive-max-bytes string     Bytes of logs to keep in all, expiring the oldest of any type past it ('10GB') (boltdb only)
+//        --auth                  Require an api key for every api route (manage keys with 'log_agg keys')
 //    -c, --config-file string    config file location for log_agg
 //    -d, --db-address string     Log storage address (default "boltdb:///var/db/log_agg.bolt")
 //    -a, --listen-http string    API listen address (same endpoint for http log collection) (default "0.0.0.0:6360")
-//    -k, --log-keep string       Age or number of logs to keep per type '{"app":"2w", "deploy": 10}' (int or X(m)in, (h)our,  (d)ay, (w)eek, (y)ear) (default "{\"app\":\"2w\"}")
+//    -t, --listen-tcp string     Syslog tcp listen address (default "0.0.0.0:6361")
+//    -u, --listen-udp string     Syslog udp listen address (default "0.0.0.0:514")
+//    -k, --log-keep string       Age or number of logs to keep per type '{"app":"2w", "deploy": 10}' (int or X(m)in, (h)our,  (d)ay, (w)eek, (y)ear, or an object of age, max, and maxBytes) (default "{\"app\":\"2w\"}")
 //    -l, --log-level string      Level at which to log (default "info")
 //    -L, --log-type string       Default type to apply to incoming logs (commonly used: app|deploy) (default "app")
+//        --queue-policy string   What to do with messages for a full output queue (block|drop-oldest|drop-newest|spill) (default "block")
+//        --queue-size int        Messages each output may have queued before the queue-policy applies (default 1000)
+//        --queue-spill-dir string  Directory output queues with the spill policy overflow to (default "/var/db/log_agg-spill")
+//        --search-index          Keep a word index of log content to speed up searches (boltdb only)
+//        --shutdown-timeout int  Seconds to wait on shutdown for requests and outputs to finish (default 10)
+//        --tls-cert string       Certificate file to serve the API over https with
+//        --tls-client-ca string  CA file to verify API client certificates with (a client's CN becomes its logs' id)
+//        --tls-key string        Private key file of the tls-cert
+//        --tls-require-client    Require API clients to present a certificate verified by tls-client-ca
 //    -v, --version               Print version info and exit
 //
 package main
 
 import (
+	"context"
 	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/jcelliott/lumber"
 	"github.com/spf13/cobra"
 
 	"github.com/r0h4n/log_agg/api"
+	"github.com/r0h4n/log_agg/auth"
 	"github.com/r0h4n/log_agg/input"
 	"github.com/r0h4n/log_agg/config"
 	"github.com/r0h4n/log_agg/transform"
@@ -37,6 +59,8 @@ import (
 var (
 	configFile string
 	portFile   string
+	keyTenant  string
+	keyScopes  []string
 
 
 	// provides the log_agg server functionality
@@ -51,6 +75,33 @@ var (
 		SilenceUsage:      true,
 	}
 
+	// manages the api keys required with --auth
+	keysCmd = &cobra.Command{
+		Use:               "keys",
+		Short:             "Manage api keys",
+		Long:              `Manage the api keys required with --auth. A boltdb archive is locked by a running log_agg, stop it first.`,
+		PersistentPreRunE: openArchive,
+		PersistentPostRun: closeArchive,
+	}
+
+	keysAddCmd = &cobra.Command{
+		Use:   "add",
+		Short: "Create an api key (the key is only shown once)",
+		RunE:  addKey,
+	}
+
+	keysListCmd = &cobra.Command{
+		Use:   "list",
+		Short: "List api keys",
+		RunE:  listKeys,
+	}
+
+	keysRemoveCmd = &cobra.Command{
+		Use:   "remove ID",
+		Short: "Remove an api key",
+		RunE:  removeKey,
+	}
+
 	// version information (populated by go linker)
 	// -ldflags="-X main.tag=${tag} -X main.commit=${commit}"
 	tag    string
@@ -58,10 +109,16 @@ var (
 )
 
 func main() {
-	Log_agg.Flags().StringVarP(&configFile, "config-file", "c", "", "config file location for server")
+	Log_agg.PersistentFlags().StringVarP(&configFile, "config-file", "c", "", "config file location for server")
 
 	config.AddFlags(Log_agg)
 
+	keysCmd.PersistentFlags().StringVarP(&config.DbAddress, "db-address", "d", config.DbAddress, "Log storage address")
+	keysAddCmd.Flags().StringVarP(&keyTenant, "tenant", "T", "", "Tenant the key posts and reads logs as (default tenant if empty)")
+	keysAddCmd.Flags().StringSliceVarP(&keyScopes, "scope", "s", []string{auth.ScopeIngest, auth.ScopeRead}, "Scopes of the key (ingest, read, admin)")
+	keysCmd.AddCommand(keysAddCmd, keysListCmd, keysRemoveCmd)
+	Log_agg.AddCommand(keysCmd)
+
 	err := Log_agg.Execute()
 	if err != nil && err.Error() != "" {
 		fmt.Println(err)
@@ -84,17 +141,65 @@ func preFlight(ccmd *cobra.Command, args []string) error {
 	return nil
 }
 
+func openArchive(ccmd *cobra.Command, args []string) error {
+	if err := readConfig(ccmd, args); err != nil {
+		return err
+	}
+
+	archive, err := output.OpenArchive()
+	if err != nil {
+		return fmt.Errorf("Failed to open archive - %s", err)
+	}
+	output.Archiver = archive
+	return nil
+}
+
+func closeArchive(ccmd *cobra.Command, args []string) {
+	output.Archiver.Close()
+}
+
+func addKey(ccmd *cobra.Command, args []string) error {
+	token, key, err := auth.NewKey(keyTenant, keyScopes)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("id:     %s\ntenant: %s\nscopes: %s\nkey:    %s\n", key.Id, key.Tenant, strings.Join(key.Scopes, ","), token)
+	return nil
+}
+
+func listKeys(ccmd *cobra.Command, args []string) error {
+	keys, err := auth.Keys()
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		fmt.Printf("%s\t%s\t%s\t%s\n", key.Id, key.Tenant, strings.Join(key.Scopes, ","), key.Created.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func removeKey(ccmd *cobra.Command, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Usage: log_agg keys remove ID")
+	}
+	return auth.RemoveKey(args[0])
+}
+
 func startLog_agg(ccmd *cobra.Command, args []string) error {
 	// initialize logger
 	lumber.Level(lumber.LvlInt(config.LogLevel)) // for clients using lumber too
 	config.Log = lumber.NewConsoleLogger(lumber.LvlInt(config.LogLevel))
 
 	// initialize log_agg
-	log_agg.Init()
-
+	err := log_agg.Init()
+	if err != nil {
+		return fmt.Errorf("Log_agg failed to initialize - %s", err)
+	}
 
 	// initialize outputs
-	err := output.Init()
+	err = output.Init()
 	if err != nil {
 		return fmt.Errorf("Output failed to initialize - %s", err)
 	}
@@ -105,12 +210,49 @@ func startLog_agg(ccmd *cobra.Command, args []string) error {
 		return fmt.Errorf("Input failed to initialize - %s", err)
 	}
 
-	err = api.Start(input.InputHandler)
-	if err != nil {
+	started := make(chan error, 1)
+	go func() {
+		started <- api.Start(input.InputHandler)
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+
+	select {
+	case err = <-started:
 		return fmt.Errorf("Api failed to initialize - %s", err)
+	case sig := <-signals:
+		config.Log.Info("Received %s, shutting down...", sig)
 	}
 
+	shutdown()
 	return nil
 }
 
+// stops accepting input, lets outputs write what they've been sent, then
+// closes the archive
+func shutdown() {
+	timeout := time.Duration(config.ShutdownTimeout) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// stop accepting input
+	err := api.Shutdown(ctx)
+	if err != nil {
+		config.Log.Error("Api failed to shut down cleanly - %s", err)
+	}
+	input.Close()
+
+	// drain outputs in whatever time is left
+	deadline, _ := ctx.Deadline()
+	pending := log_agg.Drain(deadline.Sub(time.Now()))
+
+	output.Close()
+
+	if len(pending) > 0 {
+		config.Log.Error("Shutdown timed out waiting on outputs %s", strings.Join(pending, ", "))
+	}
+	config.Log.Info("Shutdown complete - %d messages dropped, %d outputs unfinished", log_agg.Dropped(), len(pending))
+}
+
 
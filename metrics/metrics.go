@@ -0,0 +1,249 @@
+// Package metrics collects counters, gauges, and histograms and serves them in
+// the prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type (
+	// Counter is a metric that only goes up
+	Counter struct{ *family }
+
+	// Gauge is a metric that may be set to anything
+	Gauge struct{ *family }
+
+	// Histogram counts observations (commonly latencies, in seconds) into
+	// buckets
+	Histogram struct{ *family }
+
+	// family is a named metric and its series, one per set of label values
+	family struct {
+		name    string
+		help    string
+		kind    string
+		labels  []string
+		buckets []float64 // upper bounds, histograms only
+
+		mutex  sync.Mutex
+		series map[string]*series
+	}
+
+	series struct {
+		values []string
+		value  float64  // counter or gauge value, histogram sum
+		counts []uint64 // histogram observations per bucket (not cumulative)
+		count  uint64   // histogram observations
+	}
+)
+
+// DefaultBuckets suit latencies of a millisecond to several seconds
+var DefaultBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+var (
+	registry   = map[string]*family{}
+	collectors []func()
+	mutex      sync.Mutex // guards registry and collectors
+)
+
+// NewCounter registers a counter with the label names it is recorded by
+func NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{register(name, help, "counter", labels, nil)}
+}
+
+// NewGauge registers a gauge with the label names it is recorded by
+func NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{register(name, help, "gauge", labels, nil)}
+}
+
+// NewHistogram registers a histogram with the bucket upper bounds (sorted,
+// +Inf is implied) and label names it is recorded by
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return &Histogram{register(name, help, "histogram", labels, buckets)}
+}
+
+// OnCollect registers a func to run before the metrics are written, for
+// gauges that are cheaper to read than to keep up to date
+func OnCollect(collect func()) {
+	mutex.Lock()
+	collectors = append(collectors, collect)
+	mutex.Unlock()
+}
+
+func register(name, help, kind string, labels []string, buckets []float64) *family {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if _, ok := registry[name]; ok {
+		panic(fmt.Sprintf("metric '%s' registered twice", name))
+	}
+	f := &family{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		labels:  labels,
+		buckets: buckets,
+		series:  map[string]*series{},
+	}
+	registry[name] = f
+	return f
+}
+
+// Inc adds 1 to the counter for the label values
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add adds v (which must not be negative) to the counter for the label values
+func (c *Counter) Add(v float64, values ...string) {
+	c.mutex.Lock()
+	c.get(values).value += v
+	c.mutex.Unlock()
+}
+
+// Set sets the gauge for the label values
+func (g *Gauge) Set(v float64, values ...string) {
+	g.mutex.Lock()
+	g.get(values).value = v
+	g.mutex.Unlock()
+}
+
+// Reset removes every series of the gauge, so ones no longer set (a deleted
+// bucket) aren't reported
+func (g *Gauge) Reset() {
+	g.mutex.Lock()
+	g.series = map[string]*series{}
+	g.mutex.Unlock()
+}
+
+// Observe records v in the histogram for the label values
+func (h *Histogram) Observe(v float64, values ...string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	s := h.get(values)
+	s.value += v
+	s.count++
+	i := sort.SearchFloat64s(h.buckets, v)
+	if i < len(h.buckets) {
+		s.counts[i]++
+	}
+}
+
+// get returns the series for the label values, f.mutex must be held
+func (f *family) get(values []string) *series {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metric '%s' takes %d labels, got %d", f.name, len(f.labels), len(values)))
+	}
+
+	key := strings.Join(values, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{values: append([]string(nil), values...)}
+		if f.kind == "histogram" {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// Handler serves the metrics
+func Handler(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	res.WriteHeader(200)
+	Write(res)
+}
+
+// Write writes every metric in the prometheus text format, sorted by name
+func Write(writer io.Writer) error {
+	mutex.Lock()
+	collect := append([]func(){}, collectors...)
+	families := make([]*family, 0, len(registry))
+	for _, f := range registry {
+		families = append(families, f)
+	}
+	mutex.Unlock()
+
+	for i := range collect {
+		collect[i]()
+	}
+
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+
+	w := bufio.NewWriter(writer)
+	for _, f := range families {
+		f.write(w)
+	}
+	return w.Flush()
+}
+
+func (f *family) write(w *bufio.Writer) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, escape(f.help, false))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := f.series[key]
+		if f.kind != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", f.name, f.labelString(s.values, ""), formatFloat(s.value))
+			continue
+		}
+
+		var cumulative uint64
+		for i, bound := range f.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, f.labelString(s.values, formatFloat(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, f.labelString(s.values, "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", f.name, f.labelString(s.values, ""), formatFloat(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", f.name, f.labelString(s.values, ""), s.count)
+	}
+}
+
+// labelString formats the label values (and a histogram bucket's le)
+func (f *family) labelString(values []string, le string) string {
+	pairs := make([]string, 0, len(values)+1)
+	for i := range values {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, f.labels[i], escape(values[i], true)))
+	}
+	if le != "" {
+		pairs = append(pairs, fmt.Sprintf(`le="%s"`, le))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escape(s string, quote bool) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, "\n", `\n`, -1)
+	if quote {
+		s = strings.Replace(s, `"`, `\"`, -1)
+	}
+	return s
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,80 @@
+// metrics_test tests recording and writing metrics
+package metrics_test
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/r0h4n/log_agg/metrics"
+)
+
+// Test writing each kind of metric in the prometheus text format
+func TestWrite(t *testing.T) {
+	requests := metrics.NewCounter("test_requests_total", "Requests by method", "method", "path")
+	temperature := metrics.NewGauge("test_temperature", "Current temperature\nin celsius")
+	latency := metrics.NewHistogram("test_latency_seconds", "Request latency", []float64{.1, 1})
+
+	requests.Inc("GET", "/logs")
+	requests.Add(2, "GET", "/logs")
+	requests.Inc("POST", `/"quoted"\path`)
+	latency.Observe(.05)
+	latency.Observe(.5)
+	latency.Observe(5)
+
+	collected := 0
+	metrics.OnCollect(func() {
+		collected++
+		temperature.Set(21.5)
+	})
+
+	buf := &bytes.Buffer{}
+	if err := metrics.Write(buf); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	expected := `# HELP test_latency_seconds Request latency
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{le="0.1"} 1
+test_latency_seconds_bucket{le="1"} 2
+test_latency_seconds_bucket{le="+Inf"} 3
+test_latency_seconds_sum 5.55
+test_latency_seconds_count 3
+# HELP test_requests_total Requests by method
+# TYPE test_requests_total counter
+test_requests_total{method="GET",path="/logs"} 3
+test_requests_total{method="POST",path="/\"quoted\"\\path"} 1
+# HELP test_temperature Current temperature\nin celsius
+# TYPE test_temperature gauge
+test_temperature 21.5
+`
+	if buf.String() != expected || collected != 1 {
+		t.Errorf("%q doesn't match expected out", buf.String())
+	}
+
+	// collectors run for every scrape
+	temperature.Reset()
+	res := httptest.NewRecorder()
+	metrics.Handler(res, httptest.NewRequest("GET", "/metrics", nil))
+	if res.Code != 200 || !strings.HasPrefix(res.Header().Get("Content-Type"), "text/plain") || !strings.Contains(res.Body.String(), "\ntest_temperature 21.5\n") || collected != 2 {
+		t.Errorf("%q doesn't match expected out", res.Body.String())
+	}
+}
+
+// Test misused metrics panic
+func TestBadMetrics(t *testing.T) {
+	expectPanic := func(name string, fn func()) {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("%s is too forgiving", name)
+			}
+		}()
+		fn()
+	}
+
+	metrics.NewCounter("test_bad_total", "Bad", "label")
+	expectPanic("registering twice", func() { metrics.NewCounter("test_bad_total", "Bad") })
+	expectPanic("missing labels", func() { metrics.NewCounter("test_labels_total", "Labels", "label").Inc() })
+}
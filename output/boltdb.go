@@ -5,70 +5,149 @@ import (
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"math"
 	"os"
 	"path/filepath"
-	"regexp"
-	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/boltdb/bolt"
 
 	"github.com/r0h4n/log_agg/config"
+	"github.com/r0h4n/log_agg/query"
 	"github.com/r0h4n/log_agg/transform"
 )
 
 type (
-	// BoltArchive is a boltDB output archiver
+	// BoltArchive is a boltDB output archiver. Records are keyed by utime
+	// then a per type sequence, so messages with equal utimes don't collide.
 	BoltArchive struct {
-		db   *bolt.DB
-		Done chan bool
+		db       *bolt.DB // nil once Compact fails to reopen it
+		broken   error    // why db is nil
+		path     string
+		mutex    sync.RWMutex // held exclusively while Compact swaps db
+		writing  sync.RWMutex // held exclusively while Compact copies db
+		Done     chan bool    // stops Expire
+		stop     sync.Once
+		expiring sync.Mutex // held while Expire runs, so Close can wait for it
+
+		MaxBytes     int64   // bytes of records to keep in all, past it the oldest are deleted (0 for no limit)
+		CompactRatio float64 // compact after an expire pass once this fraction of the file is free (0 never)
 	}
 )
 
+// marks that records keyed only by utime have been migrated
+var keysMarker = []byte("unique-keys")
+
 // NewBoltArchive creates a new boltDB output archiver
 func NewBoltArchive(path string) (*BoltArchive, error) {
 	err := os.MkdirAll(filepath.Dir(path), 0755)
 	if err != nil {
 		return nil, err
 	}
-	d, err := bolt.Open(path, 0644, nil)
+	d, err := openBolt(path)
 	if err != nil {
 		return nil, err
 	}
 
 	archive := BoltArchive{
 		db:   d,
+		path: path,
 		Done: make(chan bool),
 	}
 
 	return &archive, nil
 }
 
+func openBolt(path string) (*bolt.DB, error) {
+	// don't wait forever on a db locked by another process (a running server)
+	return bolt.Open(path, 0644, &bolt.Options{Timeout: 5 * time.Second})
+}
+
+// view, update and batch run fn in a transaction of the db, which Compact
+// doesn't swap out from under them (update and batch also wait for it to copy)
+func (a *BoltArchive) view(fn func(*bolt.Tx) error) error {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	if a.db == nil {
+		return a.broken
+	}
+	return a.db.View(fn)
+}
+
+func (a *BoltArchive) update(fn func(*bolt.Tx) error) error {
+	a.writing.RLock()
+	defer a.writing.RUnlock()
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	if a.db == nil {
+		return a.broken
+	}
+	return a.db.Update(fn)
+}
+
+func (a *BoltArchive) batch(fn func(*bolt.Tx) error) error {
+	a.writing.RLock()
+	defer a.writing.RUnlock()
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	if a.db == nil {
+		return a.broken
+	}
+	return a.db.Batch(fn)
+}
+
 // Init initializes the archiver output
 func (a *BoltArchive) Init() error {
+	// rekey records from before message ids
+	err := a.migrateKeys()
+	if err != nil {
+		return fmt.Errorf("Failed to migrate keys - %s", err)
+	}
+
+	// build or drop the search index
+	err = a.initIndex()
+	if err != nil {
+		return fmt.Errorf("Failed to initialize search index - %s", err)
+	}
+
 	// add output
-	log_agg.AddOutput("historical", a.Write)
+	log_agg.AddBatchOutput("historical", a.WriteBatch)
 
 	return nil
 }
 
-// Close closes the bolt db
+// Close stops Expire and closes the bolt db (once pending writes finish)
 func (a *BoltArchive) Close() {
+	a.stop.Do(func() { close(a.Done) })
+	a.expiring.Lock()
+	a.expiring.Unlock()
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.db == nil {
+		return
+	}
 	err := a.db.Close()
 	if err != nil {
 		config.Log.Error("Faile to close bolt - %s", err.Error())
 	}
 }
 
-// Slice returns a slice of logs based on the name, offset, limit, and log-level
-func (a *BoltArchive) Slice(name, host string, tag []string, offset, end, limit int64, level int) ([]log_agg.Message, error) {
+// Slice returns a slice of logs based on the name, offset, limit, log-level, and query
+func (a *BoltArchive) Slice(name, host string, tag []string, offset, end, limit int64, level int, q *query.Query) ([]log_agg.Message, error) {
+	start := time.Now()
+	defer func() { sliceSeconds.Observe(time.Since(start).Seconds()) }()
+
 	var messages []log_agg.Message
 
-	err := a.db.View(func(tx *bolt.Tx) error {
+	err := a.view(func(tx *bolt.Tx) error {
 		messages = make([]log_agg.Message, 0)
 		bucket := tx.Bucket([]byte(name))
 
-		if bucket == nil {
+		// buckets starting with "_" don't hold logs
+		if bucket == nil || strings.HasPrefix(name, "_") {
 			return nil
 		}
 		c := bucket.Cursor()
@@ -78,70 +157,40 @@ func (a *BoltArchive) Slice(name, host string, tag []string, offset, end, limit
 		}
 
 		// prepare to skip to the correct id
-		initial := &bytes.Buffer{}
-		if offset == 0 {
-			// if no offset value is given, start with last log
-			initial.Write(last)
-		} else {
-			// otherwise, start at their offset
-			if err := binary.Write(initial, binary.BigEndian, offset); err != nil {
-				return err
-			}
-		}
-
-		// prepare to end at the specified time (pagination limits still apply)
-		final := &bytes.Buffer{}
-		if err := binary.Write(final, binary.BigEndian, end); err != nil {
-			return err
+		initial := last
+		if offset != 0 {
+			// start after every record at their offset
+			initial = recordKey(offset, math.MaxUint64)
 		}
 
-		// seek boltdb cursor to initial offset
-		k, v := c.Seek(initial.Bytes())
-
-		// if the record's utime (k) doesn't match the specified "initial" value, use previous record.
-		// note: https://github.com/boltdb/bolt/blob/v1.2.0/cursor.go#L114 explains why.
-		// (this step may not be needed if the order of logs returned is reversed)
-		if string(k) != initial.String() {
-			k, v = c.Prev()
-		}
+		next := walk(tx, bucket, name, initial, q)
 
 		// todo: make limit be len(bucket)? if limit < 0
-		for ; k != nil && limit > 0; k, v = c.Prev() {
-			msg := log_agg.Message{}
-			// if specified end is reached, be done
-			if string(k) == final.String() {
-				limit = 0
+		for k, v := next(); k != nil && limit > 0; k, v = next() {
+			utime, ok := keyTime(k)
+			if !ok {
+				continue
+			}
+			// if specified end is passed, be done (pagination limits still apply)
+			if end != 0 && utime < end {
+				break
 			}
 
+			msg := log_agg.Message{}
 			// unmarshal to check if match.. seems expensive
 			if err := json.Unmarshal(v, &msg); err != nil {
 				return fmt.Errorf("Couldn't unmarshal message - %s", err)
 			}
+			msg.MessageId, _ = keyId(k)
 
-			if msg.Priority >= level {
-				if host == "" || msg.Id == host {
-					// todo: negate here if tag starts with "!"
-					if len(tag) == 0 {
-						limit--
-
-						// prepend messages with new message (display newest last)
-						messages = append([]log_agg.Message{msg}, messages...)
-					} else {
-						for x := range msg.Tag {
-							for y := range tag {
-								if tag[y] == "" || msg.Tag[x] == tag[y] {
-									limit--
-
-									// prepend messages with new message (display newest last)
-									messages = append([]log_agg.Message{msg}, messages...)
-
-									return nil
-								}
-							}
-						}
-					}
-				}
+			if !matches(msg, host, tag, level, q) {
+				continue
 			}
+
+			limit--
+
+			// prepend messages with new message (display newest last)
+			messages = append([]log_agg.Message{msg}, messages...)
 		}
 
 		return nil
@@ -154,211 +203,700 @@ func (a *BoltArchive) Slice(name, host string, tag []string, offset, end, limit
 	return messages, nil
 }
 
+// Count counts logs based on the name, offset, log-level, and query per
+// interval, by group
+func (a *BoltArchive) Count(name, host string, tag []string, offset, end, interval int64, level int, q *query.Query, by string) (Counts, error) {
+	start := time.Now()
+	defer func() { sliceSeconds.Observe(time.Since(start).Seconds()) }()
+
+	counts := Counts{}
+	err := a.view(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(name))
+		if bucket == nil || strings.HasPrefix(name, "_") {
+			return nil
+		}
+		last, _ := bucket.Cursor().Last()
+		if last == nil {
+			return nil
+		}
+
+		initial := last
+		if offset != 0 {
+			initial = recordKey(offset, math.MaxUint64)
+		}
+
+		// without filters or groups, the keys' times are all that's counted
+		unfiltered := host == "" && len(tag) == 0 && level <= 0 && q == nil && by == ""
+
+		next := walk(tx, bucket, name, initial, q)
+		for k, v := next(); k != nil; k, v = next() {
+			utime, ok := keyTime(k)
+			if !ok {
+				continue
+			}
+			if end != 0 && utime < end {
+				break
+			}
+			if unfiltered {
+				counts.Add(IntervalStart(utime, interval), 1)
+				counts.AddGroup(IntervalStart(utime, interval), "", 1)
+				continue
+			}
+
+			msg := log_agg.Message{}
+			if err := json.Unmarshal(v, &msg); err != nil {
+				return fmt.Errorf("Couldn't unmarshal message - %s", err)
+			}
+			if !matches(msg, host, tag, level, q) {
+				continue
+			}
+			counts.Add(IntervalStart(utime, interval), 1)
+			for _, group := range groups(msg, by) {
+				counts.AddGroup(IntervalStart(utime, interval), group, 1)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return counts, nil
+}
+
+// matches reports whether the message passes the Slice filters
+func matches(msg log_agg.Message, host string, tag []string, level int, q *query.Query) bool {
+	if msg.Priority < level || (host != "" && msg.Id != host) {
+		return false
+	}
+
+	// tag params match any of the tags, the query can exclude them
+	if len(tag) != 0 && !hasTag(msg, tag) {
+		return false
+	}
+
+	return q == nil || q.Match(msg)
+}
+
+// walk returns an iterator over a bucket's records, newest first, starting at
+// initial. With the search index enabled, only records that may match the
+// query are visited.
+func walk(tx *bolt.Tx, bucket *bolt.Bucket, name string, initial []byte, q *query.Query) func() ([]byte, []byte) {
+	if config.SearchIndex && q != nil {
+		if keys, ok := candidates(q.Root, tx.Bucket(indexName(name))); ok {
+			return walkKeys(bucket, initial, keys)
+		}
+	}
+
+	c := bucket.Cursor()
+
+	// seek boltdb cursor to initial offset
+	k, v := c.Seek(initial)
+
+	// if the record's utime (k) doesn't match the specified "initial" value, use previous record.
+	// note: https://github.com/boltdb/bolt/blob/v1.2.0/cursor.go#L114 explains why.
+	// (this step may not be needed if the order of logs returned is reversed)
+	if !bytes.Equal(k, initial) {
+		k, v = c.Prev()
+	}
+
+	first := true
+	return func() ([]byte, []byte) {
+		if first {
+			first = false
+			return k, v
+		}
+		return c.Prev()
+	}
+}
+
+// hasTag reports whether the message has any of the tags ("" matches any tag)
+func hasTag(msg log_agg.Message, tag []string) bool {
+	for x := range msg.Tag {
+		for y := range tag {
+			if tag[y] == "" || msg.Tag[x] == tag[y] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // Write writes the message to database
 func (a *BoltArchive) Write(msg log_agg.Message) {
-	// don't archive raw stream
+	config.Log.Trace("Bolt archive writing...")
+	start := time.Now()
+	err := a.batch(func(tx *bolt.Tx) error {
+		return put(tx, msg)
+	})
+	writeSeconds.Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		writeFailures.Inc()
+		config.Log.Error("Historical write failed - %s", err)
+	}
+}
+
+// WriteBatch writes the messages to database in a single transaction
+func (a *BoltArchive) WriteBatch(msgs []log_agg.Message) {
+	config.Log.Trace("Bolt archive writing %d messages...", len(msgs))
+	start := time.Now()
+	err := a.update(func(tx *bolt.Tx) error {
+		for i := range msgs {
+			if err := put(tx, msgs[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	writeSeconds.Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		writeFailures.Inc()
+		config.Log.Error("Historical write of %d messages failed - %s", len(msgs), err)
+	}
+}
+
+// put stores the message in its type's bucket
+func put(tx *bolt.Tx, msg log_agg.Message) error {
+	// don't archive raw stream (or an id, the key is the id)
 	msg.Raw = []byte{}
+	msg.MessageId = ""
 
-	config.Log.Trace("Bolt archive writing...")
-	err := a.db.Batch(func(tx *bolt.Tx) error {
-		bucket, err := tx.CreateBucketIfNotExists([]byte(msg.Type))
+	// a bad type could write into another tenant's, or the archive's own,
+	// bucket
+	if err := ValidType(msg.Type); err != nil {
+		writeFailures.Inc()
+		config.Log.Error("Historical write skipped - %s", err)
+		return nil
+	}
+
+	name := TenantType(msg.Tenant, msg.Type)
+	bucket, err := tx.CreateBucketIfNotExists([]byte(name))
+	if err != nil {
+		return err
+	}
+
+	value, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	seq, err := bucket.NextSequence()
+	if err != nil {
+		return err
+	}
+
+	key := recordKey(msg.UTime, seq)
+	if err = bucket.Put(key, value); err != nil {
+		return err
+	}
+
+	if config.SearchIndex {
+		return index(tx, name, key, msg.Content)
+	}
+
+	return nil
+}
+
+// recordKey builds a record's key from its utime and sequence (big-endian, to
+// ensure lexographical order)
+func recordKey(utime int64, seq uint64) []byte {
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint64(key, uint64(utime))
+	binary.BigEndian.PutUint64(key[8:], seq)
+	return key
+}
+
+// keyTime returns the utime of a record key, or false if key isn't one
+func keyTime(key []byte) (int64, bool) {
+	if len(key) != 16 {
+		return 0, false
+	}
+	return int64(binary.BigEndian.Uint64(key)), true
+}
+
+// keyId returns the message id of a record key, or false if key isn't one
+func keyId(key []byte) (string, bool) {
+	utime, ok := keyTime(key)
+	if !ok {
+		return "", false
+	}
+	return messageId(utime, binary.BigEndian.Uint64(key[8:])), true
+}
+
+// migrateKeys rekeys records written before message ids, which were keyed by
+// utime alone, with a sequence
+func (a *BoltArchive) migrateKeys() error {
+	return a.update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists([]byte("_config"))
 		if err != nil {
 			return err
 		}
+		if meta.Get(keysMarker) != nil {
+			return nil
+		}
+
+		// buckets starting with "_" don't hold logs
+		var kinds [][]byte
+		tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			if !bytes.HasPrefix(name, []byte("_")) {
+				kinds = append(kinds, name)
+			}
+			return nil
+		})
+
+		migrated := 0
+		for _, kind := range kinds {
+			bucket := tx.Bucket(kind)
+
+			// collect first, a bucket can't be modified while iterating
+			var keys [][]byte
+			bucket.ForEach(func(k, v []byte) error {
+				if len(k) == 8 {
+					keys = append(keys, append([]byte{}, k...))
+				}
+				return nil
+			})
+
+			// keys are in order, so sequences are too
+			for _, k := range keys {
+				seq, err := bucket.NextSequence()
+				if err != nil {
+					return err
+				}
+				value := append([]byte{}, bucket.Get(k)...)
+				if err = bucket.Put(recordKey(int64(binary.BigEndian.Uint64(k)), seq), value); err != nil {
+					return err
+				}
+				if err = bucket.Delete(k); err != nil {
+					return err
+				}
+			}
+			migrated += len(keys)
+		}
+
+		if migrated > 0 {
+			config.Log.Info("Migrated %d archived logs to unique keys", migrated)
+
+			// the search index refers to the old keys, have it rebuilt
+			if err = dropIndex(tx); err != nil {
+				return err
+			}
+		}
 
-		value, err := json.Marshal(msg)
+		return meta.Put(keysMarker, []byte("true"))
+	})
+}
+
+// Expire cleans up old logs by date or volume of logs, compacting the db once
+// enough of it is free
+func (a *BoltArchive) Expire(rules Retention, every time.Duration) {
+	a.expiring.Lock()
+	defer a.expiring.Unlock()
+
+	expireLoop(a.Done, rules, a.MaxBytes, every, func(rules Retention, dryRun bool) ([]Expiry, error) {
+		expired, err := a.Cleanup(rules, dryRun)
+		if err == nil && a.CompactRatio > 0 && a.freeRatio() >= a.CompactRatio {
+			if err = a.Compact(); err != nil {
+				err = fmt.Errorf("Failed to compact - %s", err)
+			}
+		}
+		return expired, err
+	})
+}
+
+// Cleanup deletes the records of each bucket the retention rules don't keep
+// (each bucket in its own transaction), then the oldest records of any bucket
+// until MaxBytes are left. With dryRun it only counts them.
+func (a *BoltArchive) Cleanup(rules Retention, dryRun bool) ([]Expiry, error) {
+	var names []string
+	err := a.view(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			if !bytes.HasPrefix(name, []byte("_")) {
+				names = append(names, string(name))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var expired []Expiry
+	var kept [][]byte // oldest record kept of each bucket
+	for _, name := range names {
+		// buckets without a rule are only sized up
+		key, rule, ok := rules.rule(name)
+		if !ok {
+			rule = Rule{Max: -1, MaxBytes: -1}
+		}
+
+		// size the bucket up without holding up writes, then delete what
+		// it doesn't keep
+		var e Expiry
+		var oldest, doomed []byte
+		err = a.view(func(tx *bolt.Tx) error {
+			e, oldest, doomed = sizeBucket(tx, name, rule, now)
+			return nil
+		})
+		if err == nil && !dryRun && doomed != nil {
+			err = a.deleteThrough(name, doomed)
+		}
 		if err != nil {
-			return err
+			return sortExpiries(expired), fmt.Errorf("Failed to clean '%s' - %s", name, err)
 		}
 
-		// this needs to ensure lexographical order
-		key := &bytes.Buffer{}
-		if err = binary.Write(key, binary.BigEndian, msg.UTime); err != nil {
-			return err
+		e.Rule = key
+		expired = append(expired, e)
+		kept = append(kept, oldest)
+	}
+
+	if a.MaxBytes > 0 {
+		trim := func(tx *bolt.Tx) error {
+			return trimArchive(tx, expired, kept, a.MaxBytes, dryRun)
+		}
+		if dryRun {
+			err = a.view(trim)
+		} else {
+			err = a.update(trim)
 		}
-		if err = bucket.Put(key.Bytes(), value); err != nil {
+		if err != nil {
+			return sortExpiries(expired), fmt.Errorf("Failed to trim archive to %d bytes - %s", a.MaxBytes, err)
+		}
+	}
+
+	return sortExpiries(expired), nil
+}
+
+// sizeBucket walks a bucket's records from newest to oldest, counting those
+// older than the rule's age, or past its max or maxBytes. Those are always the
+// oldest records, so the oldest record kept, and newest not, are returned too.
+func sizeBucket(tx *bolt.Tx, name string, rule Rule, now time.Time) (Expiry, []byte, []byte) {
+	e := Expiry{Bucket: name}
+	bucket := tx.Bucket([]byte(name))
+	if bucket == nil {
+		return e, nil, nil
+	}
+
+	cutoff := rule.cutoff(now)
+	max, maxBytes := rule.limits()
+
+	var oldest, doomed []byte
+	c := bucket.Cursor()
+	for k, v := c.Last(); k != nil; k, v = c.Prev() {
+		utime, ok := keyTime(k)
+		if !ok {
+			continue
+		}
+		size := int64(len(k) + len(v))
+		e.Records++
+		e.Bytes += size
+
+		switch {
+		case utime < cutoff:
+			e.ByAge++
+		case e.Records > max:
+			e.ByMax++
+		case e.Bytes > maxBytes:
+			e.ByBytes++
+		default:
+			e.KeptBytes += size
+			oldest = append(oldest[:0], k...)
+			continue
+		}
+		e.Deleted++
+		if doomed == nil {
+			doomed = append([]byte{}, k...)
+		}
+	}
+
+	return e, oldest, doomed
+}
+
+// records deleted per transaction, so writes aren't held up for long
+const deleteTxRecords = 10000
+
+// deleteThrough deletes a bucket's records from its oldest through the one
+// keyed last, deleteTxRecords per transaction
+func (a *BoltArchive) deleteThrough(name string, last []byte) error {
+	for done := false; !done; {
+		err := a.update(func(tx *bolt.Tx) error {
+			bucket := tx.Bucket([]byte(name))
+			if bucket == nil {
+				done = true
+				return nil
+			}
+
+			// collect first, deleting while walking a cursor skips records
+			var doomed [][]byte
+			c := bucket.Cursor()
+			for k, _ := c.First(); k != nil && bytes.Compare(k, last) <= 0 && len(doomed) < deleteTxRecords; k, _ = c.Next() {
+				if _, ok := keyTime(k); ok {
+					doomed = append(doomed, append([]byte{}, k...))
+				}
+			}
+			done = len(doomed) < deleteTxRecords
+
+			for _, k := range doomed {
+				unindexRecord(tx, name, k, bucket.Get(k))
+				if err := bucket.Delete(k); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
 			return err
 		}
+	}
+	return nil
+}
 
+// trimArchive deletes (unless dryRun) the oldest records kept of any bucket,
+// until the buckets keep maxBytes in all. kept holds each bucket's oldest
+// record kept.
+func trimArchive(tx *bolt.Tx, expired []Expiry, kept [][]byte, maxBytes int64, dryRun bool) error {
+	var total int64
+	for i := range expired {
+		total += expired[i].KeptBytes
+	}
+	if total <= maxBytes {
+		return nil
+	}
+
+	// merge the buckets' records, oldest first, from where they were cleaned to
+	type head struct {
+		bucket *bolt.Bucket
+		c      *bolt.Cursor
+		k, v   []byte
+		doomed [][]byte
+	}
+	heads := make([]*head, len(expired))
+	for i := range expired {
+		h := &head{bucket: tx.Bucket([]byte(expired[i].Bucket))}
+		if h.bucket != nil && kept[i] != nil {
+			h.c = h.bucket.Cursor()
+			h.k, h.v = h.c.Seek(kept[i])
+		}
+		heads[i] = h
+	}
+
+	for total > maxBytes {
+		next := -1
+		for i, h := range heads {
+			if h.k != nil && (next < 0 || bytes.Compare(h.k, heads[next].k) < 0) {
+				next = i
+			}
+		}
+		if next < 0 {
+			break
+		}
+
+		h, e := heads[next], &expired[next]
+		size := int64(len(h.k) + len(h.v))
+		total -= size
+		e.KeptBytes -= size
+		e.ByTotal++
+		e.Deleted++
+		if !dryRun {
+			h.doomed = append(h.doomed, append([]byte{}, h.k...))
+		}
+		h.k, h.v = h.c.Next()
+	}
+
+	for i, h := range heads {
+		for _, k := range h.doomed {
+			unindexRecord(tx, expired[i].Bucket, k, h.bucket.Get(k))
+			if err := h.bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// freeRatio returns the fraction of the db file that is free pages
+func (a *BoltArchive) freeRatio() float64 {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	if a.db == nil {
+		return 0
+	}
+	var size int64
+	a.db.View(func(tx *bolt.Tx) error {
+		size = tx.Size()
 		return nil
 	})
+	if size == 0 {
+		return 0
+	}
+	stats := a.db.Stats()
+	return float64(stats.FreeAlloc) / float64(size)
+}
+
+// compactTxBytes is how much Compact copies per transaction, bounding its memory
+const compactTxBytes = 16 << 20
+
+// Compact copies the db into a fresh file and swaps it in, returning the space
+// of deleted records to the filesystem. Writes wait until it's done, reads only
+// while the files are swapped. If the db can't be reopened after, the archive
+// is unusable (every read and write fails) until restarted.
+func (a *BoltArchive) Compact() error {
+	a.writing.Lock()
+	defer a.writing.Unlock()
+
+	start := time.Now()
+	before, _ := os.Stat(a.path)
 
+	tmp := a.path + ".compact"
+	os.Remove(tmp)
+	dst, err := bolt.Open(tmp, 0644, nil)
 	if err != nil {
-		config.Log.Error("Historical write failed - %s", err)
+		return err
 	}
-}
 
-// Expire cleans up old logs by date or volume of logs
-func (a *BoltArchive) Expire() {
-	// if log-keep is "" expire is disabled
-	if config.LogKeep == "" {
-		config.Log.Debug("Log expiration disabled")
-		return
+	err = a.view(func(tx *bolt.Tx) error {
+		c := &compactor{dst: dst}
+		err := tx.ForEach(func(name []byte, bucket *bolt.Bucket) error {
+			return c.copyBucket(bucket, [][]byte{name})
+		})
+		if err != nil {
+			if c.tx != nil {
+				c.tx.Rollback()
+			}
+			return err
+		}
+		return c.commit()
+	})
+	if err == nil {
+		err = dst.Close()
+	} else {
+		dst.Close()
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
 	}
 
-	var logKeep map[string]interface{}
-	err := json.Unmarshal([]byte(config.LogKeep), &logKeep)
+	// swap the files, reopening the old one if that fails
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if err = a.db.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	err = os.Rename(tmp, a.path)
 	if err != nil {
-		config.Log.Fatal("Bad JSON syntax for log-keep - %s, saving logs indefinitely", err)
-		return
+		os.Remove(tmp)
+	}
+	d, openErr := openBolt(a.path)
+	if openErr != nil {
+		a.db = nil
+		a.broken = fmt.Errorf("Archive unusable, failed to reopen '%s' after compacting - %s", a.path, openErr)
+		return a.broken
+	}
+	a.db = d
+	if err != nil {
+		return err
 	}
 
-	if config.CleanFreq < 1 {
-		config.CleanFreq = 60
-	}
-
-	config.Log.Trace("LogKeep - %v; CleanFreq - %d", logKeep, config.CleanFreq)
-
-	// clean up every minute // todo: maybe 5mins?
-	tick := time.Tick(time.Duration(config.CleanFreq) * time.Second)
-
-	r, _ := regexp.Compile("([0-9]+)([a-za-z]+)")
-	var (
-		NANO_MIN  int64 = 60000000000
-		NANO_HOUR int64 = NANO_MIN * 60
-		NANO_DAY  int64 = NANO_HOUR * 24
-		NANO_WEEK int64 = NANO_DAY * 7
-		NANO_YEAR int64 = NANO_WEEK * 52
-		duration  int64 = NANO_WEEK * 2
-		NANO_SEC  int64 = NANO_MIN / 60
-	)
-
-	for {
-		select {
-		case <-tick:
-			for bucketName, saveAmt := range logKeep { // todo: maybe rather/also loop through buckets
-				config.Log.Trace("bucketName - %s; saveAmt - %v", bucketName, saveAmt)
-				// todo: handle if someone specifies `{"app":"10000"}` (convert to int and fallthrough?)
-				switch saveAmt.(type) {
-				case string:
-					var expireTime = time.Now().UnixNano()
-
-					match := r.FindStringSubmatch(saveAmt.(string)) // "2w"
-					config.Log.Trace("SaveAmt - %v, match - %v", saveAmt, match)
-					if len(match) == 3 {
-						number, err := strconv.ParseInt(match[1], 0, 64)
-						if err != nil {
-							config.Log.Fatal("Bad log-keep - %s", err)
-							number = 2
-						}
-						switch match[2] {
-						case "s": // second // for testing
-							config.Log.Debug("Keeping logs for %d seconds", number)
-							duration = NANO_SEC * number
-						case "m": // minute
-							config.Log.Debug("Keeping logs for %d minutes", number)
-							duration = NANO_MIN * number
-						case "h": // hour
-							config.Log.Debug("Keeping logs for %d hours", number)
-							duration = NANO_HOUR * number
-						case "d": // day
-							config.Log.Debug("Keeping logs for %d days", number)
-							duration = NANO_DAY * number
-						case "w": // week
-							config.Log.Debug("Keeping logs for %d weeks", number)
-							duration = NANO_WEEK * number
-						case "y": // year
-							config.Log.Debug("Keeping logs for %d years", number)
-							duration = NANO_YEAR * number
-						default: // 2 weeks
-							config.Log.Debug("Keeping '%s' logs for 2 weeks", bucketName)
-							duration = NANO_WEEK * 2
-						}
-					}
-
-					expireTime = expireTime - duration
-					eTime := &bytes.Buffer{}
-					if err := binary.Write(eTime, binary.BigEndian, expireTime); err != nil {
-						config.Log.Error("Failed to convert expire time to binary - %s", err.Error())
-						continue
-					}
-
-					config.Log.Debug("Starting age cleanup batch...")
-					a.db.Batch(func(tx *bolt.Tx) error {
-						bucket := tx.Bucket([]byte(bucketName))
-						if bucket == nil {
-							config.Log.Debug("No logs of type '%s' found", bucketName)
-							return fmt.Errorf("No logs of type '%s' found", bucketName)
-						}
-
-						c := bucket.Cursor()
-
-						var err error
-
-						// loop through and remove outdated logs
-						for k, _ := c.First(); k != nil; k, _ = c.Next() {
-							// if logMessage.UTime < expireTime {
-							if bytes.Compare(k, eTime.Bytes()) == -1 {
-								config.Log.Trace("Deleting expired log of type '%s'...", bucketName)
-								err = c.Delete()
-								if err != nil {
-									config.Log.Debug("Failed to delete expired log - %s", err)
-								}
-								config.Log.Trace("Deleted log")
-							} else { // don't continue looping through newer logs (resource/file-lock hog)
-								config.Log.Trace("Done with old logs")
-								break
-							}
-						}
-
-						config.Log.Debug("=======================================")
-						config.Log.Debug("= DONE CHECKING/DELETING EXPIRED LOGS =")
-						config.Log.Debug("=======================================")
-						return nil
-					})
-					config.Log.Trace("Done defining batch")
-				case float64, int:
-					records := int(saveAmt.(float64)) // assertion is slow, do it once (casting is fast)
-
-					config.Log.Debug("Starting record cleanup batch...")
-					a.db.Batch(func(tx *bolt.Tx) error {
-						bucket := tx.Bucket([]byte(bucketName))
-						if bucket == nil {
-							config.Log.Trace("No logs of type '%s' found", bucketName)
-							return fmt.Errorf("No logs of type '%s' found", bucketName)
-						}
-
-						// trim the bucket to size
-						c := bucket.Cursor()
-
-						rSaved := 0
-						// loop through and remove extra logs
-						// if we ever stop ordering by time (oldest first) we'll need to change cursor placement
-						for k, v := c.Last(); k != nil && v != nil; k, v = c.Prev() {
-							rSaved += 1
-							// if the number records we've traversed is larger than our limit, delet the current record
-							if rSaved > records {
-								config.Log.Trace("Deleting extra log of type '%s'...", bucketName)
-								err = c.Delete()
-								if err != nil {
-									config.Log.Trace("Failed to delete extra log - %s", err)
-								}
-							}
-						}
-
-						config.Log.Debug("=======================================")
-						config.Log.Debug("= DONE CHECKING/DELETING EXPIRED LOGS =")
-						config.Log.Debug("=======================================")
-						return nil
-					})
-				default:
-					// todo: we should pre-parse these values and exit on startup, not x minutes into running
-					config.Log.Fatal("Bad log-keep value")
-					os.Exit(1)
-				}
-			} // range logKeep
-		case <-a.Done:
-			config.Log.Debug("Done recieved on channel. (Cleanup halting)")
-			return
+	compactions.Inc()
+	if after, statErr := os.Stat(a.path); statErr == nil && before != nil {
+		config.Log.Info("Compacted archive from %d to %d bytes in %s", before.Size(), after.Size(), time.Since(start))
+	}
+	return nil
+}
+
+// compactor copies buckets into dst, committing every compactTxBytes
+type compactor struct {
+	dst  *bolt.DB
+	tx   *bolt.Tx
+	size int64
+}
+
+// copyBucket copies src, and the buckets nested in it, to the bucket at path
+func (c *compactor) copyBucket(src *bolt.Bucket, path [][]byte) error {
+	dst, err := c.bucket(path)
+	if err != nil {
+		return err
+	}
+	if err = dst.SetSequence(src.Sequence()); err != nil {
+		return err
+	}
+
+	return src.ForEach(func(k, v []byte) error {
+		if v == nil {
+			err := c.copyBucket(src.Bucket(k), append(path[:len(path):len(path)], k))
+			if err != nil {
+				return err
+			}
+			// the nested copy may have committed
+			dst, err = c.bucket(path)
+			return err
+		}
+
+		c.size += int64(len(k) + len(v))
+		if c.size > compactTxBytes {
+			if err := c.commit(); err != nil {
+				return err
+			}
+			if dst, err = c.bucket(path); err != nil {
+				return err
+			}
+		}
+		return dst.Put(k, v)
+	})
+}
+
+// bucket returns the bucket at path in the current transaction, creating both
+// as needed
+func (c *compactor) bucket(path [][]byte) (*bolt.Bucket, error) {
+	if c.tx == nil {
+		tx, err := c.dst.Begin(true)
+		if err != nil {
+			return nil, err
 		}
+		c.tx = tx
+	}
+
+	bucket, err := c.tx.CreateBucketIfNotExists(path[0])
+	for _, name := range path[1:] {
+		if err != nil {
+			break
+		}
+		bucket, err = bucket.CreateBucketIfNotExists(name)
+	}
+	return bucket, err
+}
+
+func (c *compactor) commit() error {
+	if c.tx == nil {
+		return nil
 	}
+	err := c.tx.Commit()
+	c.tx, c.size = nil, 0
+	return err
+}
+
+// size returns the size of the db file
+func (a *BoltArchive) size() (int64, error) {
+	var size int64
+	err := a.view(func(tx *bolt.Tx) error {
+		size = tx.Size()
+		return nil
+	})
+	return size, err
 }
 
 // Save writes a value to the database
 func (a *BoltArchive) Save(db, key string, v interface{}) error {
 	config.Log.Trace("Saving...")
 
-	err := a.db.Batch(func(tx *bolt.Tx) error {
+	err := a.batch(func(tx *bolt.Tx) error {
 		bucket, err := tx.CreateBucketIfNotExists([]byte(db))
 		if err != nil {
 			return err
@@ -386,13 +924,16 @@ func (a *BoltArchive) Save(db, key string, v interface{}) error {
 // Get gets values from the database
 func (a *BoltArchive) Get(db, key string, v interface{}) error {
 	// get all configs
-	err := a.db.View(func(tx *bolt.Tx) error {
+	err := a.view(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(db))
 		if bucket == nil {
 			return fmt.Errorf("No bucket found")
 		}
 
 		value := bucket.Get([]byte(key))
+		if value == nil {
+			return fmt.Errorf("No value found")
+		}
 		err := json.Unmarshal(value, &v)
 		if err != nil {
 			return fmt.Errorf("Bad JSON in stored output config - %s", err.Error())
@@ -0,0 +1,225 @@
+package output
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+
+	"github.com/boltdb/bolt"
+
+	"github.com/r0h4n/log_agg/config"
+	"github.com/r0h4n/log_agg/query"
+	"github.com/r0h4n/log_agg/transform"
+)
+
+// The search index is an inverted index of message content kept in a bucket
+// per log type ("_index:app"). Keys are "word\x00recordkey" with empty values,
+// so the records containing a word (or a word prefix) are found with a seek.
+
+// marks that the index has been built for every existing record
+var indexMarker = []byte("search-index")
+
+func indexName(kind string) []byte {
+	return []byte("_index:" + kind)
+}
+
+// index adds the content's words for the record stored at key
+func index(tx *bolt.Tx, kind string, key []byte, content string) error {
+	bucket, err := tx.CreateBucketIfNotExists(indexName(kind))
+	if err != nil {
+		return err
+	}
+
+	for _, word := range uniqueWords(content) {
+		if err = bucket.Put(indexKey(word, key), []byte{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unindexRecord removes the index entries of a stored record
+func unindexRecord(tx *bolt.Tx, kind string, key, value []byte) {
+	if !config.SearchIndex {
+		return
+	}
+
+	bucket := tx.Bucket(indexName(kind))
+	if bucket == nil {
+		return
+	}
+
+	msg := log_agg.Message{}
+	if err := json.Unmarshal(value, &msg); err != nil {
+		return
+	}
+	for _, word := range uniqueWords(msg.Content) {
+		bucket.Delete(indexKey(word, key))
+	}
+}
+
+func indexKey(word string, key []byte) []byte {
+	k := make([]byte, 0, len(word)+1+len(key))
+	k = append(k, word...)
+	k = append(k, 0)
+	return append(k, key...)
+}
+
+func uniqueWords(content string) []string {
+	seen := map[string]bool{}
+	var words []string
+	for _, word := range query.Words(content) {
+		if !seen[word] {
+			seen[word] = true
+			words = append(words, word)
+		}
+	}
+	return words
+}
+
+// initIndex indexes every existing record when the search index is first
+// enabled, and drops the index when it is disabled
+func (a *BoltArchive) initIndex() error {
+	return a.update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists([]byte("_config"))
+		if err != nil {
+			return err
+		}
+
+		if !config.SearchIndex {
+			return dropIndex(tx)
+		}
+
+		if meta.Get(indexMarker) != nil {
+			return nil
+		}
+
+		var kinds [][]byte
+		tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			if !bytes.HasPrefix(name, []byte("_")) {
+				kinds = append(kinds, name)
+			}
+			return nil
+		})
+
+		config.Log.Info("Building search index...")
+		for _, kind := range kinds {
+			err = tx.Bucket(kind).ForEach(func(k, v []byte) error {
+				msg := log_agg.Message{}
+				if err := json.Unmarshal(v, &msg); err != nil {
+					return nil
+				}
+				return index(tx, string(kind), k, msg.Content)
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		return meta.Put(indexMarker, []byte("true"))
+	})
+}
+
+// dropIndex removes the search index (and its marker, so it is rebuilt if
+// enabled)
+func dropIndex(tx *bolt.Tx) error {
+	var indexes [][]byte
+	tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+		if bytes.HasPrefix(name, []byte("_index:")) {
+			indexes = append(indexes, name)
+		}
+		return nil
+	})
+
+	for _, name := range indexes {
+		if err := tx.DeleteBucket(name); err != nil {
+			return err
+		}
+	}
+
+	meta := tx.Bucket([]byte("_config"))
+	if meta == nil {
+		return nil
+	}
+	return meta.Delete(indexMarker)
+}
+
+// walkKeys returns an iterator over the given records, newest first,
+// starting at initial
+func walkKeys(bucket *bolt.Bucket, initial []byte, keys map[string]bool) func() ([]byte, []byte) {
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		if k <= string(initial) {
+			sorted = append(sorted, k)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(sorted)))
+
+	i := 0
+	return func() ([]byte, []byte) {
+		for ; i < len(sorted); i++ {
+			k := []byte(sorted[i])
+			if v := bucket.Get(k); v != nil {
+				i++
+				return k, v
+			}
+		}
+		return nil, nil
+	}
+}
+
+// candidates returns the keys of records that may match the query, or false
+// if the query can't be narrowed down by the index
+func candidates(n *query.Node, bucket *bolt.Bucket) (map[string]bool, bool) {
+	switch n.Op {
+	case "word", "prefix":
+		keys := map[string]bool{}
+		if bucket == nil {
+			return keys, true
+		}
+
+		prefix := []byte(n.Text)
+		if n.Op == "word" {
+			prefix = append(prefix, 0)
+		}
+		c := bucket.Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			keys[string(k[bytes.IndexByte(k, 0)+1:])] = true
+		}
+		return keys, true
+	case "and":
+		// narrowing by any child is enough, the full query is still applied
+		var keys map[string]bool
+		for _, child := range n.Children {
+			childKeys, ok := candidates(child, bucket)
+			if !ok {
+				continue
+			}
+			if keys == nil {
+				keys = childKeys
+				continue
+			}
+			for k := range keys {
+				if !childKeys[k] {
+					delete(keys, k)
+				}
+			}
+		}
+		return keys, keys != nil
+	case "or":
+		keys := map[string]bool{}
+		for _, child := range n.Children {
+			childKeys, ok := candidates(child, bucket)
+			if !ok {
+				return nil, false
+			}
+			for k := range childKeys {
+				keys[k] = true
+			}
+		}
+		return keys, true
+	}
+
+	// substrings, regexes, comparisons, and negations need every record checked
+	return nil, false
+}
@@ -3,13 +3,20 @@
 package output_test
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
 	"os"
+	"regexp"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/boltdb/bolt"
 	"github.com/jcelliott/lumber"
 
 	"github.com/r0h4n/log_agg/config"
+	"github.com/r0h4n/log_agg/metrics"
 	"github.com/r0h4n/log_agg/transform"
 	"github.com/r0h4n/log_agg/output"
 )
@@ -60,7 +67,7 @@ func TestWrite(t *testing.T) {
 	output.Archiver.Write(messages[1])
 
 	// test successful write
-	appMsgs, err := output.Archiver.Slice("app", "", []string{""}, 0, 0, 100, 0)
+	appMsgs, err := output.Archiver.Slice("app", "", []string{""}, 0, 0, 100, 0, nil)
 	if err != nil {
 		t.Error(err)
 		t.FailNow()
@@ -72,16 +79,126 @@ func TestWrite(t *testing.T) {
 	}
 }
 
+// Test messages with the same utime don't overwrite each other
+func TestCollision(t *testing.T) {
+	now := time.Now().UnixNano()
+	for _, content := range []string{"first", "second", "third"} {
+		output.Archiver.Write(log_agg.Message{UTime: now, Type: "collide", Tag: []string{"test"}, Content: content})
+	}
+
+	msgs, err := output.Archiver.Slice("collide", "", nil, 0, 0, 100, 0, nil)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if len(msgs) != 3 || msgs[0].Content != "first" || msgs[2].Content != "third" {
+		t.Errorf("%+v doesn't match expected out", msgs)
+		t.FailNow()
+	}
+	if msgs[0].MessageId == "" || msgs[0].MessageId >= msgs[1].MessageId || msgs[1].MessageId >= msgs[2].MessageId {
+		t.Errorf("message ids %q, %q, %q aren't ordered", msgs[0].MessageId, msgs[1].MessageId, msgs[2].MessageId)
+	}
+
+	// offset and end include every message at their utime
+	msgs, err = output.Archiver.Slice("collide", "", nil, now, now, 100, 0, nil)
+	if err != nil || len(msgs) != 3 {
+		t.Errorf("%+v doesn't match expected out - %v", msgs, err)
+	}
+	msgs, err = output.Archiver.Slice("collide", "", nil, now-1, 0, 100, 0, nil)
+	if err != nil || len(msgs) != 0 {
+		t.Errorf("%+v doesn't match expected out - %v", msgs, err)
+	}
+}
+
+// Test records keyed by utime alone are migrated
+// Test types that would reach another tenant's, or the archive's own,
+// buckets are neither written nor read
+func TestBadType(t *testing.T) {
+	archive, err := output.NewBoltArchive("/tmp/boltdbTest/badtype.bolt")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer archive.Close()
+	archive.Save("_files", "/var/log/app.log", 10)
+
+	now := time.Now().UnixNano()
+	// the rest of a batch is still written
+	archive.WriteBatch([]log_agg.Message{
+		{UTime: now, Type: "_files", Content: "reserved"},
+		{UTime: now, Tenant: "team-a", Type: "team-b/app", Content: "namespaced"},
+		{UTime: now, Type: "", Content: "untyped"},
+		{UTime: now, Type: "app", Content: "kept"},
+	})
+
+	msgs, err := archive.Slice("app", "", nil, 0, 0, 100, 0, nil)
+	if err != nil || len(msgs) != 1 || msgs[0].Content != "kept" {
+		t.Errorf("%+v doesn't match expected out - %v", msgs, err)
+	}
+	for _, name := range []string{"_files", "team-a/team-b/app"} {
+		msgs, err = archive.Slice(name, "", nil, 0, 0, 100, 0, nil)
+		if err != nil || len(msgs) != 0 {
+			t.Errorf("%s - %+v doesn't match expected out - %v", name, msgs, err)
+		}
+	}
+}
+
+func TestMigrateKeys(t *testing.T) {
+	path := "/tmp/boltdbTest/migrate.bolt"
+	db, err := bolt.Open(path, 0644, nil)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucket([]byte("app"))
+		if err != nil {
+			return err
+		}
+		for i, content := range []string{"old", "older"} {
+			key := make([]byte, 8)
+			binary.BigEndian.PutUint64(key, uint64(2-i))
+			value, _ := json.Marshal(log_agg.Message{UTime: int64(2 - i), Type: "app", Content: content})
+			if err = bucket.Put(key, value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	db.Close()
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	archive, err := output.NewBoltArchive(path)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer archive.Close()
+	if err = archive.Init(); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	archive.Write(log_agg.Message{UTime: 2, Type: "app", Content: "new"})
+
+	msgs, err := archive.Slice("app", "", nil, 0, 0, 100, 0, nil)
+	if err != nil || len(msgs) != 3 || msgs[0].Content != "older" || msgs[1].Content != "old" || msgs[2].Content != "new" {
+		t.Errorf("%+v doesn't match expected out - %v", msgs, err)
+	}
+}
+
 // Test expiring/cleanup of data
 func TestExpire(t *testing.T) {
-	go output.Archiver.Expire()
+	go output.Archiver.Expire(output.RetentionRules(), time.Second)
 	time.Sleep(2 * time.Second)
 
 	// finish expire loop
 	output.Archiver.(*output.BoltArchive).Done <- true
 
 	// test successful clean
-	appMsgs, err := output.Archiver.Slice("app", "", []string{""}, 0, 0, 100, 0)
+	appMsgs, err := output.Archiver.Slice("app", "", []string{""}, 0, 0, 100, 0, nil)
 	if err != nil {
 		t.Error(err)
 		t.FailNow()
@@ -93,7 +210,7 @@ func TestExpire(t *testing.T) {
 	}
 
 	// test successful clean
-	depMsgs, err := output.Archiver.Slice("deploy", "", []string{""}, 0, 0, 100, 0)
+	depMsgs, err := output.Archiver.Slice("deploy", "", []string{""}, 0, 0, 100, 0, nil)
 	if err != nil {
 		t.Error(err)
 		t.FailNow()
@@ -104,10 +221,113 @@ func TestExpire(t *testing.T) {
 		t.FailNow()
 	}
 
+	// expire passes and the records they deleted are measured
+	buf := &bytes.Buffer{}
+	metrics.Write(buf)
+	for _, expected := range []string{
+		`(?m)^log_agg_expired_records_total\{bucket="app"\} [1-9]`,
+		`(?m)^log_agg_expire_passes_total [1-9]`,
+		`(?m)^log_agg_archive_records\{bucket="app"\} 0$`,
+		`(?m)^log_agg_archive_size_bytes [1-9]`,
+		`(?m)^log_agg_archive_query_seconds_count [1-9]`,
+	} {
+		if !regexp.MustCompile(expected).Match(buf.Bytes()) {
+			t.Errorf("metrics don't match '%s'", expected)
+		}
+	}
+
 	output.Archiver.(*output.BoltArchive).Close()
 
 }
 
+// Test cleaning deletes the oldest records over several transactions
+func TestCleanupBatches(t *testing.T) {
+	archive, err := output.NewBoltArchive("/tmp/boltdbTest/batches.bolt")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer archive.Close()
+
+	start := time.Now().UnixNano()
+	var msgs []log_agg.Message
+	for i := 0; i < 25000; i++ {
+		msgs = append(msgs, log_agg.Message{UTime: start + int64(i), Type: "app", Content: "x"})
+	}
+	archive.WriteBatch(msgs)
+
+	rules, _ := output.ParseRetention(`{"app":100}`)
+	expired, err := archive.Cleanup(rules, false)
+	if err != nil || len(expired) != 1 || expired[0].Deleted != 24900 {
+		t.Errorf("%+v doesn't match expected out - %v", expired, err)
+	}
+
+	logs, err := archive.Slice("app", "", nil, 0, 0, 1000, 0, nil)
+	if err != nil || len(logs) != 100 || logs[0].UTime != start+24900 {
+		t.Errorf("%d logs don't match expected out - %v", len(logs), err)
+	}
+}
+
+// Test compacting returns the space of deleted records, keeping the rest
+func TestCompact(t *testing.T) {
+	path := "/tmp/boltdbTest/compact.bolt"
+	archive, err := output.NewBoltArchive(path)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer archive.Close()
+
+	content := strings.Repeat("x", 1024)
+	start := time.Now().UnixNano()
+	var msgs []log_agg.Message
+	for i := 0; i < 4000; i++ {
+		msgs = append(msgs, log_agg.Message{UTime: start + int64(i), Type: "app", Content: content})
+	}
+	archive.WriteBatch(msgs)
+	archive.Save("_config", "outputs", []string{"kept"})
+
+	rules, _ := output.ParseRetention(`{"app":10}`)
+	if _, err = archive.Cleanup(rules, false); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	before, _ := os.Stat(path)
+
+	// writes wait for the compaction
+	done := make(chan bool)
+	go func() {
+		archive.Write(log_agg.Message{UTime: start + 5000, Type: "app", Content: "during"})
+		close(done)
+	}()
+	if err = archive.Compact(); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	<-done
+	archive.Write(log_agg.Message{UTime: start + 6000, Type: "app", Content: "after"})
+
+	after, _ := os.Stat(path)
+	if after.Size() >= before.Size()/4 {
+		t.Errorf("Compacted from %d to only %d bytes", before.Size(), after.Size())
+	}
+
+	logs, err := archive.Slice("app", "", nil, 0, 0, 100, 0, nil)
+	if err != nil || len(logs) != 12 || logs[10].Content != "during" || logs[11].Content != "after" {
+		t.Errorf("%d logs don't match expected out - %v", len(logs), err)
+		t.FailNow()
+	}
+	// sequences carry on
+	if logs[11].MessageId <= logs[9].MessageId || logs[0].UTime != start+3990 {
+		t.Errorf("%+v doesn't match expected out", logs[11])
+	}
+
+	var stored []string
+	if err = archive.Get("_config", "outputs", &stored); err != nil || len(stored) != 1 {
+		t.Errorf("%q doesn't match expected out - %v", stored, err)
+	}
+}
+
 // manually configure and start internals
 func initialize() error {
 	var err error
@@ -0,0 +1,472 @@
+package output
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/r0h4n/log_agg/config"
+	"github.com/r0h4n/log_agg/transform"
+)
+
+// default datadog http log intake
+const datadogIntake = "https://http-intake.logs.datadoghq.com/api/v2/logs"
+
+// log_agg priorities (0(trace)-5(fatal)) mapped onto syslog severities
+var syslogSeverity = []int{7, 7, 6, 4, 3, 2}
+
+// lumber level names, indexed by priority
+var priorityNames = []string{"trace", "debug", "info", "warn", "error", "fatal"}
+
+type (
+	// syslogForwarder writes rfc5424 messages to a remote syslog server
+	syslogForwarder struct {
+		network   string // "udp", "tcp", or "tls"
+		address   string
+		appName   string
+		tlsConfig *tls.Config
+		conn      net.Conn
+		closed    chan struct{} // closed once the server closes a stream conn
+		mutex     sync.Mutex
+	}
+
+	// httpForwarder posts json messages to a remote http endpoint
+	httpForwarder struct {
+		endpoint string
+		output   log_agg.Output
+		client   *http.Client
+		body     func(log_agg.Output, log_agg.Message) ([]byte, error)
+		header   func(log_agg.Output, *http.Request)
+	}
+
+	// forwarder is a registered forwarding output
+	forwarder struct {
+		output  log_agg.Output
+		runtime bool // added at runtime (persisted in the archive)
+	}
+
+	// datadogLog is a log entry as accepted by datadog's http intake
+	datadogLog struct {
+		Source   string `json:"ddsource"`
+		Tags     string `json:"ddtags,omitempty"`
+		Hostname string `json:"hostname,omitempty"`
+		Message  string `json:"message"`
+		Service  string `json:"service,omitempty"`
+		Status   string `json:"status"`
+	}
+)
+
+var (
+	forwarders      = map[string]forwarder{}
+	forwardersMutex sync.Mutex
+)
+
+// ForwarderTag returns the tag a forwarder is registered with in log_agg
+func ForwarderTag(o log_agg.Output) string {
+	return fmt.Sprintf("forward-%s-%s", o.Type, o.URI)
+}
+
+// NewForwarder creates an output func that forwards messages to the third
+// party endpoint defined in o
+func NewForwarder(o log_agg.Output) (log_agg.OutputFunc, error) {
+	switch o.Type {
+	case "syslog", "papertrail":
+		// papertrail accepts tls on its syslog ports
+		network := "udp"
+		if o.Type == "papertrail" {
+			network = "tls"
+		}
+		return newSyslogForwarder(o, network)
+	case "http":
+		if o.URI == "" {
+			return nil, fmt.Errorf("Missing endpoint")
+		}
+		return newHttpForwarder(o, o.URI, httpBody, httpHeader), nil
+	case "datadog":
+		if o.AuthKey == "" {
+			return nil, fmt.Errorf("Missing datadog api key")
+		}
+		endpoint := o.URI
+		if endpoint == "" {
+			endpoint = datadogIntake
+		}
+		return newHttpForwarder(o, endpoint, datadogBody, datadogHeader), nil
+	default:
+		return nil, fmt.Errorf("Unknown output type '%s'", o.Type)
+	}
+}
+
+// forwardInit adds an output for each configured forwarder, and for each
+// forwarder previously added at runtime
+func forwardInit() error {
+	forwardersMutex.Lock()
+	defer forwardersMutex.Unlock()
+
+	forwarders = map[string]forwarder{}
+
+	for _, f := range config.Forwarders {
+		o := log_agg.Output{
+			Type:       f["type"],
+			URI:        f["endpoint"],
+			ID:         f["id"],
+			AuthKey:    f["key"],
+			AuthSecret: f["secret"],
+		}
+
+		forwarder, err := NewForwarder(o)
+		if err != nil {
+			return fmt.Errorf("Bad forwarder '%s' - %s", o.Type, err)
+		}
+		addForwarder(o, forwarder, false)
+		config.Log.Info("Forwarding output '%s' to '%s' initialized", o.Type, o.URI)
+	}
+
+	var stored []log_agg.Output
+	err := Archiver.Get("_config", "outputs", &stored)
+	if err != nil {
+		config.Log.Debug("No stored forwarders - %s", err)
+		return nil
+	}
+
+	for _, o := range stored {
+		forwarder, err := NewForwarder(o)
+		if err != nil {
+			config.Log.Error("Bad stored forwarder '%s' - %s", o.Type, err)
+			continue
+		}
+		addForwarder(o, forwarder, true)
+		config.Log.Info("Forwarding output '%s' to '%s' restored", o.Type, o.URI)
+	}
+
+	return nil
+}
+
+// AddForwarder adds a forwarding output at runtime and saves it to the
+// archive so it is restored on restart
+func AddForwarder(o log_agg.Output) error {
+	forward, err := NewForwarder(o)
+	if err != nil {
+		return err
+	}
+
+	forwardersMutex.Lock()
+	defer forwardersMutex.Unlock()
+
+	old, exists := forwarders[ForwarderTag(o)]
+	forwarders[ForwarderTag(o)] = forwarder{output: o, runtime: true}
+	err = saveForwarders()
+	if err != nil {
+		if exists {
+			forwarders[ForwarderTag(o)] = old
+		} else {
+			delete(forwarders, ForwarderTag(o))
+		}
+		return err
+	}
+
+	log_agg.AddOutput(ForwarderTag(o), forward)
+	return nil
+}
+
+// RemoveForwarder removes the forwarding output matching o's type and endpoint
+func RemoveForwarder(o log_agg.Output) error {
+	forwardersMutex.Lock()
+	defer forwardersMutex.Unlock()
+
+	old, exists := forwarders[ForwarderTag(o)]
+	if !exists {
+		return fmt.Errorf("No output '%s' to '%s' found", o.Type, o.URI)
+	}
+
+	delete(forwarders, ForwarderTag(o))
+	if old.runtime {
+		err := saveForwarders()
+		if err != nil {
+			forwarders[ForwarderTag(o)] = old
+			return err
+		}
+	}
+
+	log_agg.RemoveOutput(ForwarderTag(o))
+	return nil
+}
+
+// Forwarders returns the registered forwarding outputs
+func Forwarders() []log_agg.Output {
+	forwardersMutex.Lock()
+	defer forwardersMutex.Unlock()
+
+	outputs := []log_agg.Output{}
+	for _, tag := range forwarderTags() {
+		outputs = append(outputs, forwarders[tag].output)
+	}
+	return outputs
+}
+
+// registers the forwarder with log_agg, forwardersMutex must be held
+func addForwarder(o log_agg.Output, forward log_agg.OutputFunc, runtime bool) {
+	forwarders[ForwarderTag(o)] = forwarder{output: o, runtime: runtime}
+	log_agg.AddOutput(ForwarderTag(o), forward)
+}
+
+// returns the registered tags in order, forwardersMutex must be held
+func forwarderTags() []string {
+	tags := make([]string, 0, len(forwarders))
+	for tag := range forwarders {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// persists the runtime forwarders, forwardersMutex must be held
+func saveForwarders() error {
+	stored := []log_agg.Output{}
+	for _, tag := range forwarderTags() {
+		if forwarders[tag].runtime {
+			stored = append(stored, forwarders[tag].output)
+		}
+	}
+	return Archiver.Save("_config", "outputs", stored)
+}
+
+func newSyslogForwarder(o log_agg.Output, network string) (log_agg.OutputFunc, error) {
+	address := o.URI
+	if strings.Contains(address, "://") {
+		u, err := url.Parse(address)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse endpoint - %s", err)
+		}
+		network, address = u.Scheme, u.Host
+	}
+
+	switch network {
+	case "udp", "tcp", "tls":
+	default:
+		return nil, fmt.Errorf("Unsupported syslog network '%s'", network)
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return nil, fmt.Errorf("Bad syslog endpoint - %s", err)
+	}
+
+	s := &syslogForwarder{
+		network: network,
+		address: address,
+		appName: o.ID,
+	}
+	if network == "tls" {
+		host, _, _ := net.SplitHostPort(address)
+		s.tlsConfig = &tls.Config{ServerName: host}
+	}
+
+	return s.Write, nil
+}
+
+func (s *syslogForwarder) dial() (net.Conn, error) {
+	if s.network == "tls" {
+		return tls.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}, "tcp", s.address, s.tlsConfig)
+	}
+	return net.DialTimeout(s.network, s.address, 10*time.Second)
+}
+
+// Write sends the message, reconnecting once if the connection was lost
+func (s *syslogForwarder) Write(msg log_agg.Message) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	frame := s.format(msg)
+	if s.network != "udp" {
+		// octet counting (rfc6587), messages may hold newlines
+		frame = append([]byte(strconv.Itoa(len(frame))+" "), frame...)
+	}
+
+	for attempt := 0; attempt < 2; attempt++ {
+		if s.conn != nil && !s.alive() {
+			s.conn.Close()
+			s.conn = nil
+		}
+		if s.conn == nil {
+			conn, err := s.dial()
+			if err != nil {
+				config.Log.Error("Syslog forward to '%s' failed - %s", s.address, err)
+				return
+			}
+			s.conn = conn
+			s.watch()
+		}
+
+		s.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		_, err := s.conn.Write(frame)
+		if err == nil {
+			return
+		}
+
+		config.Log.Debug("Syslog forward to '%s' failed, reconnecting - %s", s.address, err)
+		s.conn.Close()
+		s.conn = nil
+	}
+
+	config.Log.Error("Syslog forward to '%s' failed, message dropped", s.address)
+}
+
+// watch reads a stream connection in the background, noting when the server
+// closes it. Servers don't send anything, so reads only end once it's closed.
+func (s *syslogForwarder) watch() {
+	s.closed = nil
+	if s.network == "udp" {
+		return
+	}
+
+	conn, closed := s.conn, make(chan struct{})
+	s.closed = closed
+	go func() {
+		io.Copy(ioutil.Discard, conn)
+		close(closed)
+	}()
+}
+
+// alive checks whether the server has closed a stream connection, as writes
+// to a closed connection usually succeed (and are lost) the first time
+func (s *syslogForwarder) alive() bool {
+	select {
+	case <-s.closed:
+		return false
+	default:
+		return true
+	}
+}
+
+// format builds an rfc5424 frame ("<PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID SD MSG")
+func (s *syslogForwarder) format(msg log_agg.Message) []byte {
+	priority := msg.Priority
+	if priority < 0 || priority >= len(syslogSeverity) {
+		priority = 2
+	}
+
+	timestamp := msg.Time
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+
+	hostname := msg.Id
+	if hostname == "" {
+		hostname, _ = os.Hostname()
+	}
+
+	appName := s.appName
+	if appName == "" && len(msg.Tag) > 0 {
+		appName = msg.Tag[0]
+	}
+
+	// user-level facility (1)
+	return []byte(fmt.Sprintf("<%d>1 %s %s %s - - - %s",
+		8+syslogSeverity[priority],
+		timestamp.UTC().Format(time.RFC3339Nano),
+		syslogValue(hostname, 255),
+		syslogValue(appName, 48),
+		msg.Content))
+}
+
+// syslogValue trims a header value to the allowed length, using the rfc5424 nil value if empty
+func syslogValue(s string, max int) string {
+	s = strings.Join(strings.Fields(s), "_")
+	if s == "" {
+		return "-"
+	}
+	if len(s) > max {
+		return s[:max]
+	}
+	return s
+}
+
+func newHttpForwarder(o log_agg.Output, endpoint string, body func(log_agg.Output, log_agg.Message) ([]byte, error), header func(log_agg.Output, *http.Request)) log_agg.OutputFunc {
+	h := &httpForwarder{
+		endpoint: endpoint,
+		output:   o,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		body:     body,
+		header:   header,
+	}
+	return h.Write
+}
+
+// Write posts the message to the endpoint
+func (h *httpForwarder) Write(msg log_agg.Message) {
+	body, err := h.body(h.output, msg)
+	if err != nil {
+		config.Log.Error("Http forward to '%s' failed to marshal - %s", h.endpoint, err)
+		return
+	}
+
+	req, err := http.NewRequest("POST", h.endpoint, bytes.NewReader(body))
+	if err != nil {
+		config.Log.Error("Http forward to '%s' failed - %s", h.endpoint, err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	h.header(h.output, req)
+
+	res, err := h.client.Do(req)
+	if err != nil {
+		config.Log.Error("Http forward to '%s' failed - %s", h.endpoint, err)
+		return
+	}
+	res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		config.Log.Error("Http forward to '%s' failed - status '%d'", h.endpoint, res.StatusCode)
+	}
+}
+
+// generic http posts the message as is
+func httpBody(o log_agg.Output, msg log_agg.Message) ([]byte, error) {
+	msg.Raw = nil
+	if o.ID != "" && msg.Id == "" {
+		msg.Id = o.ID
+	}
+	return json.Marshal(msg)
+}
+
+func httpHeader(o log_agg.Output, req *http.Request) {
+	if o.AuthKey != "" || o.AuthSecret != "" {
+		req.SetBasicAuth(o.AuthKey, o.AuthSecret)
+	}
+}
+
+// datadog expects an array of logs
+func datadogBody(o log_agg.Output, msg log_agg.Message) ([]byte, error) {
+	status := "info"
+	if msg.Priority >= 0 && msg.Priority < len(priorityNames) {
+		status = priorityNames[msg.Priority]
+	}
+
+	tags := []string{"type:" + msg.Type}
+	for i := range msg.Tag {
+		tags = append(tags, "tag:"+msg.Tag[i])
+	}
+
+	return json.Marshal([]datadogLog{{
+		Source:   "log_agg",
+		Tags:     strings.Join(tags, ","),
+		Hostname: msg.Id,
+		Message:  msg.Content,
+		Service:  o.ID,
+		Status:   status,
+	}})
+}
+
+func datadogHeader(o log_agg.Output, req *http.Request) {
+	req.Header.Set("DD-API-KEY", o.AuthKey)
+}
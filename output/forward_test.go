@@ -0,0 +1,204 @@
+package output_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/r0h4n/log_agg/config"
+	"github.com/r0h4n/log_agg/output"
+	"github.com/r0h4n/log_agg/transform"
+)
+
+var forwardMsg = log_agg.Message{
+	Time:     time.Date(2016, 3, 7, 15, 48, 57, 0, time.UTC),
+	Id:       "myhost",
+	Tag:      []string{"nginx"},
+	Type:     "app",
+	Priority: 4,
+	Content:  "This is a forwarded message",
+}
+
+// Test forwarding to a udp syslog server
+func TestForwardSyslogUDP(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer server.Close()
+
+	forward, err := output.NewForwarder(log_agg.Output{Type: "syslog", URI: "udp://" + server.LocalAddr().String(), ID: "myapp"})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	forward(forwardMsg)
+
+	buf := make([]byte, 1024)
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := server.ReadFrom(buf)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	expected := "<11>1 2016-03-07T15:48:57Z myhost myapp - - - This is a forwarded message"
+	if string(buf[:n]) != expected {
+		t.Errorf("%q doesn't match expected out", buf[:n])
+	}
+}
+
+// Test forwarding to a tcp syslog server, including reconnecting
+func TestForwardSyslogTCP(t *testing.T) {
+	server, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer server.Close()
+
+	forward, err := output.NewForwarder(log_agg.Output{Type: "syslog", URI: "tcp://" + server.Addr().String()})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	lines := make(chan string, 2)
+	go func() {
+		for {
+			conn, err := server.Accept()
+			if err != nil {
+				return
+			}
+			// octet counted, "<length> <frame>"
+			r := bufio.NewReader(conn)
+			length, _ := r.ReadString(' ')
+			size, _ := strconv.Atoi(strings.TrimSpace(length))
+			frame := make([]byte, size)
+			io.ReadFull(r, frame)
+			lines <- length + string(frame)
+			conn.Close()
+		}
+	}()
+
+	for i := 0; i < 2; i++ {
+		forward(forwardMsg)
+		select {
+		case line := <-lines:
+			if line != "73 <11>1 2016-03-07T15:48:57Z myhost nginx - - - This is a forwarded message" {
+				t.Errorf("%q doesn't match expected out", line)
+			}
+		case <-time.After(time.Second):
+			t.Error("syslog server received nothing")
+			t.FailNow()
+		}
+		// give the forwarder a chance to notice the closed connection
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// Test forwarding to generic http and datadog endpoints
+func TestForwardHttp(t *testing.T) {
+	requests := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		requests <- req
+		bodies <- body
+		res.WriteHeader(202)
+	}))
+	defer server.Close()
+
+	forward, err := output.NewForwarder(log_agg.Output{Type: "http", URI: server.URL, AuthKey: "user", AuthSecret: "pass"})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	forward(forwardMsg)
+
+	req, body := <-requests, <-bodies
+	if user, pass, _ := req.BasicAuth(); user != "user" || pass != "pass" {
+		t.Errorf("%q:%q doesn't match expected auth", user, pass)
+	}
+	msg := log_agg.Message{}
+	if err = json.Unmarshal(body, &msg); err != nil || msg.Content != forwardMsg.Content {
+		t.Errorf("%q doesn't match expected out", body)
+	}
+
+	forward, err = output.NewForwarder(log_agg.Output{Type: "datadog", URI: server.URL, ID: "web", AuthKey: "secret-key"})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	forward(forwardMsg)
+
+	req, body = <-requests, <-bodies
+	if req.Header.Get("DD-API-KEY") != "secret-key" {
+		t.Errorf("%q doesn't match expected api key", req.Header.Get("DD-API-KEY"))
+	}
+	logs := []map[string]string{}
+	if err = json.Unmarshal(body, &logs); err != nil || len(logs) != 1 {
+		t.Errorf("%q doesn't match expected out", body)
+		t.FailNow()
+	}
+	if logs[0]["message"] != forwardMsg.Content || logs[0]["status"] != "error" || logs[0]["service"] != "web" ||
+		logs[0]["hostname"] != "myhost" || !strings.Contains(logs[0]["ddtags"], "tag:nginx") {
+		t.Errorf("%q doesn't match expected out", body)
+	}
+}
+
+// Test runtime forwarders are restored on restart
+func TestForwardRestore(t *testing.T) {
+	config.DbAddress = "boltdb:///tmp/boltdbTest/forward.bolt"
+	if err := output.Init(); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	o := log_agg.Output{Type: "http", URI: "http://127.0.0.1:1/logs"}
+	if err := output.AddForwarder(o); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	output.Archiver.Close()
+
+	if err := output.Init(); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer output.Archiver.Close()
+
+	restored := output.Forwarders()
+	if len(restored) != 1 || restored[0] != o {
+		t.Errorf("%+v doesn't match expected out", restored)
+	}
+
+	if err := output.RemoveForwarder(o); err != nil {
+		t.Error(err)
+	}
+}
+
+// Test bad forwarder definitions
+func TestForwardBad(t *testing.T) {
+	bad := []log_agg.Output{
+		{Type: "carrier-pigeon", URI: "127.0.0.1:514"},
+		{Type: "syslog", URI: "ftp://127.0.0.1:514"},
+		{Type: "syslog", URI: "127.0.0.1"},
+		{Type: "http"},
+		{Type: "datadog"},
+	}
+	for _, o := range bad {
+		if _, err := output.NewForwarder(o); err == nil {
+			t.Errorf("%+v is too forgiving", o)
+		}
+	}
+}
@@ -1,10 +1,15 @@
-// Package output handles the storing of logs.
+// Package output handles the storing of logs and forwarding them to third parties.
 package output
 
 import (
 	"fmt"
 	"net/url"
+	"strings"
+	"time"
+
 	"github.com/r0h4n/log_agg/config"
+	"github.com/r0h4n/log_agg/metrics"
+	"github.com/r0h4n/log_agg/query"
 	"github.com/r0h4n/log_agg/transform"
 )
 
@@ -13,63 +18,182 @@ type (
 	Output interface {
 		// Init initializes the output interface
 		Init() error
-		// Slice returns a slice of logs based on the name, offset, limit, and log-level
-		Slice(name, host string, tag []string, offset, end, limit int64, level int) ([]log_agg.Message, error)
+		// Slice returns a slice of logs based on the name, offset, limit, log-level, and query (may be nil)
+		Slice(name, host string, tag []string, offset, end, limit int64, level int, q *query.Query) ([]log_agg.Message, error)
+		// Count counts the logs Slice would return (without a limit) per interval, by group (see CountBy)
+		Count(name, host string, tag []string, offset, end, interval int64, level int, q *query.Query, by string) (Counts, error)
 		// Write writes the message to file/database
 		Write(msg log_agg.Message)
-		// Expire cleans up old logs
-		Expire()
+		// Expire cleans up the logs the retention rules don't keep every
+		// interval, until Close
+		Expire(rules Retention, every time.Duration)
+		// Cleanup deletes the logs the retention rules don't keep, or with
+		// dryRun only reports them
+		Cleanup(rules Retention, dryRun bool) ([]Expiry, error)
+		// Save writes a value (json encoded) to the database
+		Save(db, key string, v interface{}) error
+		// Get reads a value saved with Save into v
+		Get(db, key string, v interface{}) error
+		// Close closes the connection to the database
+		Close()
 	}
+)
 
+var Archiver Output // default archive output
+
+var (
+	writeSeconds   = metrics.NewHistogram("log_agg_archive_write_seconds", "Time taken to write messages to the archive", metrics.DefaultBuckets)
+	writeFailures  = metrics.NewCounter("log_agg_archive_write_failures_total", "Archive writes that failed (messages weren't archived)")
+	sliceSeconds   = metrics.NewHistogram("log_agg_archive_query_seconds", "Time taken to query (Slice or Count) the archive", metrics.DefaultBuckets)
+	expiredRecords = metrics.NewCounter("log_agg_expired_records_total", "Records deleted by expire, by bucket (tenant/type)", "bucket")
+	expirePasses   = metrics.NewCounter("log_agg_expire_passes_total", "Expire passes run")
+	expireLastPass = metrics.NewGauge("log_agg_expire_last_pass_records", "Records deleted by the last expire pass")
+	archiveRecords = metrics.NewGauge("log_agg_archive_records", "Records archived as of the last expire pass, by bucket (tenant/type)", "bucket")
+	archiveBytes   = metrics.NewGauge("log_agg_archive_size_bytes", "Size of the archive (bolt file, or postgres table)")
+	storedBytes    = metrics.NewGauge("log_agg_archive_stored_bytes", "Bytes of records archived as of the last expire pass, by bucket (tenant/type)", "bucket")
+	compactions    = metrics.NewCounter("log_agg_archive_compactions_total", "Times the bolt archive was compacted")
 )
 
-var Archiver Output             // default archive output
+// archiveStats is satisfied by archives that can measure their size. Records
+// are counted by expire passes, walking them on every scrape costs too much.
+type archiveStats interface {
+	// size returns the archive's size in bytes
+	size() (int64, error)
+}
+
+func init() {
+	metrics.OnCollect(collectArchive)
+}
+
+// collectArchive updates the archive's size gauge
+func collectArchive() {
+	archive, ok := Archiver.(archiveStats)
+	if !ok {
+		return
+	}
+
+	size, err := archive.size()
+	if err != nil {
+		config.Log.Error("Failed to collect archive metrics - %s", err)
+		return
+	}
+	archiveBytes.Set(float64(size))
+}
 
 // Init initializes the archiver output if configured
 func Init() error {
+	// validate log-keep before anything starts
+	rules, err := ParseRetention(config.LogKeep)
+	if err != nil {
+		return err
+	}
+	retention = rules
+
+	archiveMaxBytes = 0
+	if config.ArchiveMaxBytes != "" {
+		archiveMaxBytes, err = parseBytes(config.ArchiveMaxBytes)
+		if err != nil {
+			return fmt.Errorf("Bad archive-max-bytes - %s", err)
+		}
+	}
+
 	// initialize archiver
-	err := archiveInit()
+	err = archiveInit()
 	if err != nil {
 		return fmt.Errorf("Failed to initialize archiver - %s", err)
 	}
 	config.Log.Info("Archiving output '%s' initialized", config.DbAddress)
 
+	// initialize third party forwarders
+	err = forwardInit()
+	if err != nil {
+		return fmt.Errorf("Failed to initialize forwarders - %s", err)
+	}
+
 	return nil
 }
 
+// Close closes the archive (stopping its cleanup)
+func Close() {
+	if Archiver != nil {
+		Archiver.Close()
+	}
+}
+
 func archiveInit() error {
+	var err error
+	Archiver, err = OpenArchive()
+	if err != nil {
+		return err
+	}
+	if archive, ok := Archiver.(*BoltArchive); ok {
+		archive.MaxBytes = archiveMaxBytes
+		archive.CompactRatio = config.ArchiveCompactRatio
+	} else if archiveMaxBytes > 0 {
+		Archiver.Close()
+		return fmt.Errorf("archive-max-bytes is only supported by boltdb")
+	}
+	// initialize Archiver
+	err = Archiver.Init()
+	if err != nil {
+		return err
+	}
+	// start cleanup goroutine
+	every := config.CleanFreq
+	if every < 1 {
+		every = 60
+	}
+	go Archiver.Expire(retention, time.Duration(every)*time.Second)
+	return nil
+}
+
+// OpenArchive connects to the archive at config.DbAddress without starting it
+// as an output (for Save and Get outside of the server)
+func OpenArchive() (Output, error) {
 	u, err := url.Parse(config.DbAddress)
 	if err != nil {
 		u, err = url.Parse("boltdb://" + config.DbAddress)
 		if err != nil {
-			return fmt.Errorf("Failed to parse db connection - %s", err)
+			return nil, fmt.Errorf("Failed to parse db connection - %s", err)
 		}
 	}
 
-
 	switch u.Scheme {
-	case "boltdb":
-		Archiver, err = NewBoltArchive(u.Path)
-		if err != nil {
-			return err
-		}
-	case "file":
-		Archiver, err = NewBoltArchive(u.Path)
-		if err != nil {
-			return err
-		}
+	case "boltdb", "file", "":
+		return NewBoltArchive(u.Path)
+	case "postgres", "postgresql":
+		return NewPostgresArchive(config.DbAddress)
 	default:
-		Archiver, err = NewBoltArchive(u.Path)
-		if err != nil {
-			return err
-		}
+		return nil, fmt.Errorf("Unsupported db scheme '%s'", u.Scheme)
 	}
-	// initialize Archiver
-	err = Archiver.Init()
-	if err != nil {
-		return err
+}
+
+// TenantType returns the name a tenant's logs of type kind are archived
+// under. Logs without a tenant keep their type.
+func TenantType(tenant, kind string) string {
+	if tenant == "" {
+		return kind
+	}
+	return tenant + "/" + kind
+}
+
+// ValidType returns why a log type can't be archived or read, if it can't. A
+// "/" namespaces a tenant's types and "_" starts the archive's own buckets, so
+// neither may be given as a type.
+func ValidType(kind string) error {
+	switch {
+	case kind == "":
+		return fmt.Errorf("Missing type")
+	case strings.Contains(kind, "/"):
+		return fmt.Errorf("Bad type '%s' - '/' isn't allowed", kind)
+	case strings.HasPrefix(kind, "_"):
+		return fmt.Errorf("Bad type '%s' - types can't start with '_'", kind)
 	}
-	// start cleanup goroutine
-	go Archiver.Expire()
 	return nil
 }
+
+// messageId formats a record's utime and sequence as its unique id. Ids are
+// fixed width hex so they sort the same as the records.
+func messageId(utime int64, seq uint64) string {
+	return fmt.Sprintf("%016x%016x", uint64(utime), seq)
+}
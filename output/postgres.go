@@ -0,0 +1,527 @@
+package output
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	_ "github.com/lib/pq"
+
+	"github.com/r0h4n/log_agg/config"
+	"github.com/r0h4n/log_agg/query"
+	"github.com/r0h4n/log_agg/transform"
+)
+
+type (
+	// PostgresArchive is a postgresql output archiver. Logs of every type
+	// share one table, partitioned by the indexed type column and ordered by
+	// utime (then insert order, so equal utimes don't collide and seq makes
+	// the message id).
+	PostgresArchive struct {
+		db       *sql.DB
+		Done     chan bool // stops Expire
+		stop     sync.Once
+		expiring sync.Mutex // held while Expire runs, so Close can wait for it
+	}
+)
+
+// schema created on init (requires postgresql 9.4+ for jsonb)
+var postgresSchema = []string{
+	`CREATE TABLE IF NOT EXISTS log_agg_logs (
+		seq      BIGSERIAL PRIMARY KEY,
+		type     TEXT      NOT NULL,
+		utime    BIGINT    NOT NULL,
+		id       TEXT      NOT NULL DEFAULT '',
+		priority INTEGER   NOT NULL DEFAULT 0,
+		data     JSONB     NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS log_agg_logs_type_utime ON log_agg_logs (type, utime, seq)`,
+	`CREATE TABLE IF NOT EXISTS log_agg_store (
+		db    TEXT NOT NULL,
+		key   TEXT NOT NULL,
+		value TEXT NOT NULL,
+		PRIMARY KEY (db, key)
+	)`,
+}
+
+// NewPostgresArchive creates a new postgresql output archiver, creating the
+// schema if needed
+func NewPostgresArchive(address string) (*PostgresArchive, error) {
+	d, err := sql.Open("postgres", address)
+	if err != nil {
+		return nil, err
+	}
+
+	err = d.Ping()
+	if err != nil {
+		d.Close()
+		return nil, err
+	}
+
+	for _, statement := range postgresSchema {
+		if _, err = d.Exec(statement); err != nil {
+			d.Close()
+			return nil, fmt.Errorf("Failed to create schema - %s", err)
+		}
+	}
+
+	archive := PostgresArchive{
+		db:   d,
+		Done: make(chan bool),
+	}
+
+	return &archive, nil
+}
+
+// Init initializes the archiver output
+func (a *PostgresArchive) Init() error {
+	// add output
+	log_agg.AddBatchOutput("historical", a.WriteBatch)
+
+	return nil
+}
+
+// Close stops Expire and closes the postgres connection pool
+func (a *PostgresArchive) Close() {
+	a.stop.Do(func() { close(a.Done) })
+	a.expiring.Lock()
+	a.expiring.Unlock()
+
+	err := a.db.Close()
+	if err != nil {
+		config.Log.Error("Failed to close postgres - %s", err.Error())
+	}
+}
+
+// Slice returns a slice of logs based on the name, offset, limit, log-level, and query
+func (a *PostgresArchive) Slice(name, host string, tag []string, offset, end, limit int64, level int, q *query.Query) ([]log_agg.Message, error) {
+	start := time.Now()
+	defer func() { sliceSeconds.Observe(time.Since(start).Seconds()) }()
+
+	where, args := sliceWhere(name, host, tag, offset, end, level, q)
+
+	// a negative LIMIT is an error in postgres, bolt returns nothing
+	if limit < 0 {
+		limit = 0
+	}
+	args = append(args, limit)
+	query := fmt.Sprintf("SELECT data, utime, seq FROM log_agg_logs WHERE %s ORDER BY utime DESC, seq DESC LIMIT $%d",
+		where, len(args))
+
+	rows, err := a.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := make([]log_agg.Message, 0)
+	for rows.Next() {
+		var value []byte
+		var utime, seq int64
+		if err = rows.Scan(&value, &utime, &seq); err != nil {
+			return nil, err
+		}
+
+		msg := log_agg.Message{}
+		if err = json.Unmarshal(value, &msg); err != nil {
+			return nil, fmt.Errorf("Couldn't unmarshal message - %s", err)
+		}
+		msg.MessageId = messageId(utime, uint64(seq))
+
+		// prepend messages with new message (display newest last)
+		messages = append([]log_agg.Message{msg}, messages...)
+	}
+
+	return messages, rows.Err()
+}
+
+// Count counts logs based on the name, offset, log-level, and query per
+// interval, by group
+func (a *PostgresArchive) Count(name, host string, tag []string, offset, end, interval int64, level int, q *query.Query, by string) (Counts, error) {
+	start := time.Now()
+	defer func() { sliceSeconds.Observe(time.Since(start).Seconds()) }()
+
+	where, args := sliceWhere(name, host, tag, offset, end, level, q)
+
+	from := "log_agg_logs"
+	group := "''"
+	switch by {
+	case "id":
+		group = "id"
+	case "type":
+		group = "data->>'type'"
+	case "priority":
+		group = "priority::text"
+	case "tag":
+		// a row per distinct tag, or one without any
+		from += " LEFT JOIN LATERAL (SELECT DISTINCT tag FROM jsonb_array_elements_text(CASE WHEN jsonb_typeof(data->'tag') = 'array'" +
+			" THEN data->'tag' ELSE '[]' END) AS tag) AS tags ON TRUE"
+		group = "COALESCE(tags.tag, '')"
+	}
+
+	// totals are counted without grouping, as a log may be in several groups,
+	// and returned with a null group
+	args = append(args, interval)
+	bucket := fmt.Sprintf("utime - (utime %% $%d + $%d) %% $%d", len(args), len(args), len(args))
+	query := fmt.Sprintf("SELECT %s AS bucket, %s AS grp, count(*) FROM %s WHERE %s GROUP BY 1, 2"+
+		" UNION ALL SELECT %s, NULL, count(*) FROM log_agg_logs WHERE %s GROUP BY 1",
+		bucket, group, from, where, bucket, where)
+
+	rows, err := a.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := Counts{}
+	for rows.Next() {
+		var utime, count int64
+		var group sql.NullString
+		if err = rows.Scan(&utime, &group, &count); err != nil {
+			return nil, err
+		}
+		if !group.Valid {
+			counts.Add(utime, count)
+			continue
+		}
+		counts.AddGroup(utime, group.String, count)
+	}
+
+	return counts, rows.Err()
+}
+
+// sliceWhere returns the condition (and its parameters) for the logs Slice
+// and Count read
+func sliceWhere(name, host string, tag []string, offset, end int64, level int, q *query.Query) (string, []interface{}) {
+	where := []string{"type = $1", "priority >= $2"}
+	args := []interface{}{name, level}
+
+	// start with the last log unless given an offset
+	if offset != 0 {
+		args = append(args, offset)
+		where = append(where, fmt.Sprintf("utime <= $%d", len(args)))
+	}
+	if end != 0 {
+		args = append(args, end)
+		where = append(where, fmt.Sprintf("utime >= $%d", len(args)))
+	}
+	if host != "" {
+		args = append(args, host)
+		where = append(where, fmt.Sprintf("id = $%d", len(args)))
+	}
+
+	// match any of the tags, "" matching logs with any tag (as bolt does)
+	var tags []string
+	anyTag := false
+	for i := range tag {
+		if tag[i] == "" {
+			anyTag = true
+			continue
+		}
+		args = append(args, tag[i])
+		tags = append(tags, fmt.Sprintf("$%d", len(args)))
+	}
+	switch {
+	case anyTag:
+		where = append(where, "CASE WHEN jsonb_typeof(data->'tag') = 'array' THEN jsonb_array_length(data->'tag') > 0 ELSE FALSE END")
+	case len(tags) > 0:
+		where = append(where, fmt.Sprintf("data->'tag' ?| ARRAY[%s]::text[]", strings.Join(tags, ", ")))
+	}
+
+	if q != nil {
+		where = append(where, querySql(q.Root, &args))
+	}
+
+	return strings.Join(where, " AND "), args
+}
+
+// Write writes the message to database
+func (a *PostgresArchive) Write(msg log_agg.Message) {
+	config.Log.Trace("Postgres archive writing...")
+	start := time.Now()
+	err := insert(a.db.Exec, msg)
+	writeSeconds.Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		writeFailures.Inc()
+		config.Log.Error("Historical write failed - %s", err)
+	}
+}
+
+// WriteBatch writes the messages to database in a single transaction
+func (a *PostgresArchive) WriteBatch(msgs []log_agg.Message) {
+	config.Log.Trace("Postgres archive writing %d messages...", len(msgs))
+	start := time.Now()
+	err := func() error {
+		tx, err := a.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		for i := range msgs {
+			if err = insert(tx.Exec, msgs[i]); err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	}()
+	writeSeconds.Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		writeFailures.Inc()
+		config.Log.Error("Historical write of %d messages failed - %s", len(msgs), err)
+	}
+}
+
+// insert inserts the message with exec (of the db or a transaction)
+func insert(exec func(string, ...interface{}) (sql.Result, error), msg log_agg.Message) error {
+	// don't archive raw stream (or an id, seq is the id)
+	msg.Raw = []byte{}
+	msg.MessageId = ""
+
+	// a bad type could write into another tenant's logs
+	if err := ValidType(msg.Type); err != nil {
+		writeFailures.Inc()
+		config.Log.Error("Historical write skipped - %s", err)
+		return nil
+	}
+
+	value, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	_, err = exec("INSERT INTO log_agg_logs (type, utime, id, priority, data) VALUES ($1, $2, $3, $4, $5)",
+		TenantType(msg.Tenant, msg.Type), msg.UTime, msg.Id, msg.Priority, string(value))
+	return err
+}
+
+// Expire cleans up old logs by date or volume of logs
+func (a *PostgresArchive) Expire(rules Retention, every time.Duration) {
+	a.expiring.Lock()
+	defer a.expiring.Unlock()
+
+	expireLoop(a.Done, rules, 0, every, a.Cleanup)
+}
+
+// ranks the logs of type $1 newest first, with their running count and size
+const postgresRanked = `SELECT seq, utime, row_number() OVER w AS n, sum(octet_length(data::text)) OVER w AS total
+	FROM log_agg_logs WHERE type = $1 WINDOW w AS (ORDER BY utime DESC, seq DESC)`
+
+// Cleanup deletes the logs of each type (by tenant) the retention rules don't
+// keep, or with dryRun only counts them
+func (a *PostgresArchive) Cleanup(rules Retention, dryRun bool) ([]Expiry, error) {
+	rows, err := a.db.Query("SELECT DISTINCT type FROM log_agg_logs")
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var expired []Expiry
+	for _, name := range names {
+		// types without a rule are only sized up
+		key, rule, ok := rules.rule(name)
+		if !ok {
+			rule = Rule{Max: -1, MaxBytes: -1}
+		}
+		cutoff := rule.cutoff(now)
+		max, maxBytes := rule.limits()
+
+		e := Expiry{Bucket: name, Rule: key}
+		err = a.db.QueryRow(`SELECT count(*), coalesce(max(total), 0),
+			count(*) FILTER (WHERE utime < $2),
+			count(*) FILTER (WHERE utime >= $2 AND n > $3),
+			count(*) FILTER (WHERE utime >= $2 AND n <= $3 AND total > $4),
+			coalesce(max(total) FILTER (WHERE utime >= $2 AND n <= $3 AND total <= $4), 0)
+			FROM (`+postgresRanked+`) ranked`, name, cutoff, max, maxBytes).Scan(&e.Records, &e.Bytes, &e.ByAge, &e.ByMax, &e.ByBytes, &e.KeptBytes)
+		e.Deleted = e.ByAge + e.ByMax + e.ByBytes
+		if err == nil && !dryRun && e.Deleted > 0 {
+			_, err = a.db.Exec(`DELETE FROM log_agg_logs WHERE seq IN (
+				SELECT seq FROM (`+postgresRanked+`) ranked WHERE utime < $2 OR n > $3 OR total > $4
+			)`, name, cutoff, max, maxBytes)
+		}
+		if err != nil {
+			return sortExpiries(expired), fmt.Errorf("Failed to clean '%s' - %s", name, err)
+		}
+
+		expired = append(expired, e)
+	}
+
+	return sortExpiries(expired), nil
+}
+
+// size returns the size of the logs table
+func (a *PostgresArchive) size() (int64, error) {
+	var size int64
+	err := a.db.QueryRow("SELECT pg_total_relation_size('log_agg_logs')").Scan(&size)
+	return size, err
+}
+
+// Save writes a value to the database
+func (a *PostgresArchive) Save(db, key string, v interface{}) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("Save failed - Failed to marshal - %s", err.Error())
+	}
+
+	// emulate an upsert for postgresql < 9.5
+	tx, err := a.db.Begin()
+	if err != nil {
+		return fmt.Errorf("Save failed - %s", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("UPDATE log_agg_store SET value = $3 WHERE db = $1 AND key = $2", db, key, string(value))
+	if err != nil {
+		return fmt.Errorf("Save failed - %s", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		_, err = tx.Exec("INSERT INTO log_agg_store (db, key, value) VALUES ($1, $2, $3)", db, key, string(value))
+		if err != nil {
+			return fmt.Errorf("Save failed - %s", err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("Save failed - %s", err)
+	}
+
+	return nil
+}
+
+// Get gets values from the database
+func (a *PostgresArchive) Get(db, key string, v interface{}) error {
+	var value string
+	err := a.db.QueryRow("SELECT value FROM log_agg_store WHERE db = $1 AND key = $2", db, key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("Failed to get - No value found")
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to get - %s", err)
+	}
+
+	err = json.Unmarshal([]byte(value), v)
+	if err != nil {
+		return fmt.Errorf("Failed to get - Bad JSON in stored output config - %s", err.Error())
+	}
+
+	return nil
+}
+
+// querySql translates the query into a postgres condition, appending its
+// parameters to args
+func querySql(n *query.Node, args *[]interface{}) string {
+	param := func(v interface{}) string {
+		*args = append(*args, v)
+		return "$" + strconv.Itoa(len(*args))
+	}
+
+	// message terms match the content
+	column := "data->>'message'"
+	switch n.Op {
+	case "and", "or":
+		parts := make([]string, len(n.Children))
+		for i, child := range n.Children {
+			parts[i] = querySql(child, args)
+		}
+		return "(" + strings.Join(parts, " "+strings.ToUpper(n.Op)+" ") + ")"
+	case "not":
+		return "NOT " + querySql(n.Children[0], args)
+	case "word":
+		return column + " ~* " + param(`\m`+n.Text+`\M`)
+	case "prefix":
+		return column + " ~* " + param(`\m`+n.Text)
+	case "substring":
+		return "strpos(lower(" + column + "), " + param(n.Text) + ") > 0"
+	case "regex":
+		return column + " ~ " + param(n.Text)
+	case "compare":
+		return compareSql(n, param)
+	}
+	return "FALSE"
+}
+
+// compareSql matches a term on a message's attribute the way Query.Match does
+func compareSql(n *query.Node, param func(interface{}) string) string {
+	switch n.Field {
+	case "id":
+		return textSql("id", n, param)
+	case "type":
+		// the type column is namespaced by tenant
+		return textSql("data->>'type'", n, param)
+	case "tag":
+		return "(CASE WHEN jsonb_typeof(data->'tag') = 'array' THEN EXISTS (SELECT 1 FROM jsonb_array_elements_text(data->'tag') AS tag WHERE " +
+			textSql("tag", n, param) + ") ELSE FALSE END)"
+	case "priority":
+		return "priority " + n.Cmp + " " + param(strconv.FormatFloat(n.Number, 'g', -1, 64)) + "::numeric"
+	case "field":
+		return fieldSql(n, param)
+	}
+	return "FALSE"
+}
+
+// textSql compares a text column with the term, ordered comparisons are by byte
+func textSql(column string, n *query.Node, param func(interface{}) string) string {
+	switch n.Cmp {
+	case "~":
+		return column + " ~ " + param(n.Text)
+	case "=":
+		return column + " = " + param(n.Text)
+	}
+	return "(" + column + `) COLLATE "C" ` + n.Cmp + " " + param(n.Text)
+}
+
+// fieldSql compares a field (in the data column's "fields") the way Query.Match does
+func fieldSql(n *query.Node, param func(interface{}) string) string {
+	// a text[] literal of the path, '{fields,user,id}'
+	keys := append([]string{"fields"}, strings.Split(n.Path, ".")...)
+	for i := range keys {
+		keys[i] = `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(keys[i]) + `"`
+	}
+	field := "(data #> " + param("{"+strings.Join(keys, ",")+"}") + "::text[])"
+	text := field + " #>> '{}'"
+
+	switch n.Cmp {
+	case "set":
+		return field + " IS NOT NULL"
+	case "unset":
+		return field + " IS NULL"
+	case "~":
+		return "(CASE jsonb_typeof(" + field + ") WHEN 'string' THEN " + text + " ~ " + param(n.Text) + " ELSE FALSE END)"
+	case "=", "!=":
+		equal := "(jsonb_typeof(" + field + ") IN ('string', 'boolean') AND " + text + " = " + param(n.Text) + ")"
+		if n.Numeric {
+			equal = "(CASE jsonb_typeof(" + field + ") WHEN 'number' THEN (" + text + ")::numeric = " + param(strconv.FormatFloat(n.Number, 'g', -1, 64)) + "::numeric" +
+				" WHEN 'string' THEN " + text + " = " + param(n.Text) + " ELSE FALSE END)"
+		}
+		if n.Cmp == "!=" {
+			return "(" + field + " IS NOT NULL AND NOT " + equal + ")"
+		}
+		return equal
+	}
+
+	// ordered comparisons, numeric to numbers or text to strings
+	if n.Numeric {
+		return "(CASE jsonb_typeof(" + field + ") WHEN 'number' THEN (" + text + ")::numeric " + n.Cmp + " " +
+			param(strconv.FormatFloat(n.Number, 'g', -1, 64)) + "::numeric ELSE FALSE END)"
+	}
+	return "(CASE jsonb_typeof(" + field + ") WHEN 'string' THEN (" + text + `) COLLATE "C" ` + n.Cmp + " " + param(n.Text) + " ELSE FALSE END)"
+}
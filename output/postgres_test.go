@@ -0,0 +1,108 @@
+package output_test
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/r0h4n/log_agg/config"
+	"github.com/r0h4n/log_agg/output"
+	"github.com/r0h4n/log_agg/transform"
+)
+
+// Test unknown db schemes fail to initialize
+func TestArchiveScheme(t *testing.T) {
+	address := config.DbAddress
+	defer func() { config.DbAddress = address }()
+
+	config.DbAddress = "mongodb://127.0.0.1/log_agg"
+	if err := output.Init(); err == nil {
+		t.Error("unknown db scheme is too forgiving")
+	}
+}
+
+// Test writing, getting, and trimming data in postgres
+// (set LOG_AGG_POSTGRES to a disposable database to run)
+func TestPostgres(t *testing.T) {
+	address := os.Getenv("LOG_AGG_POSTGRES")
+	if address == "" {
+		t.Skip("LOG_AGG_POSTGRES not set")
+	}
+
+	archive, err := output.NewPostgresArchive(address)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer archive.Close()
+	if err = archive.Init(); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	kind := "pgtest" + time.Now().Format("150405.000")
+	now := time.Now().UnixNano()
+	for i, tag := range []string{"web", "db", "web"} {
+		archive.Write(log_agg.Message{
+			UTime:    now + int64(i),
+			Id:       "myhost",
+			Tag:      []string{tag},
+			Type:     kind,
+			Priority: i + 2,
+			Content:  tag + " message",
+		})
+	}
+	// same utime as the last message, should not collide
+	archive.Write(log_agg.Message{UTime: now + 2, Type: kind, Priority: 1, Content: "collision"})
+
+	msgs, err := archive.Slice(kind, "", nil, 0, 0, 100, 0, nil)
+	if err != nil || len(msgs) != 4 || msgs[0].Content != "web message" || msgs[3].Content != "collision" {
+		t.Errorf("%+v doesn't match expected out - %v", msgs, err)
+	} else if msgs[2].MessageId == "" || msgs[2].MessageId >= msgs[3].MessageId {
+		t.Errorf("message ids %q and %q aren't ordered", msgs[2].MessageId, msgs[3].MessageId)
+	}
+
+	msgs, err = archive.Slice(kind, "myhost", []string{"web"}, 0, 0, 100, 3, nil)
+	if err != nil || len(msgs) != 1 || msgs[0].Priority != 4 {
+		t.Errorf("%+v doesn't match expected out - %v", msgs, err)
+	}
+
+	msgs, err = archive.Slice(kind, "", nil, now+1, 0, 1, 0, nil)
+	if err != nil || len(msgs) != 1 || msgs[0].Content != "db message" {
+		t.Errorf("%+v doesn't match expected out - %v", msgs, err)
+	}
+
+	// an empty tag matches any tagged log, as in bolt
+	msgs, err = archive.Slice(kind, "", []string{""}, 0, 0, 100, 0, nil)
+	if err != nil || len(msgs) != 3 {
+		t.Errorf("%+v doesn't match expected out - %v", msgs, err)
+	}
+
+	msgs, err = archive.Slice(kind, "", nil, 0, 0, -1, 0, nil)
+	if err != nil || len(msgs) != 0 {
+		t.Errorf("%+v doesn't match expected out - %v", msgs, err)
+	}
+
+	// counted by tag, each message once per tag and the untagged under ""
+	counts, err := archive.Count(kind, "", nil, 0, 0, int64(time.Hour), 0, nil, "tag")
+	tags := map[string]int64{}
+	for _, counted := range counts {
+		for tag, n := range counted.Groups {
+			tags[tag] += n
+		}
+	}
+	if err != nil || tags["web"] != 2 || tags["db"] != 1 || tags[""] != 1 {
+		t.Errorf("%v doesn't match expected out - %v", counts, err)
+	}
+
+	if err = archive.Save("_config", kind, []string{"a", "b"}); err == nil {
+		err = archive.Save("_config", kind, []string{"c"})
+	}
+	stored := []string{}
+	if err == nil {
+		err = archive.Get("_config", kind, &stored)
+	}
+	if err != nil || len(stored) != 1 || stored[0] != "c" {
+		t.Errorf("%q doesn't match expected out - %v", stored, err)
+	}
+}
@@ -0,0 +1,297 @@
+package output
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/r0h4n/log_agg/config"
+)
+
+type (
+	// Retention holds the parsed log-keep rules by type. The "*" rule applies
+	// to types that aren't listed, and a rule for "tenant/type" to just that
+	// tenant's logs.
+	Retention map[string]Rule
+
+	// Rule limits the logs of a type. Logs are deleted, oldest first, once
+	// older than Age, past the newest Max, or past the newest MaxBytes (of
+	// stored records). A negative (or zero Age) limit doesn't apply.
+	Rule struct {
+		Age      time.Duration `json:"age"`
+		Max      int64         `json:"max"`
+		MaxBytes int64         `json:"maxBytes"`
+	}
+
+	// Expiry reports what a cleanup deleted, or would delete, from a bucket
+	Expiry struct {
+		Bucket    string `json:"bucket"`    // type, or tenant/type
+		Rule      string `json:"rule"`      // log-keep key of the rule applied ("" for none)
+		Records   int64  `json:"records"`   // records before the cleanup
+		Bytes     int64  `json:"bytes"`     // bytes of records before the cleanup
+		ByAge     int64  `json:"byAge"`     // records older than the rule's age
+		ByMax     int64  `json:"byMax"`     // newer records past the rule's max
+		ByBytes   int64  `json:"byBytes"`   // newer records past the rule's maxBytes
+		ByTotal   int64  `json:"byTotal"`   // records kept by the rule, but past archive-max-bytes
+		Deleted   int64  `json:"deleted"`   // records deleted for any of the above
+		KeptBytes int64  `json:"keptBytes"` // bytes of records after the cleanup
+	}
+)
+
+var (
+	// the parsed config.LogKeep and config.ArchiveMaxBytes, set by Init
+	retention       Retention
+	archiveMaxBytes int64
+
+	ageRegex   = regexp.MustCompile(`^([0-9]+)(s|m|h|d|w|y)$`)
+	bytesRegex = regexp.MustCompile(`^([0-9]+)\s*([KMGT]?B)?$`)
+
+	ageUnits = map[string]time.Duration{
+		"s": time.Second,
+		"m": time.Minute,
+		"h": time.Hour,
+		"d": 24 * time.Hour,
+		"w": 7 * 24 * time.Hour,
+		"y": 52 * 7 * 24 * time.Hour,
+	}
+	byteUnits = map[string]int64{"": 1, "B": 1, "KB": 1 << 10, "MB": 1 << 20, "GB": 1 << 30, "TB": 1 << 40}
+)
+
+// ParseRetention parses log-keep, a json object of type to a rule. A rule is
+// an age ("2w"), a number of logs to keep (10), or an object combining them
+// ({"age":"2w","max":100000,"maxBytes":"1GB"}). An empty log-keep keeps
+// everything.
+func ParseRetention(logKeep string) (Retention, error) {
+	r := Retention{}
+	if logKeep == "" {
+		return r, nil
+	}
+
+	var raw map[string]interface{}
+	if err := json.Unmarshal([]byte(logKeep), &raw); err != nil {
+		return nil, fmt.Errorf("Bad JSON syntax for log-keep - %s", err)
+	}
+
+	for kind, value := range raw {
+		rule, err := parseRule(value)
+		if err != nil {
+			return nil, fmt.Errorf("Bad log-keep for '%s' - %s", kind, err)
+		}
+		r[kind] = rule
+	}
+	return r, nil
+}
+
+func parseRule(value interface{}) (Rule, error) {
+	rule := Rule{Max: -1, MaxBytes: -1}
+
+	switch v := value.(type) {
+	case float64:
+		max, err := parseCount(v)
+		rule.Max = max
+		return rule, err
+	case string:
+		// "10" is a count, as 10 is
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+			rule.Max, err = parseCount(float64(n))
+			return rule, err
+		}
+		age, err := parseAge(v)
+		rule.Age = age
+		return rule, err
+	case map[string]interface{}:
+		var err error
+		for key, limit := range v {
+			switch key {
+			case "age":
+				s, ok := limit.(string)
+				if !ok {
+					return rule, fmt.Errorf("age must be a string like \"2w\"")
+				}
+				rule.Age, err = parseAge(s)
+			case "max":
+				n, ok := limit.(float64)
+				if !ok {
+					return rule, fmt.Errorf("max must be a number")
+				}
+				rule.Max, err = parseCount(n)
+			case "maxBytes":
+				rule.MaxBytes, err = parseBytes(limit)
+			default:
+				err = fmt.Errorf("unknown limit '%s' (age, max, or maxBytes)", key)
+			}
+			if err != nil {
+				return rule, err
+			}
+		}
+		if rule.Age == 0 && rule.Max < 0 && rule.MaxBytes < 0 {
+			return rule, fmt.Errorf("no limits given")
+		}
+		return rule, nil
+	default:
+		return rule, fmt.Errorf("must be an age, a count, or an object")
+	}
+}
+
+func parseAge(s string) (time.Duration, error) {
+	match := ageRegex.FindStringSubmatch(s)
+	if match == nil {
+		return 0, fmt.Errorf("bad age '%s' (X(s)ec, (m)in, (h)our, (d)ay, (w)eek, or (y)ear)", s)
+	}
+	n, err := strconv.ParseInt(match[1], 10, 64)
+	if err != nil || n == 0 || time.Duration(n) > math.MaxInt64/ageUnits[match[2]] {
+		return 0, fmt.Errorf("bad age '%s'", s)
+	}
+	return time.Duration(n) * ageUnits[match[2]], nil
+}
+
+func parseCount(n float64) (int64, error) {
+	if n < 0 || n != math.Trunc(n) {
+		return 0, fmt.Errorf("bad count '%v'", n)
+	}
+	return int64(n), nil
+}
+
+func parseBytes(value interface{}) (int64, error) {
+	switch v := value.(type) {
+	case float64:
+		return parseCount(v)
+	case string:
+		match := bytesRegex.FindStringSubmatch(strings.ToUpper(strings.TrimSpace(v)))
+		if match == nil {
+			return 0, fmt.Errorf("bad maxBytes '%s' (a number of B, KB, MB, GB, or TB)", v)
+		}
+		n, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil || n > math.MaxInt64/byteUnits[match[2]] {
+			return 0, fmt.Errorf("bad maxBytes '%s'", v)
+		}
+		return n * byteUnits[match[2]], nil
+	default:
+		return 0, fmt.Errorf("maxBytes must be a number or a string like \"1GB\"")
+	}
+}
+
+// rule returns the rule for a bucket, and the key it is configured under
+func (r Retention) rule(bucket string) (string, Rule, bool) {
+	kind := bucket
+	if i := strings.LastIndex(bucket, "/"); i >= 0 {
+		kind = bucket[i+1:]
+	}
+	for _, key := range []string{bucket, kind, "*"} {
+		if rule, ok := r[key]; ok {
+			return key, rule, true
+		}
+	}
+	return "", Rule{}, false
+}
+
+// cutoff returns the utime records must not be older than (math.MinInt64
+// without an age)
+func (r Rule) cutoff(now time.Time) int64 {
+	if r.Age <= 0 {
+		return math.MinInt64
+	}
+	return now.Add(-r.Age).UnixNano()
+}
+
+// limits returns Max and MaxBytes, math.MaxInt64 where they don't apply
+func (r Rule) limits() (int64, int64) {
+	max, maxBytes := r.Max, r.MaxBytes
+	if max < 0 {
+		max = math.MaxInt64
+	}
+	if maxBytes < 0 {
+		maxBytes = math.MaxInt64
+	}
+	return max, maxBytes
+}
+
+// MarshalJSON writes the limits that apply, the age as a go duration ("336h0m0s")
+func (r Rule) MarshalJSON() ([]byte, error) {
+	limits := map[string]interface{}{}
+	if r.Age > 0 {
+		limits["age"] = r.Age.String()
+	}
+	if r.Max >= 0 {
+		limits["max"] = r.Max
+	}
+	if r.MaxBytes >= 0 {
+		limits["maxBytes"] = r.MaxBytes
+	}
+	return json.Marshal(limits)
+}
+
+// DryRun reports what the next cleanup of the archive would delete
+func DryRun() ([]Expiry, error) {
+	if Archiver == nil {
+		return nil, fmt.Errorf("No archive")
+	}
+	return Archiver.Cleanup(retention, true)
+}
+
+// RetentionRules returns the rules in effect
+func RetentionRules() Retention {
+	return retention
+}
+
+// RetentionMaxBytes returns the bytes of logs the archive keeps in all (0 for
+// no limit)
+func RetentionMaxBytes() int64 {
+	return archiveMaxBytes
+}
+
+// expireLoop runs cleanup with rules every interval, until done receives.
+// maxBytes is the archive's limit on bytes in all (0 for none).
+func expireLoop(done chan bool, rules Retention, maxBytes int64, every time.Duration, cleanup func(Retention, bool) ([]Expiry, error)) {
+	// if log-keep is "" (and there's no archive-max-bytes) expire is disabled
+	if len(rules) == 0 && maxBytes == 0 {
+		config.Log.Debug("Log expiration disabled")
+		return
+	}
+
+	config.Log.Trace("Retention - %+v; every - %s", rules, every)
+
+	tick := time.NewTicker(every)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-tick.C:
+			expired, err := cleanup(rules, false)
+			if err != nil {
+				config.Log.Error("Failed to expire logs - %s", err)
+			}
+
+			var deleted int64
+			if err == nil {
+				storedBytes.Reset()
+				archiveRecords.Reset()
+			}
+			for _, e := range expired {
+				storedBytes.Set(float64(e.KeptBytes), e.Bucket)
+				archiveRecords.Set(float64(e.Records-e.Deleted), e.Bucket)
+				if e.Deleted > 0 {
+					config.Log.Debug("Expired %d logs of '%s' (rule '%s')", e.Deleted, e.Bucket, e.Rule)
+					expiredRecords.Add(float64(e.Deleted), e.Bucket)
+					deleted += e.Deleted
+				}
+			}
+			expirePasses.Inc()
+			expireLastPass.Set(float64(deleted))
+		case <-done:
+			config.Log.Debug("Done recieved on channel. (Cleanup halting)")
+			return
+		}
+	}
+}
+
+// sortExpiries orders expiries by bucket
+func sortExpiries(expired []Expiry) []Expiry {
+	sort.Slice(expired, func(i, j int) bool { return expired[i].Bucket < expired[j].Bucket })
+	return expired
+}
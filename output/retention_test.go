@@ -0,0 +1,219 @@
+package output_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/r0h4n/log_agg/output"
+	"github.com/r0h4n/log_agg/transform"
+)
+
+// Test parsing log-keep
+func TestParseRetention(t *testing.T) {
+	rules, err := output.ParseRetention(`{"app":"2w", "deploy":10, "web":"100", "*":{"age":"1d","max":1000,"maxBytes":"1GB"}, "db":{"maxBytes":2048}}`)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	expected := map[string]output.Rule{
+		"app":    {Age: 14 * 24 * time.Hour, Max: -1, MaxBytes: -1},
+		"deploy": {Max: 10, MaxBytes: -1},
+		"web":    {Max: 100, MaxBytes: -1},
+		"*":      {Age: 24 * time.Hour, Max: 1000, MaxBytes: 1 << 30},
+		"db":     {Max: -1, MaxBytes: 2048},
+	}
+	for kind, rule := range expected {
+		if rules[kind] != rule {
+			t.Errorf("'%s' rule %+v doesn't match expected %+v", kind, rules[kind], rule)
+		}
+	}
+
+	body, _ := json.Marshal(rules["*"])
+	if string(body) != `{"age":"24h0m0s","max":1000,"maxBytes":1073741824}` {
+		t.Errorf("%q doesn't match expected out", body)
+	}
+
+	bad := []string{
+		`{"app":"2 weeks"}`,
+		`{"app":"0w"}`,
+		`{"app":-1}`,
+		`{"app":1.5}`,
+		`{"app":true}`,
+		`{"app":{}}`,
+		`{"app":{"age":14}}`,
+		`{"app":{"max":"10"}}`,
+		`{"app":{"maxBytes":"1 parsec"}}`,
+		`{"app":{"min":10}}`,
+		`["app"]`,
+	}
+	for _, logKeep := range bad {
+		if _, err = output.ParseRetention(logKeep); err == nil {
+			t.Errorf("log-keep '%s' is too forgiving", logKeep)
+		}
+	}
+}
+
+// Test cleaning up with combined rules, per tenant, and as a dry run
+func TestCleanup(t *testing.T) {
+	os.RemoveAll("/tmp/retentionTest")
+	defer os.RemoveAll("/tmp/retentionTest")
+
+	archive, err := output.NewBoltArchive("/tmp/retentionTest/log_agg.bolt")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer archive.Close()
+
+	// 10 logs of each bucket, an hour apart, from 15.5 to 6.5 hours old
+	hour := int64(time.Hour)
+	start := time.Now().UnixNano() - 15*hour - hour/2
+	var msgs []log_agg.Message
+	for _, bucket := range [][2]string{{"", "app"}, {"", "deploy"}, {"team-a", "deploy"}, {"", "other"}} {
+		for i := int64(0); i < 10; i++ {
+			msgs = append(msgs, log_agg.Message{UTime: start + i*hour, Tenant: bucket[0], Type: bucket[1], Content: fmt.Sprint(i)})
+		}
+	}
+	archive.WriteBatch(msgs)
+
+	// a record is ~135 bytes of key and json
+	rules, err := output.ParseRetention(`{"app":{"age":"12h","max":5}, "deploy":{"max":8,"maxBytes":800}, "team-a/deploy":3}`)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	expected := []string{
+		"app (app): 10 records, 4 by age, 1 by max",
+		"deploy (deploy): 10 records, 0 by age, 2 by max, 3 by bytes",
+		"other (): 10 records, 0 by age, 0 by max, 0 by bytes",
+		"team-a/deploy (team-a/deploy): 10 records, 0 by age, 7 by max, 0 by bytes",
+	}
+	check := func(expired []output.Expiry) {
+		if len(expired) != len(expected) {
+			t.Errorf("%+v doesn't match expected out", expired)
+			t.FailNow()
+		}
+		for i, e := range expired {
+			got := fmt.Sprintf("%s (%s): %d records, %d by age, %d by max", e.Bucket, e.Rule, e.Records, e.ByAge, e.ByMax)
+			if e.Bucket != "app" {
+				got += fmt.Sprintf(", %d by bytes", e.ByBytes)
+			}
+			if got != expected[i] || e.Deleted != e.ByAge+e.ByMax+e.ByBytes {
+				t.Errorf("'%s' doesn't match expected '%s'", got, expected[i])
+			}
+		}
+	}
+
+	// dry runs don't delete
+	for i := 0; i < 2; i++ {
+		expired, err := archive.Cleanup(rules, true)
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		check(expired)
+	}
+
+	expired, err := archive.Cleanup(rules, false)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	check(expired)
+
+	// the newest logs are kept
+	for bucket, kept := range map[string]string{"app": "5 6 7 8 9", "deploy": "5 6 7 8 9", "team-a/deploy": "7 8 9", "other": "0 1 2 3 4 5 6 7 8 9"} {
+		logs, err := archive.Slice(bucket, "", nil, 0, 0, 100, 0, nil)
+		if err != nil {
+			t.Error(err)
+		}
+		var got string
+		for i := range logs {
+			got += " " + logs[i].Content
+		}
+		if got != " "+kept {
+			t.Errorf("'%s' kept '%s', expected '%s'", bucket, strings.TrimSpace(got), kept)
+		}
+	}
+
+	// the wildcard applies to unlisted types
+	rules["*"] = output.Rule{Max: 1, MaxBytes: -1}
+	expired, _ = archive.Cleanup(rules, true)
+	if len(expired) != 4 || expired[2].Bucket != "other" || expired[2].Rule != "*" || expired[2].Deleted != 9 || expired[0].Deleted != 0 {
+		t.Errorf("%+v doesn't match expected out", expired)
+	}
+}
+
+// Test trimming the whole archive to MaxBytes, oldest of any bucket first
+func TestMaxBytes(t *testing.T) {
+	os.RemoveAll("/tmp/retentionTest")
+	defer os.RemoveAll("/tmp/retentionTest")
+
+	archive, err := output.NewBoltArchive("/tmp/retentionTest/log_agg.bolt")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer archive.Close()
+
+	// interleave 10 logs of 2 types, an hour apart
+	hour := int64(time.Hour)
+	start := time.Now().UnixNano() - 20*hour
+	var msgs []log_agg.Message
+	for i := int64(0); i < 20; i++ {
+		kind := []string{"app", "deploy"}[i%2]
+		msgs = append(msgs, log_agg.Message{UTime: start + i*hour, Type: kind, Content: fmt.Sprint(i)})
+	}
+	archive.WriteBatch(msgs)
+
+	// app keeps its newest 8 of its own accord
+	rules, _ := output.ParseRetention(`{"app":8}`)
+	expired, err := archive.Cleanup(rules, true)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if len(expired) != 2 || expired[0].ByMax != 2 {
+		t.Errorf("%+v doesn't match expected out", expired)
+		t.FailNow()
+	}
+	total := expired[0].KeptBytes + expired[1].KeptBytes
+	record := expired[1].KeptBytes / 10
+
+	// make room for a bit more than 12 records
+	archive.MaxBytes = total - 5*record - record/2
+	for _, dryRun := range []bool{true, false} {
+		expired, err = archive.Cleanup(rules, dryRun)
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		// app 0 and 2 are already gone, so deploy 1, 3, 5, 7 and app 4, 6 go
+		if expired[0].ByMax != 2 || expired[0].ByTotal != 2 || expired[0].Deleted != 4 || expired[1].ByTotal != 4 || expired[1].Deleted != 4 {
+			t.Errorf("%+v doesn't match expected out", expired)
+		}
+		if kept := expired[0].KeptBytes + expired[1].KeptBytes; kept > archive.MaxBytes {
+			t.Errorf("Kept %d bytes, more than %d", kept, archive.MaxBytes)
+		}
+	}
+
+	for bucket, kept := range map[string]string{"app": "8 10 12 14 16 18", "deploy": "9 11 13 15 17 19"} {
+		logs, err := archive.Slice(bucket, "", nil, 0, 0, 100, 0, nil)
+		if err != nil {
+			t.Error(err)
+		}
+		var got string
+		for i := range logs {
+			got += " " + logs[i].Content
+		}
+		if got != " "+kept {
+			t.Errorf("'%s' kept '%s', expected '%s'", bucket, strings.TrimSpace(got), kept)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package output_test
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/r0h4n/log_agg/config"
+	"github.com/r0h4n/log_agg/output"
+	"github.com/r0h4n/log_agg/query"
+	"github.com/r0h4n/log_agg/transform"
+)
+
+// Test searching with the word index
+func TestSearchIndex(t *testing.T) {
+	os.RemoveAll("/tmp/searchTest")
+	defer os.RemoveAll("/tmp/searchTest")
+	os.MkdirAll("/tmp/searchTest", 0755)
+
+	index := config.SearchIndex
+	defer func() { config.SearchIndex = index }()
+
+	archive, err := output.NewBoltArchive("/tmp/searchTest/log_agg.bolt")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer archive.Close()
+
+	// records written before the index is enabled are indexed on init
+	now := time.Now().UnixNano()
+	archive.Write(log_agg.Message{UTime: now, Type: "app", Content: "disk full on db1"})
+
+	config.SearchIndex = true
+	if err = archive.Init(); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	archive.Write(log_agg.Message{UTime: now + 1, Type: "app", Id: "db1", Content: "db1 connection timeout"})
+	archive.Write(log_agg.Message{UTime: now + 2, Type: "app", Id: "web1", Tag: []string{"health"}, Content: "web1 connection refused"})
+
+	searches := map[string]int{
+		"db1":                    2,
+		"conn*":                  2,
+		"db1 AND timeout":        1,
+		"db1 OR web1":            3,
+		"connection NOT refused": 1,
+		"\"on db\"":              1,
+		"missing":                0,
+		"conn* AND id:db*":       1,
+		"conn* NOT tag:health":   1,
+		"db1 OR id:web1":         3,
+	}
+	for q, count := range searches {
+		parsed, err := query.Parse(q)
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		msgs, err := archive.Slice("app", "", nil, 0, 0, 100, 0, parsed)
+		if err != nil || len(msgs) != count {
+			t.Errorf("search %q - %+v doesn't match expected out - %v", q, msgs, err)
+		}
+	}
+
+	// limit returns the newest matches
+	parsed, _ := query.Parse("connection")
+	msgs, err := archive.Slice("app", "", nil, 0, 0, 1, 0, parsed)
+	if err != nil || len(msgs) != 1 || msgs[0].Content != "web1 connection refused" {
+		t.Errorf("%+v doesn't match expected out - %v", msgs, err)
+	}
+}
@@ -0,0 +1,78 @@
+package output
+
+import (
+	"strconv"
+
+	"github.com/r0h4n/log_agg/transform"
+)
+
+type (
+	// Counts are the number of logs per interval, keyed by the utime it starts at
+	Counts map[int64]*IntervalCounts
+
+	// IntervalCounts are the logs in an interval, in total and by group. A log
+	// counted in several groups (by tag) counts once in the total.
+	IntervalCounts struct {
+		Total  int64
+		Groups map[string]int64
+	}
+)
+
+// CountBy are what logs may be counted by. Logs count once per tag when
+// counted by tag, logs without any under "". Not grouping ("") counts every
+// log under "".
+var CountBy = map[string]bool{"": true, "id": true, "tag": true, "type": true, "priority": true}
+
+// Add adds n logs to the total of the interval starting at utime
+func (c Counts) Add(utime int64, n int64) {
+	c.interval(utime).Total += n
+}
+
+// AddGroup adds n logs of group to the interval starting at utime, without
+// adding to its total
+func (c Counts) AddGroup(utime int64, group string, n int64) {
+	c.interval(utime).Groups[group] += n
+}
+
+func (c Counts) interval(utime int64) *IntervalCounts {
+	if c[utime] == nil {
+		c[utime] = &IntervalCounts{Groups: map[string]int64{}}
+	}
+	return c[utime]
+}
+
+// IntervalStart returns the start of the interval utime is in
+func IntervalStart(utime, interval int64) int64 {
+	start := utime - utime%interval
+	if utime < 0 && utime%interval != 0 {
+		start -= interval
+	}
+	return start
+}
+
+// groups returns the groups the message is counted in
+func groups(msg log_agg.Message, by string) []string {
+	switch by {
+	case "id":
+		return []string{msg.Id}
+	case "type":
+		return []string{msg.Type}
+	case "priority":
+		return []string{strconv.Itoa(msg.Priority)}
+	case "tag":
+		if len(msg.Tag) == 0 {
+			return []string{""}
+		}
+		// count each tag once
+		seen := map[string]bool{}
+		var tags []string
+		for _, tag := range msg.Tag {
+			if !seen[tag] {
+				seen[tag] = true
+				tags = append(tags, tag)
+			}
+		}
+		return tags
+	}
+	return []string{""}
+}
@@ -0,0 +1,86 @@
+package output_test
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/r0h4n/log_agg/output"
+	"github.com/r0h4n/log_agg/query"
+	"github.com/r0h4n/log_agg/transform"
+)
+
+// Test counting logs per interval
+func TestCount(t *testing.T) {
+	os.RemoveAll("/tmp/countTest")
+	defer os.RemoveAll("/tmp/countTest")
+	os.MkdirAll("/tmp/countTest", 0755)
+
+	archive, err := output.NewBoltArchive("/tmp/countTest/log_agg.bolt")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer archive.Close()
+
+	// three logs a minute over 3 minutes, web-0 tagged twice
+	start := time.Now().Truncate(time.Minute).UnixNano()
+	for i := 0; i < 9; i++ {
+		archive.Write(log_agg.Message{
+			UTime:    start + int64(i/3)*int64(time.Minute) + int64(i),
+			Type:     "app",
+			Id:       fmt.Sprintf("web-%d", i%3),
+			Tag:      []string{"http", fmt.Sprintf("node-%d", i%2)},
+			Priority: i % 3,
+			Content:  "request",
+		})
+	}
+	minute := func(i int) int64 { return start + int64(i)*int64(time.Minute) }
+	web1, _ := query.Parse("id:web-1")
+
+	cases := []struct {
+		by       string
+		offset   int64
+		end      int64
+		level    int
+		q        *query.Query
+		expected string
+	}{
+		{by: "", expected: "0: 3 =3, 1: 3 =3, 2: 3 =3"},
+		{by: "id", expected: "0: 3 web-0=1 web-1=1 web-2=1, 1: 3 web-0=1 web-1=1 web-2=1, 2: 3 web-0=1 web-1=1 web-2=1"},
+		{by: "tag", expected: "0: 3 http=3 node-0=2 node-1=1, 1: 3 http=3 node-0=1 node-1=2, 2: 3 http=3 node-0=2 node-1=1"},
+		{by: "priority", level: 2, expected: "0: 1 2=1, 1: 1 2=1, 2: 1 2=1"},
+		{by: "type", offset: minute(1) + int64(time.Second), end: minute(1), expected: "1: 3 app=3"},
+		{by: "", q: web1, expected: "0: 1 =1, 1: 1 =1, 2: 1 =1"},
+	}
+	for _, c := range cases {
+		counts, err := archive.Count("app", "", nil, c.offset, c.end, int64(time.Minute), c.level, c.q, c.by)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		var got string
+		for i := 0; i < 3; i++ {
+			counted, ok := counts[minute(i)]
+			if !ok {
+				continue
+			}
+			if got != "" {
+				got += ", "
+			}
+			got += fmt.Sprintf("%d: %d", i, counted.Total)
+			for _, group := range []string{"", "web-0", "web-1", "web-2", "http", "node-0", "node-1", "2", "app"} {
+				if n, ok := counted.Groups[group]; ok {
+					got += fmt.Sprintf(" %s=%d", group, n)
+				}
+			}
+		}
+		if len(counts) > 3 {
+			got += fmt.Sprintf(", %d intervals", len(counts))
+		}
+		if got != c.expected {
+			t.Errorf("by '%s' - '%s' doesn't match expected '%s'", c.by, got, c.expected)
+		}
+	}
+}
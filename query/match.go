@@ -0,0 +1,171 @@
+package query
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/r0h4n/log_agg/transform"
+)
+
+// matcher lazily lowercases and tokenizes a message's content for matching
+type matcher struct {
+	msg   log_agg.Message
+	lower *string
+	words map[string]bool
+}
+
+// Match reports whether the message matches the query
+func (q *Query) Match(msg log_agg.Message) bool {
+	m := &matcher{msg: msg}
+	return m.match(q.Root)
+}
+
+func (m *matcher) match(n *Node) bool {
+	switch n.Op {
+	case "and":
+		for _, child := range n.Children {
+			if !m.match(child) {
+				return false
+			}
+		}
+		return true
+	case "or":
+		for _, child := range n.Children {
+			if m.match(child) {
+				return true
+			}
+		}
+		return false
+	case "not":
+		return !m.match(n.Children[0])
+	case "compare":
+		return m.compare(n)
+	case "regex":
+		return n.Regex.MatchString(m.msg.Content)
+	case "substring":
+		if m.lower == nil {
+			lower := strings.ToLower(m.msg.Content)
+			m.lower = &lower
+		}
+		return strings.Contains(*m.lower, n.Text)
+	case "word", "prefix":
+		if m.words == nil {
+			m.words = map[string]bool{}
+			for _, word := range Words(m.msg.Content) {
+				m.words[word] = true
+			}
+		}
+		if n.Op == "word" {
+			return m.words[n.Text]
+		}
+		for word := range m.words {
+			if strings.HasPrefix(word, n.Text) {
+				return true
+			}
+		}
+		return false
+	}
+	return false
+}
+
+// compare matches a term on one of the message's attributes
+func (m *matcher) compare(n *Node) bool {
+	switch n.Field {
+	case "id":
+		return n.compareText(m.msg.Id)
+	case "type":
+		return n.compareText(m.msg.Type)
+	case "tag":
+		for _, tag := range m.msg.Tag {
+			if n.compareText(tag) {
+				return true
+			}
+		}
+		return false
+	case "priority":
+		return compared(n.Cmp, compareNumber(float64(m.msg.Priority), n.Number))
+	case "field":
+		return n.compareField(m.msg.Fields)
+	}
+	return false
+}
+
+func (n *Node) compareText(value string) bool {
+	if n.Cmp == "~" {
+		return n.Regex.MatchString(value)
+	}
+	return compared(n.Cmp, strings.Compare(value, n.Text))
+}
+
+// compareField compares the node's field in fields
+func (n *Node) compareField(fields log_agg.Fields) bool {
+	value, ok := fields.Lookup(n.Path)
+	switch {
+	case n.Cmp == "set":
+		return ok
+	case n.Cmp == "unset":
+		return !ok
+	case !ok:
+		return false
+	case n.Cmp == "=":
+		return n.equal(value)
+	case n.Cmp == "!=":
+		return !n.equal(value)
+	case n.Cmp == "~":
+		s, ok := value.(string)
+		return ok && n.Regex.MatchString(s)
+	}
+
+	if f, ok := toNumber(value); ok && n.Numeric {
+		return compared(n.Cmp, compareNumber(f, n.Number))
+	}
+	if s, ok := value.(string); ok && !n.Numeric {
+		return compared(n.Cmp, strings.Compare(s, n.Text))
+	}
+	return false
+}
+
+// equal reports whether a field's value is the node's text. Numbers are equal
+// numerically, strings and booleans as text. Objects, arrays, and null are
+// never equal.
+func (n *Node) equal(value interface{}) bool {
+	if f, ok := toNumber(value); ok {
+		return n.Numeric && f == n.Number
+	}
+	switch v := value.(type) {
+	case string:
+		return v == n.Text
+	case bool:
+		return strconv.FormatBool(v) == n.Text
+	}
+	return false
+}
+
+func compareNumber(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// compared reports whether the result of a comparison (-1, 0, 1) satisfies cmp
+func compared(cmp string, c int) bool {
+	switch cmp {
+	case "=":
+		return c == 0
+	case "!=":
+		return c != 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	}
+	return false
+}
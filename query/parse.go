@@ -0,0 +1,364 @@
+package query
+
+import (
+	"regexp"
+	"strings"
+)
+
+type (
+	token struct {
+		kind string // "(", ")", "AND", "OR", "NOT", "term", "quoted", "regex", "field"
+		text string
+		pos  int
+
+		// field terms ("id:web") also have the field, comparison, and
+		// value, of a kind ("term", "quoted", or "regex")
+		field     string
+		cmp       string
+		value     string
+		valueKind string
+		valuePos  int
+	}
+
+	parser struct {
+		query  string
+		tokens []token
+		pos    int
+	}
+)
+
+// fields that may be named in a term
+var fieldNames = map[string]bool{"id": true, "tag": true, "type": true, "priority": true, "message": true}
+
+// Parse parses a query. Syntax errors are *Error.
+func Parse(q string) (*Query, error) {
+	tokens, err := lex(q)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, &Error{Pos: 0, Msg: "Empty query"}
+	}
+
+	p := &parser{query: q, tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		t := p.tokens[p.pos]
+		return nil, &Error{Pos: t.pos, Msg: "Unexpected '" + t.text + "'"}
+	}
+
+	return &Query{query: q, Root: root}, nil
+}
+
+func lex(q string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(q); {
+		c := q[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c == '(' || c == ')':
+			tokens = append(tokens, token{kind: string(c), text: string(c), pos: i})
+			i++
+		case c == '"' || c == '/':
+			text, end, err := lexDelimited(q, i)
+			if err != nil {
+				return nil, err
+			}
+			kind := "quoted"
+			if c == '/' {
+				kind = "regex"
+			}
+			tokens = append(tokens, token{kind: kind, text: text, pos: i})
+			i = end
+		default:
+			start := i
+			i = lexBare(q, i)
+			text := q[start:i]
+
+			if field, cmp, ok := fieldPrefix(text); ok {
+				t := token{kind: "field", field: field, cmp: cmp, pos: start, valuePos: start + len(field) + len(cmp)}
+				end, err := lexValue(q, &t)
+				if err != nil {
+					return nil, err
+				}
+				t.text = q[start:end]
+				tokens = append(tokens, t)
+				i = end
+				continue
+			}
+
+			kind := "term"
+			if text == "AND" || text == "OR" || text == "NOT" {
+				kind = text
+			}
+			tokens = append(tokens, token{kind: kind, text: text, pos: start})
+		}
+	}
+	return tokens, nil
+}
+
+// returns the end of the bare (unquoted) text starting at q[start]
+func lexBare(q string, start int) int {
+	i := start
+	for i < len(q) && !strings.ContainsRune(" \t\n()\"", rune(q[i])) {
+		i++
+	}
+	return i
+}
+
+// fieldPrefix splits the name and comparison off a term naming a field
+// ("id:web-1" is "id" and ":")
+func fieldPrefix(text string) (string, string, bool) {
+	end := strings.IndexAny(text, ":<>")
+	if end < 1 {
+		return "", "", false
+	}
+	name := text[:end]
+	if !fieldNames[name] && !(strings.HasPrefix(name, "field.") && goodPath(strings.TrimPrefix(name, "field."))) {
+		return "", "", false
+	}
+
+	cmp := text[end : end+1]
+	if (cmp == ">" || cmp == "<") && strings.HasPrefix(text[end+1:], "=") {
+		cmp += "="
+	}
+	return name, cmp, true
+}
+
+// lexValue reads a field term's value, which may be quoted or a regex too,
+// returning where it ends
+func lexValue(q string, t *token) (int, error) {
+	i := t.valuePos
+	if i < len(q) && (q[i] == '"' || q[i] == '/') {
+		text, end, err := lexDelimited(q, i)
+		if err != nil {
+			return 0, err
+		}
+		t.valueKind = "quoted"
+		if q[i] == '/' {
+			t.valueKind = "regex"
+		}
+		t.value = text
+		return end, nil
+	}
+
+	end := lexBare(q, i)
+	if end == i {
+		return 0, &Error{Pos: i, Msg: "Missing value for '" + t.field + t.cmp + "'"}
+	}
+	t.value, t.valueKind = q[i:end], "term"
+	return end, nil
+}
+
+// reads a '"' or '/' delimited string starting at q[start], unescaping the delimiter
+func lexDelimited(q string, start int) (string, int, error) {
+	delim := q[start]
+	text := &strings.Builder{}
+	for i := start + 1; i < len(q); i++ {
+		if q[i] == '\\' && i+1 < len(q) && q[i+1] == delim {
+			text.WriteByte(delim)
+			i++
+			continue
+		}
+		if q[i] == delim {
+			return text.String(), i + 1, nil
+		}
+		text.WriteByte(q[i])
+	}
+	return "", 0, &Error{Pos: start, Msg: "Unterminated " + string(delim)}
+}
+
+func (p *parser) peek() *token {
+	if p.pos < len(p.tokens) {
+		return &p.tokens[p.pos]
+	}
+	return nil
+}
+
+func (p *parser) parseOr() (*Node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	node := &Node{Op: "or", Children: []*Node{left}, Pos: left.Pos}
+	for t := p.peek(); t != nil && t.kind == "OR"; t = p.peek() {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		node.Children = append(node.Children, right)
+	}
+	if len(node.Children) == 1 {
+		return left, nil
+	}
+	return node, nil
+}
+
+func (p *parser) parseAnd() (*Node, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	node := &Node{Op: "and", Children: []*Node{left}, Pos: left.Pos}
+	for t := p.peek(); t != nil && t.kind != "OR" && t.kind != ")"; t = p.peek() {
+		if t.kind == "AND" {
+			p.pos++
+		}
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		node.Children = append(node.Children, right)
+	}
+	if len(node.Children) == 1 {
+		return left, nil
+	}
+	return node, nil
+}
+
+func (p *parser) parseNot() (*Node, error) {
+	t := p.peek()
+	if t != nil && t.kind == "NOT" {
+		p.pos++
+		child, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &Node{Op: "not", Children: []*Node{child}, Pos: t.pos}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (*Node, error) {
+	t := p.peek()
+	if t == nil {
+		return nil, &Error{Pos: len(p.query), Msg: "Unexpected end of query"}
+	}
+	p.pos++
+
+	switch t.kind {
+	case "(":
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if end := p.peek(); end == nil || end.kind != ")" {
+			return nil, &Error{Pos: t.pos, Msg: "Missing ')' for '('"}
+		}
+		p.pos++
+		return node, nil
+	case "quoted", "regex", "term":
+		return textNode(t.kind, t.text, t.pos)
+	case "field":
+		return fieldNode(t)
+	default:
+		return nil, &Error{Pos: t.pos, Msg: "Unexpected '" + t.text + "'"}
+	}
+}
+
+// textNode matches message content with a term
+func textNode(kind, text string, pos int) (*Node, error) {
+	switch kind {
+	case "quoted":
+		return &Node{Op: "substring", Text: strings.ToLower(text), Pos: pos}, nil
+	case "regex":
+		r, err := regexp.Compile(text)
+		if err != nil {
+			return nil, &Error{Pos: pos, Msg: "Bad regex", Detail: err.Error()}
+		}
+		return &Node{Op: "regex", Text: text, Regex: r, Pos: pos}, nil
+	}
+
+	text = strings.ToLower(text)
+	if strings.HasSuffix(text, "*") && isWord(text[:len(text)-1]) {
+		return &Node{Op: "prefix", Text: text[:len(text)-1], Pos: pos}, nil
+	}
+	if isWord(text) {
+		return &Node{Op: "word", Text: text, Pos: pos}, nil
+	}
+	// terms that aren't a single word are matched as substrings
+	return &Node{Op: "substring", Text: text, Pos: pos}, nil
+}
+
+// fieldNode compares a message's attribute with a field term's value
+func fieldNode(t *token) (*Node, error) {
+	value := t.value
+	if t.field == "message" {
+		if t.cmp != ":" {
+			return nil, &Error{Pos: t.pos, Msg: "Can't compare message"}
+		}
+		return textNode(t.valueKind, value, t.valuePos)
+	}
+
+	n := &Node{Op: "compare", Field: t.field, Cmp: t.cmp, Pos: t.pos}
+	if n.Cmp == ":" {
+		n.Cmp = "="
+	}
+	if strings.HasPrefix(t.field, "field.") {
+		n.Field, n.Path = "field", strings.TrimPrefix(t.field, "field.")
+	}
+
+	if n.Field == "priority" {
+		if t.valueKind == "regex" {
+			return nil, &Error{Pos: t.valuePos, Msg: "Can't match priority with a regex"}
+		}
+		n.setText(value)
+		if level, ok := levels[strings.ToLower(value)]; ok {
+			n.Number, n.Numeric = float64(level), true
+		}
+		if !n.Numeric {
+			return nil, &Error{Pos: t.valuePos, Msg: "Bad priority '" + value + "'"}
+		}
+		return n, nil
+	}
+
+	switch {
+	case t.valueKind == "regex" || (t.valueKind == "term" && strings.ContainsAny(value, "*?")):
+		if n.Cmp != "=" {
+			return nil, &Error{Pos: t.valuePos, Msg: "Can't compare " + t.field + " with a pattern"}
+		}
+		// "field.user:*" is set to anything, not just a string
+		if n.Field == "field" && t.valueKind == "term" && value == "*" {
+			n.Cmp = "set"
+			return n, nil
+		}
+
+		pattern := value
+		if t.valueKind == "term" {
+			pattern = glob(value)
+		}
+		r, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, &Error{Pos: t.valuePos, Msg: "Bad regex", Detail: err.Error()}
+		}
+		n.Cmp, n.Text, n.Regex = "~", pattern, r
+	case n.Field == "field":
+		n.setText(value)
+	default:
+		n.Text = value
+	}
+	return n, nil
+}
+
+// glob translates a glob ("web-*") to an anchored regular expression
+func glob(pattern string) string {
+	r := &strings.Builder{}
+	r.WriteString("^")
+	for _, part := range strings.SplitAfter(pattern, "") {
+		switch part {
+		case "*":
+			r.WriteString(".*")
+		case "?":
+			r.WriteString(".")
+		default:
+			r.WriteString(regexp.QuoteMeta(part))
+		}
+	}
+	r.WriteString("$")
+	return r.String()
+}
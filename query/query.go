@@ -0,0 +1,234 @@
+// Package query parses and matches the query language of `GET /logs`.
+//
+// A query is made of terms, combined with AND, OR, NOT and parentheses.
+// Adjacent terms are ANDed.
+//
+//  word            message contains the whole word, case insensitive
+//  word*           message contains a word starting with "word"
+//  "some text"     message contains the substring, case insensitive
+//  /regex/         message matches the regular expression
+//  id:web-1        id is "web-1" (type: and tag: too, tag matching any tag)
+//  id:web-*        id matches the glob, "*" is any text and "?" any character
+//  id:/^web-\d+$/  id matches the regular expression
+//  id>=web-3       id sorts after (or is) "web-3", also >, < and <=
+//  priority>=warn  priority compared with a number or a level name
+//  field.status:500, field.status>=500, field.user:*
+//                  a field is equal to (numerically, to numbers), compared
+//                  with, or set
+//  message:timeout the same as a bare term
+//
+// Terms with other names ("http://host") are matched against the message like
+// any other text.
+package query
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type (
+	// Query is a parsed query
+	Query struct {
+		query string
+		Root  *Node
+	}
+
+	// Node is a term or a combination of them. Message terms have an empty
+	// Field, terms on a message's attributes compare it with Text (or Number,
+	// or Regex).
+	Node struct {
+		Op       string // "and", "or", "not", "word", "prefix", "substring", "regex", "compare"
+		Children []*Node
+		Text     string
+		Regex    *regexp.Regexp
+		Pos      int // position in the query
+
+		Field   string  // "id", "tag", "type", "priority", or "field"
+		Path    string  // dotted path into the message's fields
+		Cmp     string  // "=", "!=", ">", ">=", "<", "<=", "~" (Regex), "set", "unset"
+		Number  float64 // Text as a number
+		Numeric bool    // Text is a (finite) number
+	}
+
+	// Error is a syntax error in a query, at Pos (a byte offset)
+	Error struct {
+		Pos    int
+		Msg    string
+		Detail string
+	}
+)
+
+// levels are the names priority may be compared with
+var levels = map[string]int{"trace": 0, "debug": 1, "info": 2, "warn": 3, "error": 4, "fatal": 5}
+
+func (e *Error) Error() string {
+	if e.Detail != "" {
+		return fmt.Sprintf("%s at %d - %s", e.Msg, e.Pos, e.Detail)
+	}
+	return fmt.Sprintf("%s at %d", e.Msg, e.Pos)
+}
+
+// ParseField parses a filter on a message's Fields (`field.<path>=<expr>` in
+// `GET /logs`). Path may be dotted ("user.id") to reach into objects.
+//
+//  500                  equal (numerically, to numbers)
+//  !500                 set, and not equal
+//  >500 >=500 <5 <=5    numerically compared to numbers, or if expr isn't a
+//                       number, compared to strings
+//  (empty)              set, to anything
+//  !                    not set
+func ParseField(path, expr string) (*Query, error) {
+	if !goodPath(path) {
+		return nil, fmt.Errorf("Bad field '%s'", path)
+	}
+
+	query := fmt.Sprintf("field.%s=%s", path, expr)
+	n := &Node{Op: "compare", Field: "field", Path: path, Cmp: "="}
+	switch {
+	case expr == "":
+		n.Cmp = "set"
+	case expr == "!":
+		n.Cmp = "unset"
+	default:
+		for _, cmp := range []string{">=", "<=", ">", "<", "!"} {
+			if strings.HasPrefix(expr, cmp) {
+				n.Cmp = cmp
+				expr = expr[len(cmp):]
+				break
+			}
+		}
+		if n.Cmp == "!" {
+			n.Cmp = "!="
+		}
+		if expr == "" {
+			return nil, fmt.Errorf("Missing value to compare field '%s' with", path)
+		}
+		n.setText(expr)
+	}
+
+	return &Query{query: query, Root: n}, nil
+}
+
+// And returns a query matching both q and other (either may be nil)
+func (q *Query) And(other *Query) *Query {
+	if q == nil {
+		return other
+	}
+	if other == nil {
+		return q
+	}
+	return &Query{
+		query: q.query + " AND " + other.query,
+		Root:  &Node{Op: "and", Children: []*Node{q.Root, other.Root}},
+	}
+}
+
+// String returns the original query
+func (q *Query) String() string {
+	return q.query
+}
+
+// Types returns the log types a matching message must have, and false if the
+// query doesn't narrow them down (`type:app OR type:deploy` needs one of two,
+// `type:app OR timeout` may be any type)
+func (q *Query) Types() ([]string, bool) {
+	set, ok := q.Root.types()
+	if !ok {
+		return nil, false
+	}
+	types := make([]string, 0, len(set))
+	for kind := range set {
+		types = append(types, kind)
+	}
+	sort.Strings(types)
+	return types, true
+}
+
+func (n *Node) types() (map[string]bool, bool) {
+	switch n.Op {
+	case "compare":
+		if n.Field == "type" && n.Cmp == "=" {
+			return map[string]bool{n.Text: true}, true
+		}
+	case "and":
+		// each constraint narrows the types further
+		var set map[string]bool
+		for _, child := range n.Children {
+			childSet, ok := child.types()
+			if !ok {
+				continue
+			}
+			if set == nil {
+				set = childSet
+				continue
+			}
+			for kind := range set {
+				if !childSet[kind] {
+					delete(set, kind)
+				}
+			}
+		}
+		return set, set != nil
+	case "or":
+		set := map[string]bool{}
+		for _, child := range n.Children {
+			childSet, ok := child.types()
+			if !ok {
+				return nil, false
+			}
+			for kind := range childSet {
+				set[kind] = true
+			}
+		}
+		return set, true
+	}
+	return nil, false
+}
+
+// setText sets the text compared with, and its number if it is one
+func (n *Node) setText(text string) {
+	n.Text = text
+	if f, err := strconv.ParseFloat(text, 64); err == nil && !math.IsInf(f, 0) && !math.IsNaN(f) {
+		n.Number, n.Numeric = f, true
+	}
+}
+
+// Words splits content into lowercase words (runs of letters and digits), the
+// way word terms are matched
+func Words(content string) []string {
+	return strings.FieldsFunc(strings.ToLower(content), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+func isWord(s string) bool {
+	words := Words(s)
+	return len(words) == 1 && words[0] == s
+}
+
+func goodPath(path string) bool {
+	return path != "" && !strings.HasPrefix(path, ".") && !strings.HasSuffix(path, ".") && !strings.Contains(path, "..")
+}
+
+func toNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
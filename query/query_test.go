@@ -0,0 +1,191 @@
+package query_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/r0h4n/log_agg/query"
+	"github.com/r0h4n/log_agg/transform"
+)
+
+// Test parsing and matching queries
+func TestParse(t *testing.T) {
+	msg := log_agg.Message{
+		Id:       "web-12",
+		Type:     "app",
+		Tag:      []string{"http", "prod"},
+		Priority: 4,
+		Content:  "GET /api/users failed: Timeout after 30s",
+		Fields:   log_agg.Fields{"status": 500.0, "user": map[string]interface{}{"id": "ann"}},
+	}
+
+	matches := map[string]bool{
+		"timeout":                      true,
+		"time":                         false,
+		"time*":                        true,
+		"timeout users":                true,
+		"timeout AND NOT failed":       false,
+		"ok OR failed":                 true,
+		"NOT (ok OR failed)":           false,
+		"\"users failed\"":             true,
+		"/api/users":                   true,
+		"/[0-9]+s$/":                   true,
+		"/TIMEOUT/":                    false,
+		"\"escaped \\\" quote\" OR ok": false,
+		"message:timeout":              true,
+		"message:\"after 30\"":         true,
+		"failed:":                      true,
+		"id:web-12":                    true,
+		"id:web-1":                     false,
+		"id:web-*":                     true,
+		"id:web-?":                     false,
+		"id:\"web-*\"":                 false,
+		"id:/^web-[0-9]+$/":            true,
+		"id>web-1":                     true,
+		"id<=web-1":                    false,
+		"type:app AND tag:prod":        true,
+		"tag:health":                   false,
+		"NOT tag:health":               true,
+		"tag:*":                        true,
+		"priority>=3":                  true,
+		"priority:error":               true,
+		"priority<warn":                false,
+		"field.status:500":             true,
+		"field.status>=500":            true,
+		"field.user.id:a*":             true,
+		"field.user:*":                 true,
+		"field.email:*":                false,
+		"type:app AND id:web-* AND NOT tag:health AND priority>=3 AND \"timeout\"": true,
+		"(type:deploy OR id:web-12) timeout":                                       true,
+	}
+	for q, match := range matches {
+		parsed, err := query.Parse(q)
+		if err != nil {
+			t.Errorf("query %q failed to parse - %s", q, err)
+			continue
+		}
+		if parsed.Match(msg) != match {
+			t.Errorf("query %q should match %v", q, match)
+		}
+	}
+
+	errors := map[string]string{
+		"":                  "Empty query at 0",
+		"(timeout":          "Missing ')' for '(' at 0",
+		"timeout)":          "Unexpected ')' at 7",
+		"a \"timeout":       "Unterminated \" at 2",
+		"/(/":               "Bad regex at 0 - ",
+		"timeout OR":        "Unexpected end of query at 10",
+		"NOT":               "Unexpected end of query at 3",
+		"id: web":           "Missing value for 'id:' at 3",
+		"a AND priority:hi": "Bad priority 'hi' at 15",
+		"priority:/4/":      "Can't match priority with a regex at 9",
+		"message>a":         "Can't compare message at 0",
+		"id>web-*":          "Can't compare id with a pattern at 3",
+		"tag:/[/":           "Bad regex at 4 - ",
+	}
+	for q, expected := range errors {
+		_, err := query.Parse(q)
+		if err == nil {
+			t.Errorf("bad query %q is too forgiving", q)
+			continue
+		}
+		if _, ok := err.(*query.Error); !ok || !strings.HasPrefix(err.Error(), expected) {
+			t.Errorf("bad query %q - '%s' doesn't match expected out", q, err)
+		}
+	}
+}
+
+// Test parsing and matching field filters
+func TestParseField(t *testing.T) {
+	msg := log_agg.Message{Content: "request failed", Fields: log_agg.Fields{
+		"status":  500.0,
+		"code":    "E42",
+		"ok":      false,
+		"latency": 0.25,
+		"user":    map[string]interface{}{"id": 3.0, "name": "ann"},
+	}}
+
+	matches := map[[2]string]bool{
+		{"status", "500"}:    true,
+		{"status", "5e2"}:    true,
+		{"status", "!500"}:   false,
+		{"status", "!404"}:   true,
+		{"status", ">=500"}:  true,
+		{"status", ">500"}:   false,
+		{"status", "<600"}:   true,
+		{"status", "<=499"}:  false,
+		{"status", ">abc"}:   false,
+		{"code", "E42"}:      true,
+		{"code", ">E4"}:      true,
+		{"code", "<E"}:       false,
+		{"ok", "false"}:      true,
+		{"latency", ">0.1"}:  true,
+		{"user.id", "3"}:     true,
+		{"user.name", "ann"}: true,
+		{"user", "ann"}:      false,
+		{"user", ""}:         true,
+		{"user.email", ""}:   false,
+		{"user.email", "!"}:  true,
+		{"user.email", "!x"}: false,
+		{"missing", "!"}:     true,
+		{"missing", "<1"}:    false,
+	}
+	for filter, match := range matches {
+		parsed, err := query.ParseField(filter[0], filter[1])
+		if err != nil {
+			t.Errorf("field.%s=%s failed to parse - %s", filter[0], filter[1], err)
+			continue
+		}
+		if parsed.Match(msg) != match {
+			t.Errorf("field.%s=%s should match %v", filter[0], filter[1], match)
+		}
+	}
+
+	// filters are ANDed with a query
+	parsed, _ := query.Parse("failed")
+	status, _ := query.ParseField("status", ">=500")
+	if parsed = parsed.And(status); !parsed.Match(msg) || parsed.String() != "failed AND field.status=>=500" {
+		t.Errorf("'%s' should match", parsed)
+	}
+	notFound, _ := query.ParseField("status", "404")
+	if parsed.And(notFound).Match(msg) {
+		t.Errorf("'%s' shouldn't match", parsed.And(notFound))
+	}
+
+	for _, filter := range [][2]string{{"", "1"}, {"user.", "1"}, {".id", "1"}, {"a..b", "1"}, {"status", ">="}, {"status", "<"}} {
+		if _, err := query.ParseField(filter[0], filter[1]); err == nil {
+			t.Errorf("bad filter field.%s=%s is too forgiving", filter[0], filter[1])
+		}
+	}
+}
+
+// Test finding the types a query narrows to
+func TestTypes(t *testing.T) {
+	types := map[string]string{
+		"type:app":                           "app",
+		"type:app AND timeout":               "app",
+		"type:app OR type:deploy":            "app,deploy",
+		"(type:app OR type:deploy) type:app": "app",
+		"type:app type:deploy":               "",
+		"type:app OR timeout":                "any",
+		"NOT type:app":                       "any",
+		"type:app*":                          "any",
+		"timeout":                            "any",
+	}
+	for q, expected := range types {
+		parsed, err := query.Parse(q)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		kinds, ok := parsed.Types()
+		got := strings.Join(kinds, ",")
+		if !ok {
+			got = "any"
+		}
+		if got != expected {
+			t.Errorf("query %q - types '%s' don't match expected out", q, got)
+		}
+	}
+}
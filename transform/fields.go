@@ -0,0 +1,81 @@
+package log_agg
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// the json attributes of Message's own fields, any others are kept in Fields
+var messageKeys = map[string]bool{
+	"time":       true,
+	"utime":      true,
+	"id":         true,
+	"tag":        true,
+	"type":       true,
+	"priority":   true,
+	"message":    true,
+	"raw":        true,
+	"message_id": true,
+	"tenant":     true,
+	"fields":     true,
+}
+
+// UnmarshalJSON decodes a message, keeping attributes it has no field for in
+// Fields. Those given in "fields" take precedence over them.
+func (m *Message) UnmarshalJSON(data []byte) error {
+	// without the method, to decode as usual
+	type message Message
+	var msg message
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return err
+	}
+
+	var attributes map[string]json.RawMessage
+	if err := json.Unmarshal(data, &attributes); err != nil {
+		return err
+	}
+	for key, raw := range attributes {
+		if messageKeys[key] {
+			continue
+		}
+		if _, ok := msg.Fields[key]; ok {
+			continue
+		}
+		var value interface{}
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return err
+		}
+		if msg.Fields == nil {
+			msg.Fields = Fields{}
+		}
+		msg.Fields[key] = value
+	}
+
+	*m = Message(msg)
+	return nil
+}
+
+// Lookup returns the value at a dotted path ("user.id") of nested objects
+// (and arrays, by index)
+func (f Fields) Lookup(path string) (interface{}, bool) {
+	var value interface{} = map[string]interface{}(f)
+	for _, key := range strings.Split(path, ".") {
+		var ok bool
+		switch v := value.(type) {
+		case map[string]interface{}:
+			value, ok = v[key]
+		case Fields:
+			value, ok = v[key]
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if ok = err == nil && i >= 0 && i < len(v); ok {
+				value = v[i]
+			}
+		}
+		if !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
@@ -0,0 +1,205 @@
+package log_agg
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/r0h4n/log_agg/config"
+)
+
+const (
+	// how long an event waits for its next line, when not configured
+	defaultMultilineTimeout = time.Second
+
+	// longest event, when not configured
+	defaultMultilineMax = 64 * 1024
+)
+
+type (
+	// combiner assembles multiline events (stack traces) out of consecutive
+	// messages, before they're processed
+	combiner struct {
+		rules   []*multilineRule
+		emit    func([]Message) // writes events completed by their timeout
+		mutex   sync.Mutex      // guards pending
+		pending map[string]*event
+	}
+
+	// multilineRule is a compiled config.MultilineConfig
+	multilineRule struct {
+		match    matcher
+		start    *regexp.Regexp
+		cont     *regexp.Regexp
+		timeout  time.Duration
+		maxBytes int
+	}
+
+	// event is a message waiting for more lines
+	event struct {
+		rule  *multilineRule
+		msg   Message
+		timer *time.Timer
+	}
+)
+
+// compiles the configured multiline rules, there's no combiner without any
+func newCombiner(configs []config.MultilineConfig, emit func([]Message)) (*combiner, error) {
+	if len(configs) == 0 {
+		return nil, nil
+	}
+
+	c := &combiner{emit: emit, pending: make(map[string]*event)}
+	for i, cfg := range configs {
+		rule, err := newMultilineRule(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("Bad multiline %d - %s", i, err)
+		}
+		c.rules = append(c.rules, rule)
+	}
+
+	return c, nil
+}
+
+func newMultilineRule(cfg config.MultilineConfig) (*multilineRule, error) {
+	match, err := newMatcher(cfg.Match)
+	if err != nil {
+		return nil, err
+	}
+	rule := &multilineRule{match: match, timeout: defaultMultilineTimeout, maxBytes: defaultMultilineMax}
+
+	switch {
+	case cfg.Start == "" && cfg.Continue == "":
+		return nil, fmt.Errorf("Missing start or continue")
+	case cfg.Start != "" && cfg.Continue != "":
+		return nil, fmt.Errorf("Only one of start or continue may be set")
+	case cfg.Start != "":
+		if rule.start, err = regexp.Compile(cfg.Start); err != nil {
+			return nil, fmt.Errorf("Bad start - %s", err)
+		}
+	default:
+		if rule.cont, err = regexp.Compile(cfg.Continue); err != nil {
+			return nil, fmt.Errorf("Bad continue - %s", err)
+		}
+	}
+
+	if cfg.Timeout != "" {
+		rule.timeout, err = time.ParseDuration(cfg.Timeout)
+		if err != nil || rule.timeout <= 0 {
+			return nil, fmt.Errorf("Bad timeout '%s'", cfg.Timeout)
+		}
+	}
+	if cfg.MaxBytes < 0 {
+		return nil, fmt.Errorf("Bad max-bytes '%d'", cfg.MaxBytes)
+	}
+	if cfg.MaxBytes > 0 {
+		rule.maxBytes = cfg.MaxBytes
+	}
+
+	return rule, nil
+}
+
+// combine adds the messages to their events, returning those they complete
+// (and messages no rule applies to) in order
+func (c *combiner) combine(msgs []Message) []Message {
+	var done []Message
+	for i := range msgs {
+		done = append(done, c.add(msgs[i])...)
+	}
+	return done
+}
+
+func (c *combiner) add(msg Message) []Message {
+	var rule *multilineRule
+	for _, r := range c.rules {
+		if r.match.matches(msg) {
+			rule = r
+			break
+		}
+	}
+	if rule == nil {
+		return []Message{msg}
+	}
+
+	// events are kept apart per source, tenants never share one
+	key := strings.Join(append([]string{msg.Tenant, msg.Id}, msg.Tag...), "\x00")
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var done []Message
+	if e := c.pending[key]; e != nil {
+		if e.rule == rule && rule.continues(msg.Content) && len(e.msg.Content)+1+len(msg.Content) <= rule.maxBytes {
+			e.append(msg)
+			e.timer.Reset(rule.timeout)
+			return nil
+		}
+		e.timer.Stop()
+		delete(c.pending, key)
+		done = append(done, e.msg)
+	}
+
+	e := &event{rule: rule, msg: msg}
+	e.timer = time.AfterFunc(rule.timeout, func() { c.expire(key, e) })
+	c.pending[key] = e
+
+	return done
+}
+
+// expire writes an event that's waited its timeout for another line
+func (c *combiner) expire(key string, e *event) {
+	c.mutex.Lock()
+	if c.pending[key] != e {
+		// completed by a line in the meantime
+		c.mutex.Unlock()
+		return
+	}
+	delete(c.pending, key)
+	c.mutex.Unlock()
+
+	c.emit([]Message{e.msg})
+}
+
+// flush writes every pending event, oldest first
+func (c *combiner) flush() {
+	c.mutex.Lock()
+	msgs := make([]Message, 0, len(c.pending))
+	for key, e := range c.pending {
+		e.timer.Stop()
+		msgs = append(msgs, e.msg)
+		delete(c.pending, key)
+	}
+	c.mutex.Unlock()
+
+	if len(msgs) == 0 {
+		return
+	}
+	sort.SliceStable(msgs, func(i, j int) bool { return msgs[i].UTime < msgs[j].UTime })
+	c.emit(msgs)
+}
+
+// continues reports whether a line carries on the event before it
+func (r *multilineRule) continues(line string) bool {
+	if r.start != nil {
+		return !r.start.MatchString(line)
+	}
+	return r.cont.MatchString(line)
+}
+
+// append adds a message's line to the event, which keeps the highest priority
+// of its lines
+func (e *event) append(msg Message) {
+	e.msg.Content += "\n" + msg.Content
+	if len(msg.Raw) > 0 {
+		if len(e.msg.Raw) > 0 {
+			e.msg.Raw = append(e.msg.Raw[:len(e.msg.Raw):len(e.msg.Raw)], '\n')
+		}
+		e.msg.Raw = append(e.msg.Raw, msg.Raw...)
+	}
+	if msg.Priority > e.msg.Priority {
+		e.msg.Priority = msg.Priority
+	}
+}
@@ -0,0 +1,286 @@
+package log_agg
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/r0h4n/log_agg/config"
+)
+
+type (
+	// Processor modifies, enriches, or drops a message before it reaches the
+	// outputs. Returning no messages drops the message, returning several
+	// passes each of them on to the next processor.
+	Processor interface {
+		Process(Message) []Message
+	}
+
+	// ProcessorFunc is a function that satisfies the Processor interface
+	ProcessorFunc func(Message) []Message
+
+	namedProcessor struct {
+		tag       string
+		processor Processor
+	}
+
+	// matcher holds the compiled `match` of a ProcessorConfig
+	matcher map[string]*regexp.Regexp
+)
+
+// Process calls f(msg)
+func (f ProcessorFunc) Process(msg Message) []Message {
+	return f(msg)
+}
+
+// AddProcessor appends a processor to the end of the transform chain.
+// Adding a processor with an existing tag replaces it in place.
+func AddProcessor(tag string, processor Processor) {
+	Vac.addProcessor(tag, processor)
+}
+
+func (l *Log_agg) addProcessor(tag string, processor Processor) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	// copy on write, process() may be ranging over the current slice
+	processors := append([]namedProcessor(nil), l.processors...)
+	for i := range processors {
+		if processors[i].tag == tag {
+			processors[i].processor = processor
+			l.processors = processors
+			return
+		}
+	}
+	l.processors = append(processors, namedProcessor{tag: tag, processor: processor})
+}
+
+// RemoveProcessor drops a processor from the transform chain
+func RemoveProcessor(tag string) {
+	Vac.removeProcessor(tag)
+}
+
+func (l *Log_agg) removeProcessor(tag string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for i := range l.processors {
+		if l.processors[i].tag == tag {
+			l.processors = append(l.processors[:i:i], l.processors[i+1:]...)
+			return
+		}
+	}
+}
+
+// process runs the message through each processor, in order
+func (l *Log_agg) process(msg Message) []Message {
+	l.mutex.RLock()
+	processors := l.processors
+	l.mutex.RUnlock()
+
+	messages := []Message{msg}
+	for _, p := range processors {
+		var next []Message
+		for i := range messages {
+			next = append(next, p.processor.Process(messages[i])...)
+		}
+		messages = next
+		if len(messages) == 0 {
+			break
+		}
+	}
+	return messages
+}
+
+// NewProcessor creates a built-in processor from its config
+func NewProcessor(cfg config.ProcessorConfig) (Processor, error) {
+	match, err := newMatcher(cfg.Match)
+	if err != nil {
+		return nil, err
+	}
+
+	switch cfg.Kind {
+	case "set":
+		if !isField(cfg.Field) {
+			return nil, fmt.Errorf("Unknown field '%s'", cfg.Field)
+		}
+		if err := (&Message{}).SetField(cfg.Field, cfg.Value); err != nil {
+			return nil, err
+		}
+		return ProcessorFunc(func(msg Message) []Message {
+			if match.matches(msg) {
+				msg.SetField(cfg.Field, cfg.Value)
+			}
+			return []Message{msg}
+		}), nil
+	case "rename":
+		if !isField(cfg.Field) || !isField(cfg.To) {
+			return nil, fmt.Errorf("Unknown field '%s' or '%s'", cfg.Field, cfg.To)
+		}
+		return ProcessorFunc(func(msg Message) []Message {
+			if match.matches(msg) {
+				value := msg.GetField(cfg.Field)
+				if msg.SetField(cfg.To, value) == nil {
+					msg.DeleteField(cfg.Field)
+				}
+			}
+			return []Message{msg}
+		}), nil
+	case "delete":
+		if !isField(cfg.Field) {
+			return nil, fmt.Errorf("Unknown field '%s'", cfg.Field)
+		}
+		return ProcessorFunc(func(msg Message) []Message {
+			if match.matches(msg) {
+				msg.DeleteField(cfg.Field)
+			}
+			return []Message{msg}
+		}), nil
+	case "route":
+		if cfg.To == "" {
+			return nil, fmt.Errorf("Missing type to route to")
+		}
+		return ProcessorFunc(func(msg Message) []Message {
+			if match.matches(msg) {
+				msg.Type = cfg.To
+			}
+			return []Message{msg}
+		}), nil
+	case "drop":
+		if len(match) == 0 {
+			return nil, fmt.Errorf("Refusing to drop every message, missing match")
+		}
+		return ProcessorFunc(func(msg Message) []Message {
+			if match.matches(msg) {
+				return nil
+			}
+			return []Message{msg}
+		}), nil
+	default:
+		return nil, fmt.Errorf("Unknown processor kind '%s'", cfg.Kind)
+	}
+}
+
+// creates the configured processors, in order
+func initProcessors(l *Log_agg, configs []config.ProcessorConfig) error {
+	for i, cfg := range configs {
+		if cfg.Name == "" {
+			cfg.Name = fmt.Sprintf("%s-%d", cfg.Kind, i)
+		}
+		processor, err := NewProcessor(cfg)
+		if err != nil {
+			return fmt.Errorf("Bad processor '%s' - %s", cfg.Name, err)
+		}
+		l.addProcessor(cfg.Name, processor)
+	}
+	return nil
+}
+
+// compiles a `match` of field names to regexes
+func newMatcher(fields map[string]string) (matcher, error) {
+	match := matcher{}
+	for field, expr := range fields {
+		if !isField(field) {
+			return nil, fmt.Errorf("Unknown match field '%s'", field)
+		}
+		r, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("Bad match for '%s' - %s", field, err)
+		}
+		match[field] = r
+	}
+	return match, nil
+}
+
+// matches reports whether every configured field matches the message
+func (m matcher) matches(msg Message) bool {
+	for field, r := range m {
+		if field == "tag" {
+			found := false
+			for i := range msg.Tag {
+				if r.MatchString(msg.Tag[i]) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+			continue
+		}
+		if !r.MatchString(msg.GetField(field)) {
+			return false
+		}
+	}
+	return true
+}
+
+func isField(name string) bool {
+	switch name {
+	case "id", "type", "tag", "priority", "message":
+		return true
+	}
+	return false
+}
+
+// GetField returns the string value of the named field ("id", "type",
+// "tag", "priority", or "message"). Tags are comma separated.
+func (m Message) GetField(name string) string {
+	switch name {
+	case "id":
+		return m.Id
+	case "type":
+		return m.Type
+	case "tag":
+		return strings.Join(m.Tag, ",")
+	case "priority":
+		return strconv.Itoa(m.Priority)
+	case "message":
+		return m.Content
+	}
+	return ""
+}
+
+// SetField sets the named field from a string value. Setting "tag" adds
+// the value to the message's tags.
+func (m *Message) SetField(name, value string) error {
+	switch name {
+	case "id":
+		m.Id = value
+	case "type":
+		m.Type = value
+	case "tag":
+		if value != "" {
+			m.Tag = append(m.Tag[:len(m.Tag):len(m.Tag)], value)
+		}
+	case "priority":
+		p, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("Bad priority '%s'", value)
+		}
+		m.Priority = p
+	case "message":
+		m.Content = value
+	default:
+		return fmt.Errorf("Unknown field '%s'", name)
+	}
+	return nil
+}
+
+// DeleteField resets the named field. Deleting "type" reverts it to the
+// default log type.
+func (m *Message) DeleteField(name string) {
+	switch name {
+	case "id":
+		m.Id = ""
+	case "type":
+		m.Type = config.LogType
+	case "tag":
+		m.Tag = nil
+	case "priority":
+		m.Priority = 0
+	case "message":
+		m.Content = ""
+	}
+}
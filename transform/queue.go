@@ -0,0 +1,472 @@
+package log_agg
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/r0h4n/log_agg/config"
+	"github.com/r0h4n/log_agg/metrics"
+)
+
+// Queue policies, applied to messages written to an output whose queue is full
+const (
+	PolicyBlock      = "block"       // wait for room, slowing writers to the output's pace
+	PolicyDropOldest = "drop-oldest" // drop the oldest queued messages to make room
+	PolicyDropNewest = "drop-newest" // drop the messages being written
+	PolicySpill      = "spill"       // append to a file in config.QueueSpillDir, read back in order
+)
+
+type (
+	// QueueStat describes an output's queue
+	QueueStat struct {
+		Size    int    `json:"size"`
+		Policy  string `json:"policy"`
+		Depth   int    `json:"depth"`   // messages waiting, including spilled ones
+		Spilled int    `json:"spilled"` // messages waiting on disk
+		Dropped uint64 `json:"dropped"` // messages dropped by the policy or by removing the output
+	}
+
+	// queue holds the batches written to an output until it is ready for them
+	queue struct {
+		tag    string
+		size   int
+		policy string
+
+		mutex   sync.Mutex
+		cond    *sync.Cond // signals pushes, pops, and closing
+		batches [][]Message
+		depth   int // messages in batches
+		spill   *spill
+		dropped uint64
+		closed  bool
+		flush   bool      // when closed, write what's queued before stopping
+		handed  bool      // when closed, what's queued was handed to a replacement
+		stopped chan bool // closed once the output has returned
+	}
+
+	// spill is a file of json encoded batches, read back in the order written
+	spill struct {
+		path   string
+		writer *os.File
+		file   *os.File
+		reader *bufio.Reader
+		count  int // messages written and not yet read
+	}
+)
+
+var (
+	queueDepth   = metrics.NewGauge("log_agg_output_queue_depth", "Messages waiting for an output, by output", "output")
+	queueDropped = metrics.NewCounter("log_agg_output_dropped_messages_total", "Messages dropped by an output's queue, by output", "output")
+)
+
+func init() {
+	metrics.OnCollect(func() {
+		depths := map[string]int{}
+		for tag, stat := range QueueStats() {
+			depths[metricLabel(tag)] += stat.Depth
+		}
+		queueDepth.Reset()
+		for label, depth := range depths {
+			queueDepth.Set(float64(depth), label)
+		}
+	})
+}
+
+// metricLabel is an output's label in the queue metrics. Streams come and go,
+// so they share "stream" rather than each adding series.
+func metricLabel(tag string) string {
+	if strings.HasPrefix(tag, "stream-") {
+		return "stream"
+	}
+	return tag
+}
+
+// validates the configured queue size and policies
+func checkQueues() error {
+	if config.QueueSize < 1 {
+		return fmt.Errorf("Bad queue-size '%d' - must be at least 1", config.QueueSize)
+	}
+
+	spills := config.QueuePolicy == PolicySpill
+	configs := map[string]config.QueueConfig{"": {Policy: config.QueuePolicy}}
+	for tag, c := range config.Queues {
+		configs[tag] = c
+		spills = spills || c.Policy == PolicySpill
+	}
+	for tag, c := range configs {
+		switch c.Policy {
+		case "", PolicyBlock, PolicyDropOldest, PolicyDropNewest, PolicySpill:
+		default:
+			return fmt.Errorf("Bad queue-policy '%s' for '%s'", c.Policy, tag)
+		}
+		if c.Size < 0 {
+			return fmt.Errorf("Bad queue size '%d' for '%s'", c.Size, tag)
+		}
+	}
+
+	if spills {
+		if err := os.MkdirAll(config.QueueSpillDir, 0755); err != nil {
+			return fmt.Errorf("Failed to create queue-spill-dir - %s", err)
+		}
+	}
+	return nil
+}
+
+// newQueue creates the configured queue for an output
+func newQueue(tag string) *queue {
+	q := &queue{
+		tag:     tag,
+		size:    config.QueueSize,
+		policy:  config.QueuePolicy,
+		stopped: make(chan bool),
+	}
+	q.cond = sync.NewCond(&q.mutex)
+
+	if c, ok := config.Queues[tag]; ok {
+		if c.Size > 0 {
+			q.size = c.Size
+		}
+		if c.Policy != "" {
+			q.policy = c.Policy
+		}
+	}
+
+	if q.policy == PolicySpill {
+		s, err := openSpill(filepath.Join(config.QueueSpillDir, url.QueryEscape(tag)+".spill"))
+		if err != nil {
+			config.Log.Error("Failed to open spill file for '%s', blocking instead - %s", tag, err)
+			q.policy = PolicyBlock
+		} else {
+			q.spill = s
+		}
+	}
+
+	return q
+}
+
+// push queues msgs, applying the queue's policy if it is full
+func (q *queue) push(msgs []Message) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	n := len(msgs)
+	switch q.policy {
+	case PolicyBlock:
+		// a batch larger than the queue waits for it to empty
+		for !q.closed && q.depth > 0 && q.depth+n > q.size {
+			q.cond.Wait()
+		}
+	case PolicyDropNewest:
+		if room := q.size - q.depth; n > room {
+			if room < 0 {
+				room = 0
+			}
+			q.drop(n - room)
+			msgs = msgs[:room]
+		}
+	case PolicyDropOldest:
+		if n > q.size {
+			q.drop(n - q.size)
+			msgs = msgs[n-q.size:]
+		}
+		for len(q.batches) > 0 && q.depth+len(msgs) > q.size {
+			excess := q.depth + len(msgs) - q.size
+			if oldest := len(q.batches[0]); oldest <= excess {
+				q.batches = q.batches[1:]
+				q.depth -= oldest
+				q.drop(oldest)
+				continue
+			}
+			q.batches[0] = q.batches[0][excess:]
+			q.depth -= excess
+			q.drop(excess)
+		}
+	case PolicySpill:
+		// once spilling, keep spilling until the spill is read, to preserve order
+		if q.spill.count > 0 || q.depth+n > q.size {
+			if q.closed {
+				q.drop(n)
+				return
+			}
+			if err := q.spill.write(msgs); err != nil {
+				config.Log.Error("Failed to spill messages for '%s' - %s", q.tag, err)
+				q.drop(n)
+				return
+			}
+			q.cond.Broadcast()
+			return
+		}
+	}
+
+	if q.closed {
+		q.drop(len(msgs))
+		return
+	}
+	if len(msgs) == 0 {
+		return
+	}
+	q.batches = append(q.batches, msgs)
+	q.depth += len(msgs)
+	q.cond.Broadcast()
+}
+
+// pop waits for the next batch, returning false once the queue is closed (and,
+// if flushing, empty)
+func (q *queue) pop() ([]Message, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for !q.closed && q.depth == 0 && q.spilled() == 0 {
+		q.cond.Wait()
+	}
+
+	if q.closed && q.handed {
+		return nil, false
+	}
+	if q.closed && !q.flush {
+		q.drop(q.depth + q.spilled())
+		q.batches, q.depth = nil, 0
+		if q.spill != nil {
+			q.spill.remove()
+		}
+		return nil, false
+	}
+
+	if len(q.batches) > 0 {
+		msgs := q.batches[0]
+		q.batches[0] = nil
+		q.batches = q.batches[1:]
+		q.depth -= len(msgs)
+		q.cond.Broadcast()
+		return msgs, true
+	}
+
+	if q.spilled() > 0 {
+		msgs, err := q.spill.read()
+		if err == nil {
+			q.cond.Broadcast()
+			return msgs, true
+		}
+		config.Log.Error("Failed to read spilled messages for '%s' - %s", q.tag, err)
+		q.drop(q.spill.count)
+		q.spill.reset()
+	}
+
+	// closed, flushed, and empty
+	if q.spill != nil {
+		q.spill.remove()
+	}
+	return nil, false
+}
+
+// close stops the queue. If flush, the output is first given what's queued.
+func (q *queue) close(flush bool) {
+	q.mutex.Lock()
+	q.closed = true
+	q.flush = flush
+	q.cond.Broadcast()
+	q.mutex.Unlock()
+}
+
+// handOff stops the queue for a replacement, returning the batches queued in
+// memory. A spill file is closed holding only what wasn't read, for the
+// replacement to read back.
+func (q *queue) handOff() [][]Message {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.closed = true
+	q.handed = true
+	batches := q.batches
+	q.batches, q.depth = nil, 0
+	if q.spill != nil {
+		if err := q.spill.keep(); err != nil {
+			config.Log.Error("Failed to keep spilled messages for '%s' - %s", q.tag, err)
+			q.drop(q.spill.count)
+			os.Remove(q.spill.path)
+		}
+		q.spill.count = 0
+	}
+	q.cond.Broadcast()
+	return batches
+}
+
+// takeOver queues the batches a replaced queue handed off, ahead of anything
+// spilled (which was written after them)
+func (q *queue) takeOver(batches [][]Message) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for _, msgs := range batches {
+		q.batches = append(q.batches, msgs)
+		q.depth += len(msgs)
+	}
+}
+
+func (q *queue) spilled() int {
+	if q.spill == nil {
+		return 0
+	}
+	return q.spill.count
+}
+
+// drop counts n dropped messages, q.mutex must be held
+func (q *queue) drop(n int) {
+	if n <= 0 {
+		return
+	}
+	q.dropped += uint64(n)
+	atomic.AddUint64(&dropped, uint64(n))
+	queueDropped.Add(float64(n), metricLabel(q.tag))
+}
+
+func (q *queue) stat() QueueStat {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return QueueStat{
+		Size:    q.size,
+		Policy:  q.policy,
+		Depth:   q.depth + q.spilled(),
+		Spilled: q.spilled(),
+		Dropped: q.dropped,
+	}
+}
+
+// QueueStats returns the state of each output's queue, by tag
+func QueueStats() map[string]QueueStat {
+	return Vac.queueStats()
+}
+
+func (l *Log_agg) queueStats() map[string]QueueStat {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	stats := make(map[string]QueueStat, len(l.outputs))
+	for tag, q := range l.outputs {
+		stats[tag] = q.stat()
+	}
+	return stats
+}
+
+// openSpill opens (or creates) a spill file. Batches left by a previous run
+// are read back first.
+func openSpill(path string) (*spill, error) {
+	writer, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		writer.Close()
+		return nil, err
+	}
+
+	s := &spill{path: path, writer: writer, file: file, reader: bufio.NewReader(file)}
+
+	// count what was left
+	for {
+		msgs, err := s.decode()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			config.Log.Error("Failed to read spill file '%s', discarding it - %s", path, err)
+			s.count = 0
+			s.reset()
+			return s, nil
+		}
+		s.count += len(msgs)
+	}
+	file.Seek(0, io.SeekStart)
+	s.reader.Reset(file)
+
+	if s.count > 0 {
+		config.Log.Info("Replaying %d spilled messages from '%s'", s.count, path)
+	}
+	return s, nil
+}
+
+func (s *spill) write(msgs []Message) error {
+	data, err := json.Marshal(msgs)
+	if err != nil {
+		return err
+	}
+	_, err = s.writer.Write(append(data, '\n'))
+	if err != nil {
+		return err
+	}
+	s.count += len(msgs)
+	return nil
+}
+
+func (s *spill) read() ([]Message, error) {
+	msgs, err := s.decode()
+	if err != nil {
+		return nil, err
+	}
+	s.count -= len(msgs)
+
+	// start over once everything written has been read
+	if s.count <= 0 {
+		s.reset()
+	}
+	return msgs, nil
+}
+
+func (s *spill) decode() ([]Message, error) {
+	line, err := s.reader.ReadBytes('\n')
+	if err != nil {
+		if err == io.EOF && len(line) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	var msgs []Message
+	err = json.Unmarshal(line, &msgs)
+	return msgs, err
+}
+
+// reset empties the spill file
+func (s *spill) reset() {
+	s.count = 0
+	s.writer.Truncate(0)
+	s.file.Seek(0, io.SeekStart)
+	s.reader.Reset(s.file)
+}
+
+// keep closes the spill file, leaving just what hasn't been read in it
+func (s *spill) keep() error {
+	defer s.writer.Close()
+	defer s.file.Close()
+
+	tmp, err := os.Create(s.path + ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(tmp, s.reader); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// remove closes and deletes the spill file
+func (s *spill) remove() {
+	s.writer.Close()
+	s.file.Close()
+	os.Remove(s.path)
+}
@@ -0,0 +1,136 @@
+package log_agg
+
+import (
+	"fmt"
+	"regexp"
+	"sync/atomic"
+
+	"github.com/r0h4n/log_agg/config"
+)
+
+// redactor is a compiled config.RedactRule
+type redactor struct {
+	name    string
+	regex   *regexp.Regexp
+	replace string
+	tag     bool
+	count   uint64 // number of matches scrubbed by this rule
+}
+
+// compiles the configured redaction rules, in order
+func newRedactors(rules []config.RedactRule) ([]*redactor, error) {
+	redactors := make([]*redactor, 0, len(rules))
+	for i, rule := range rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule-%d", i)
+		}
+
+		r, err := regexp.Compile(rule.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("Bad redact-regex '%s' - %s", rule.Name, err)
+		}
+
+		redactors = append(redactors, &redactor{
+			name:    rule.Name,
+			regex:   r,
+			replace: rule.Replace,
+			tag:     rule.Tag,
+		})
+	}
+
+	return redactors, nil
+}
+
+// RedactCounts returns the number of matches each redaction rule has scrubbed
+func RedactCounts() map[string]uint64 {
+	return Vac.redactCounts()
+}
+
+func (l *Log_agg) redactCounts() map[string]uint64 {
+	counts := make(map[string]uint64, len(l.redactors))
+	for _, r := range l.redactors {
+		counts[r.name] += atomic.LoadUint64(&r.count)
+	}
+	return counts
+}
+
+// redact applies each redaction rule, in order, to the message
+func (l *Log_agg) redact(msg Message) Message {
+	if len(l.redactors) == 0 {
+		return msg
+	}
+
+	// don't modify the caller's tags or raw
+	if len(msg.Tag) > 0 {
+		msg.Tag = append([]string(nil), msg.Tag...)
+	}
+
+	for _, r := range l.redactors {
+		var matches int
+		msg.Content, matches = r.replaceString(msg.Content)
+		atomic.AddUint64(&r.count, uint64(matches))
+		if len(msg.Raw) > 0 {
+			msg.Raw = r.redactBytes(msg.Raw, matches)
+		}
+		if r.tag {
+			for i := range msg.Tag {
+				msg.Tag[i] = r.redactString(msg.Tag[i])
+			}
+		}
+		if len(msg.Fields) > 0 {
+			msg.Fields = Fields(r.redactValue(map[string]interface{}(msg.Fields)).(map[string]interface{}))
+		}
+	}
+
+	return msg
+}
+
+// redactValue redacts the strings of a decoded json value, copying objects and
+// arrays rather than modifying the caller's
+func (r *redactor) redactValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		return r.redactString(v)
+	case map[string]interface{}:
+		redacted := make(map[string]interface{}, len(v))
+		for key := range v {
+			redacted[key] = r.redactValue(v[key])
+		}
+		return redacted
+	case []interface{}:
+		redacted := make([]interface{}, len(v))
+		for i := range v {
+			redacted[i] = r.redactValue(v[i])
+		}
+		return redacted
+	}
+	return value
+}
+
+func (r *redactor) redactString(s string) string {
+	s, matches := r.replaceString(s)
+	atomic.AddUint64(&r.count, uint64(matches))
+	return s
+}
+
+// replaceString redacts s without counting, returning its matches
+func (r *redactor) replaceString(s string) (string, int) {
+	matches := len(r.regex.FindAllStringIndex(s, -1))
+	if matches == 0 {
+		return s, 0
+	}
+	return r.regex.ReplaceAllString(s, r.replace), matches
+}
+
+// redactBytes redacts raw, which usually holds the content's text, so only
+// its matches beyond the content's (counted) are counted
+func (r *redactor) redactBytes(b []byte, counted int) []byte {
+	matches := len(r.regex.FindAllIndex(b, -1))
+	if matches == 0 {
+		return b
+	}
+	if matches > counted {
+		atomic.AddUint64(&r.count, uint64(matches-counted))
+	}
+	return r.regex.ReplaceAll(b, []byte(r.replace))
+}
@@ -4,7 +4,9 @@ package log_agg
 
 import (
 	"io"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/r0h4n/log_agg/config"
@@ -24,19 +26,30 @@ type (
 
 	// Message defines the structure of a log message
 	Message struct {
-		Time     time.Time `json:"time"`
-		UTime    int64     `json:"utime"`
-		Id       string    `json:"id"`   // ignoreifempty? // If setting multiple tags in id (syslog), set hostname first
-		Tag      []string  `json:"tag"`  // ignoreifempty?
-		Type     string    `json:"type"` // Can be set if logs are submitted via http (deploy logs)
-		Priority int       `json:"priority"`
-		Content  string    `json:"message"`
-		Raw      []byte    `json:"raw,omitempty"`
+		Time      time.Time `json:"time"`
+		UTime     int64     `json:"utime"`
+		Id        string    `json:"id"`   // ignoreifempty? // If setting multiple tags in id (syslog), set hostname first
+		Tag       []string  `json:"tag"`  // ignoreifempty?
+		Type      string    `json:"type"` // Can be set if logs are submitted via http (deploy logs)
+		Priority  int       `json:"priority"`
+		Content   string    `json:"message"`
+		Raw       []byte    `json:"raw,omitempty"`
+		MessageId string    `json:"message_id,omitempty"` // unique archive id, sorts in archive order (set by the archive on read)
+		Tenant    string    `json:"tenant,omitempty"`     // tenant of the api key the message was posted with, namespaces its type in the archive
+		Fields    Fields    `json:"fields,omitempty"`     // structured attributes, posted as "fields" or as any attribute not above
 	}
 
+	// Fields holds a message's structured attributes, as decoded from json
+	Fields map[string]interface{}
+
 	// Log_agg defines the structure for the default log_agg object
 	Log_agg struct {
-		outputs map[string]outputChannels
+		outputs    map[string]*queue
+		processors []namedProcessor
+		redactors  []*redactor
+		combiner   *combiner     // assembles multiline events, nil without config.Multiline
+		mutex      *sync.RWMutex // guards outputs and processors, which may change at runtime
+		replacing  *sync.Mutex   // held while an output is added, so replacements don't overlap
 	}
 
 	// Output defines a third party log output endpoint (generally, only raw logs get outputed)
@@ -51,20 +64,50 @@ type (
 	// OutputFunc is a function that "outputs a Message"
 	OutputFunc func(Message)
 
-	outputChannels struct {
-		send chan Message
-		done chan bool
-	}
+	// BatchOutputFunc is a function that outputs the Messages written together
+	// (by WriteMessages) at once
+	BatchOutputFunc func([]Message)
 )
 
 // Vac is the default log_agg object
 var Vac Log_agg
 
+// count of messages dropped by a queue policy, or because their output was
+// removed before receiving them
+var dropped uint64
+
 // Initializes a log_agg object
 func Init() error {
-	Vac = Log_agg{
-		outputs: make(map[string]outputChannels),
+	err := checkQueues()
+	if err != nil {
+		return err
+	}
+
+	redactors, err := newRedactors(config.RedactRegex)
+	if err != nil {
+		return err
+	}
+
+	// events completed by their timeout are written by whichever log_agg is
+	// the default then
+	combiner, err := newCombiner(config.Multiline, func(msgs []Message) { Vac.output(msgs) })
+	if err != nil {
+		return err
+	}
+
+	l := Log_agg{
+		outputs:   make(map[string]*queue),
+		redactors: redactors,
+		combiner:  combiner,
+		mutex:     &sync.RWMutex{},
+		replacing: &sync.Mutex{},
+	}
+	err = initProcessors(&l, config.Processors)
+	if err != nil {
+		return err
 	}
+
+	Vac = l
 	config.Log.Debug("Log_agg initialized")
 	return nil
 }
@@ -75,8 +118,14 @@ func Close() {
 }
 
 func (l *Log_agg) close() {
+	l.flush()
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
 	for tag := range l.outputs {
-		l.removeOutput(tag)
+		l.outputs[tag].close(false)
+		delete(l.outputs, tag)
 	}
 }
 
@@ -86,24 +135,106 @@ func AddOutput(tag string, output OutputFunc) {
 }
 
 func (l *Log_agg) addOutput(tag string, output OutputFunc) {
-	channels := outputChannels{
-		done: make(chan bool),
-		send: make(chan Message),
+	l.addBatchOutput(tag, func(msgs []Message) {
+		for i := range msgs {
+			output(msgs[i])
+		}
+	})
+}
+
+// AddBatchOutput adds a output that receives batches of messages. Messages
+// are queued for the output, see config.QueueSize and config.QueuePolicy.
+func AddBatchOutput(tag string, output BatchOutputFunc) {
+	Vac.addBatchOutput(tag, output)
+}
+
+func (l *Log_agg) addBatchOutput(tag string, output BatchOutputFunc) {
+	l.replacing.Lock()
+	defer l.replacing.Unlock()
+
+	// replace any output with the same tag, taking over what's queued for it
+	l.mutex.Lock()
+	old, ok := l.outputs[tag]
+	var batches [][]Message
+	if ok {
+		batches = old.handOff()
+		delete(l.outputs, tag)
+	}
+	l.mutex.Unlock()
+
+	// a spilling output must be done with its file before it's reopened (and
+	// its last batch written before the spilled ones)
+	if ok && old.spill != nil {
+		<-old.stopped
 	}
 
+	q := newQueue(tag)
+	q.takeOver(batches)
 	go func() {
+		defer close(q.stopped)
 		for {
-			select {
-			case <-channels.done:
+			msgs, ok := q.pop()
+			if !ok {
 				return
-			case msg := <-channels.send:
-				// don't goroutine to preserve log order
-				output(msg)
 			}
+			// don't goroutine to preserve log order
+			output(msgs)
 		}
 	}()
 
-	l.outputs[tag] = channels
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.outputs[tag] = q
+}
+
+// Drain removes every output, letting each finish writing what was queued for
+// it, and waits up to timeout for them. It returns the tags of the outputs
+// still writing.
+func Drain(timeout time.Duration) []string {
+	return Vac.drain(timeout)
+}
+
+func (l *Log_agg) drain(timeout time.Duration) []string {
+	l.flush()
+
+	l.mutex.Lock()
+	outputs := l.outputs
+	l.outputs = make(map[string]*queue)
+	l.mutex.Unlock()
+
+	for tag := range outputs {
+		outputs[tag].close(true)
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	expired := false
+	var pending []string
+	for tag := range outputs {
+		if !expired {
+			select {
+			case <-outputs[tag].stopped:
+				continue
+			case <-timer.C:
+				expired = true
+			}
+		}
+		// once expired, only check
+		select {
+		case <-outputs[tag].stopped:
+		default:
+			pending = append(pending, tag)
+		}
+	}
+	sort.Strings(pending)
+	return pending
+}
+
+// Dropped returns the number of messages not written, because their output's
+// queue was full or the output was removed first
+func Dropped() uint64 {
+	return atomic.LoadUint64(&dropped)
 }
 
 // RemoveOutput drops a output
@@ -112,34 +243,74 @@ func RemoveOutput(tag string) {
 }
 
 func (l *Log_agg) removeOutput(tag string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
 	_, ok := l.outputs[tag]
 	if ok {
-		close(l.outputs[tag].done)
+		l.outputs[tag].close(false)
 		delete(l.outputs, tag)
 	}
 }
 
-// WriteMessage broadcasts to all outputs in seperate go routines
-// Returns once all outputs have received the message, but may not have processed
-// the message yet
+// WriteMessage runs the message through the processors (once the multiline
+// event it's part of, if any, is complete), redacts the results, then queues
+// them for all outputs
+// Returns once all outputs have queued the message (or dropped it, depending on
+// their queue policy), but may not have processed the message yet
 func WriteMessage(msg Message) {
-	Vac.writeMessage(msg)
+	Vac.writeMessages([]Message{msg})
+}
+
+// WriteMessages writes messages like WriteMessage, but outputs receive them
+// together (batch outputs in a single call)
+func WriteMessages(msgs []Message) {
+	Vac.writeMessages(msgs)
+}
+
+func (l *Log_agg) writeMessages(msgs []Message) {
+	// config.Log.Trace("Writing messages - %s...", msgs)
+	if l.combiner != nil {
+		msgs = l.combiner.combine(msgs)
+	}
+	l.output(msgs)
+}
+
+// output processes, redacts, and queues messages that are complete
+func (l *Log_agg) output(msgs []Message) {
+	var processed []Message
+	for i := range msgs {
+		for _, msg := range l.process(msgs[i]) {
+			processed = append(processed, l.redact(msg))
+		}
+	}
+	if len(processed) == 0 {
+		return
+	}
+
+	l.broadcast(processed)
 }
 
-func (l *Log_agg) writeMessage(msg Message) {
-	// config.Log.Trace("Writing message - %s...", msg)
-	group := sync.WaitGroup{}
+// flush writes the multiline events still waiting for lines
+func (l *Log_agg) flush() {
+	if l.combiner != nil {
+		l.combiner.flush()
+	}
+}
+
+func (l *Log_agg) broadcast(msgs []Message) {
+	l.mutex.RLock()
+	outputs := make([]*queue, 0, len(l.outputs))
 	for _, output := range l.outputs {
-		group.Add(1)
-		go func(myOutput outputChannels) {
-			select {
-			case <-myOutput.done:
-			case myOutput.send <- msg:
-			}
-			group.Done()
-		}(output)
+		outputs = append(outputs, output)
+	}
+	l.mutex.RUnlock()
+
+	// only full queues with the block policy wait, so each output is
+	// simply queued for in turn
+	for _, output := range outputs {
+		output.push(msgs)
 	}
-	group.Wait()
 }
 
 func (m Message) eof() bool {
@@ -7,6 +7,8 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 
@@ -72,6 +74,219 @@ func TestAddOutput(t *testing.T) {
 	}
 }
 
+// Test writing messages to a batch output
+func TestAddBatchOutput(t *testing.T) {
+	batches := make(chan []log_agg.Message, 2)
+	log_agg.AddBatchOutput("batch", func(msgs []log_agg.Message) {
+		batches <- msgs
+	})
+	defer log_agg.RemoveOutput("batch")
+
+	log_agg.WriteMessages([]log_agg.Message{
+		{Type: "app", Content: "first"},
+		{Type: "app", Content: "second"},
+	})
+	log_agg.WriteMessage(log_agg.Message{Type: "app", Content: "third"})
+
+	for _, expected := range [][]string{{"first", "second"}, {"third"}} {
+		select {
+		case msgs := <-batches:
+			if len(msgs) != len(expected) || msgs[0].Content != expected[0] {
+				t.Errorf("%+v doesn't match expected out", msgs)
+			}
+		case <-time.After(time.Second):
+			t.Error("batch output received nothing")
+			t.FailNow()
+		}
+	}
+}
+
+// Test draining outputs on shutdown
+func TestDrain(t *testing.T) {
+	written := make(chan string, 2)
+	log_agg.AddOutput("fast", func(msg log_agg.Message) {
+		written <- "fast"
+	})
+	log_agg.AddOutput("slow", func(msg log_agg.Message) {
+		time.Sleep(time.Second)
+		written <- "slow"
+	})
+
+	log_agg.WriteMessage(log_agg.Message{Type: "app", Content: "draining"})
+	pending := log_agg.Drain(100 * time.Millisecond)
+	if len(pending) != 1 || pending[0] != "slow" || len(written) != 1 {
+		t.Errorf("%q doesn't match expected pending outputs", pending)
+	}
+
+	// drained outputs are removed
+	if pending = log_agg.Drain(time.Second); len(pending) != 0 {
+		t.Errorf("%q doesn't match expected pending outputs", pending)
+	}
+	<-written
+	<-written
+}
+
+// Test the policies applied to full output queues
+func TestQueues(t *testing.T) {
+	config.QueueSize = 2
+	config.QueueSpillDir = "/tmp/transformTest"
+	config.Queues = map[string]config.QueueConfig{
+		"oldest":  {Policy: log_agg.PolicyDropOldest},
+		"newest":  {Policy: log_agg.PolicyDropNewest},
+		"spilled": {Policy: log_agg.PolicySpill},
+		"blocked": {Policy: log_agg.PolicyBlock, Size: 1},
+	}
+	defer func() {
+		config.QueueSize, config.QueueSpillDir, config.Queues = 1000, "/var/db/log_agg-spill", nil
+		os.RemoveAll("/tmp/transformTest")
+	}()
+
+	if err := log_agg.Init(); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer log_agg.Close()
+
+	// outputs wait on the gate after receiving the first message
+	gate := make(chan bool)
+	written := map[string]chan string{}
+	for _, tag := range []string{"oldest", "newest", "spilled"} {
+		out := make(chan string, 5)
+		written[tag] = out
+		log_agg.AddOutput(tag, func(msg log_agg.Message) {
+			<-gate
+			out <- msg.Content
+		})
+	}
+
+	for i := 1; i <= 5; i++ {
+		log_agg.WriteMessage(log_agg.Message{Type: "app", Content: fmt.Sprint(i)})
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stats := log_agg.QueueStats()
+	if stats["oldest"].Depth != 2 || stats["oldest"].Dropped != 2 || stats["newest"].Dropped != 2 ||
+		stats["spilled"].Depth != 4 || stats["spilled"].Spilled != 2 || stats["spilled"].Dropped != 0 {
+		t.Errorf("%+v doesn't match expected stats", stats)
+	}
+	if _, err := os.Stat("/tmp/transformTest/spilled.spill"); err != nil {
+		t.Error(err)
+	}
+
+	close(gate)
+	expected := map[string]string{"oldest": "1 4 5", "newest": "1 2 3", "spilled": "1 2 3 4 5"}
+	for tag, out := range written {
+		var got []string
+		for len(got) < len(strings.Fields(expected[tag])) {
+			select {
+			case content := <-out:
+				got = append(got, content)
+			case <-time.After(time.Second):
+				t.Errorf("'%s' wrote %q", tag, got)
+				t.FailNow()
+			}
+		}
+		if strings.Join(got, " ") != expected[tag] {
+			t.Errorf("'%s' wrote %q, expected '%s'", tag, got, expected[tag])
+		}
+	}
+
+	// block waits for room
+	log_agg.Close()
+	gate = make(chan bool)
+	log_agg.AddOutput("blocked", func(msg log_agg.Message) {
+		<-gate
+	})
+	log_agg.WriteMessage(log_agg.Message{Type: "app", Content: "writing"})
+	time.Sleep(10 * time.Millisecond)
+	log_agg.WriteMessage(log_agg.Message{Type: "app", Content: "queued"})
+
+	done := make(chan bool)
+	go func() {
+		log_agg.WriteMessage(log_agg.Message{Type: "app", Content: "blocked"})
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Error("full queue didn't block")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(gate)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("blocked write never finished")
+	}
+
+	// bad policies should fail to initialize
+	config.Queues = map[string]config.QueueConfig{"bad": {Policy: "drop-all"}}
+	if err := log_agg.Init(); err == nil {
+		t.Error("bad queue policy is too forgiving")
+	}
+}
+
+// Test replacing an output that has spilled
+func TestReplaceSpilled(t *testing.T) {
+	config.QueueSize = 2
+	config.QueueSpillDir = "/tmp/transformTest"
+	config.Queues = map[string]config.QueueConfig{"spilled": {Policy: log_agg.PolicySpill}}
+	defer func() {
+		config.QueueSize, config.QueueSpillDir, config.Queues = 1000, "/var/db/log_agg-spill", nil
+		os.RemoveAll("/tmp/transformTest")
+	}()
+
+	if err := log_agg.Init(); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer log_agg.Close()
+
+	// the first output waits on the gate after receiving the first message
+	gate := make(chan bool)
+	first := make(chan string, 5)
+	log_agg.AddOutput("spilled", func(msg log_agg.Message) {
+		<-gate
+		first <- msg.Content
+	})
+	for i := 1; i <= 5; i++ {
+		log_agg.WriteMessage(log_agg.Message{Type: "app", Content: fmt.Sprint(i)})
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stats := log_agg.QueueStats(); stats["spilled"].Spilled != 2 {
+		t.Errorf("%+v doesn't match expected stats", stats)
+	}
+
+	// the replacement is added once the first output finishes its message
+	second := make(chan string, 5)
+	added := make(chan bool)
+	go func() {
+		log_agg.AddOutput("spilled", func(msg log_agg.Message) {
+			second <- msg.Content
+		})
+		close(added)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	close(gate)
+	<-added
+
+	var got []string
+	for len(got) < 4 {
+		select {
+		case content := <-second:
+			got = append(got, content)
+		case <-time.After(time.Second):
+			t.Errorf("replacement wrote %q", got)
+			t.FailNow()
+		}
+	}
+	if strings.Join(got, " ") != "2 3 4 5" || len(first) != 1 {
+		t.Errorf("replacement wrote %q, first output wrote %d", got, len(first))
+	}
+	if stats := log_agg.QueueStats(); stats["spilled"].Depth != 0 || stats["spilled"].Dropped != 0 {
+		t.Errorf("%+v doesn't match expected stats", stats)
+	}
+}
+
 // Test removing a output
 func TestRemoveOutput(t *testing.T) {
 	tag := "null"
@@ -88,6 +303,264 @@ func TestClose(t *testing.T) {
 	time.Sleep(time.Second)
 }
 
+// Test redacting messages before they are output
+func TestRedact(t *testing.T) {
+	config.RedactRegex = []config.RedactRule{
+		{Name: "card", Regex: `\b(?:\d[ -]?){12}(\d{4})\b`, Replace: "****-$1"},
+		{Name: "bearer", Regex: `(?i)bearer [a-z0-9._-]+`, Replace: "Bearer [redacted]", Tag: true},
+		{Name: "email", Regex: `[a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+`, Replace: "[email]"},
+	}
+	defer func() { config.RedactRegex = nil }()
+
+	if err := log_agg.Init(); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer log_agg.Close()
+
+	out := make(chan log_agg.Message, 1)
+	log_agg.AddOutput("redact", func(msg log_agg.Message) { out <- msg })
+
+	log_agg.WriteMessage(log_agg.Message{
+		Tag:     []string{"bearer abc123", "bob@example.com"},
+		Content: "paid with 4111 1111 1111 1234 by bob@example.com, jim@example.com",
+		Raw:     []byte("Authorization: Bearer abc.def-123"),
+		Fields:  log_agg.Fields{"user": map[string]interface{}{"email": "ann@example.com"}, "code": 500},
+	})
+
+	// encoded and decoded, as an archive would
+	var rMsg log_agg.Message
+	select {
+	case msg := <-out:
+		data, err := json.Marshal(msg)
+		if err == nil {
+			err = json.Unmarshal(data, &rMsg)
+		}
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+	case <-time.After(time.Second):
+		t.Error("redacted message never written")
+		t.FailNow()
+	}
+
+	if rMsg.Content != "paid with ****-1234 by [email], [email]" {
+		t.Errorf("%q doesn't match expected out", rMsg.Content)
+	}
+	if string(rMsg.Raw) != "Authorization: Bearer [redacted]" {
+		t.Errorf("%q doesn't match expected out", rMsg.Raw)
+	}
+	if rMsg.Tag[0] != "Bearer [redacted]" || rMsg.Tag[1] != "bob@example.com" {
+		t.Errorf("%q doesn't match expected out", rMsg.Tag)
+	}
+
+	if email, _ := rMsg.Fields.Lookup("user.email"); email != "[email]" || rMsg.Fields["code"] != 500.0 {
+		t.Errorf("%v doesn't match expected out", rMsg.Fields)
+	}
+
+	// raw's bearer isn't in the content, so it's counted too
+	counts := log_agg.RedactCounts()
+	if counts["card"] != 1 || counts["bearer"] != 2 || counts["email"] != 3 {
+		t.Errorf("%v doesn't match expected counts", counts)
+	}
+
+	// bad rules should fail to initialize
+	config.RedactRegex = []config.RedactRule{{Name: "bad", Regex: "(["}}
+	if err := log_agg.Init(); err == nil {
+		t.Error("bad redact-regex is too forgiving")
+	}
+}
+
+// Test decoding attributes without a Message field into Fields
+func TestFields(t *testing.T) {
+	var msg log_agg.Message
+	err := json.Unmarshal([]byte(`{"id":"web","message":"done","status":500,"user":{"id":3,"roles":["admin"]},"fields":{"status":503,"region":"us"}}`), &msg)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if msg.Id != "web" || msg.Content != "done" || len(msg.Fields) != 3 || msg.Fields["status"] != 503.0 || msg.Fields["region"] != "us" {
+		t.Errorf("%+v doesn't match expected out", msg)
+	}
+
+	lookups := map[string]interface{}{
+		"user.id":       3.0,
+		"user.roles.0":  "admin",
+		"user.roles.1":  nil,
+		"user.id.value": nil,
+		"missing":       nil,
+	}
+	for path, expected := range lookups {
+		value, ok := msg.Fields.Lookup(path)
+		if value != expected || ok != (expected != nil) {
+			t.Errorf("'%s' is %v (%v), expected %v", path, value, ok, expected)
+		}
+	}
+
+	// fields survive being encoded (archived) and decoded again
+	data, _ := json.Marshal(msg)
+	var decoded log_agg.Message
+	if err = json.Unmarshal(data, &decoded); err != nil || fmt.Sprint(decoded.Fields) != fmt.Sprint(msg.Fields) {
+		t.Errorf("%s doesn't match expected out - %v", data, err)
+	}
+
+	// messages without extra attributes have none
+	if err = json.Unmarshal([]byte(`{"message":"plain"}`), &decoded); err != nil || decoded.Fields != nil {
+		t.Errorf("%+v doesn't match expected out - %v", decoded, err)
+	}
+	if err = json.Unmarshal([]byte(`{"message":"bad","status":}`), &decoded); err == nil {
+		t.Error("bad json is too forgiving")
+	}
+}
+
+// Test transforming messages with the processor chain
+func TestProcessors(t *testing.T) {
+	config.Processors = []config.ProcessorConfig{
+		{Kind: "drop", Match: map[string]string{"message": "^GET /health"}},
+		{Kind: "route", To: "deploy", Match: map[string]string{"tag": "^build-"}},
+		{Kind: "rename", Field: "id", To: "tag"},
+		{Kind: "set", Field: "id", Value: "web", Match: map[string]string{"type": "app"}},
+		{Kind: "delete", Field: "priority", Match: map[string]string{"priority": "^[0-1]$"}},
+	}
+	defer func() { config.Processors = nil }()
+
+	if err := log_agg.Init(); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer log_agg.Close()
+
+	// split multi-line messages
+	log_agg.AddProcessor("split", log_agg.ProcessorFunc(func(msg log_agg.Message) []log_agg.Message {
+		var messages []log_agg.Message
+		for _, line := range strings.Split(msg.Content, "\n") {
+			msg.Content = line
+			messages = append(messages, msg)
+		}
+		return messages
+	}))
+
+	out := make(chan log_agg.Message, 10)
+	log_agg.AddOutput("processed", func(msg log_agg.Message) { out <- msg })
+
+	log_agg.WriteMessage(log_agg.Message{Id: "lb", Type: "app", Content: "GET /health 200"})
+	log_agg.WriteMessage(log_agg.Message{Id: "ci", Type: "app", Tag: []string{"build-12"}, Priority: 1, Content: "building\ndone"})
+
+	// wait for what's expected, then a little longer for anything else
+	var messages []log_agg.Message
+	for done := false; !done; {
+		wait := time.Second
+		if len(messages) >= 2 {
+			wait = 10 * time.Millisecond
+		}
+		select {
+		case msg := <-out:
+			messages = append(messages, msg)
+		case <-time.After(wait):
+			done = true
+		}
+	}
+
+	if len(messages) != 2 || messages[0].Content != "building" || messages[1].Content != "done" {
+		t.Errorf("%+v doesn't match expected out", messages)
+		t.FailNow()
+	}
+	for _, msg := range messages {
+		if msg.Type != "deploy" || msg.Id != "" || msg.Priority != 0 || strings.Join(msg.Tag, " ") != "build-12 ci" {
+			t.Errorf("%+v doesn't match expected out", msg)
+		}
+	}
+
+	// bad processors should fail to initialize
+	config.Processors = []config.ProcessorConfig{{Kind: "set", Field: "priority", Value: "high"}}
+	if err := log_agg.Init(); err == nil {
+		t.Error("bad processor is too forgiving")
+	}
+}
+
+// Test combining multiline events
+func TestMultiline(t *testing.T) {
+	config.Multiline = []config.MultilineConfig{
+		{Match: map[string]string{"type": "java"}, Start: `^\S`, Timeout: "50ms"},
+		{Match: map[string]string{"type": "go"}, Continue: `^(\s|goroutine |$)`, Timeout: "50ms", MaxBytes: 40},
+	}
+	defer func() { config.Multiline = nil }()
+
+	if err := log_agg.Init(); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer log_agg.Close()
+
+	buf := &bytes.Buffer{}
+	log_agg.AddOutput("combined", writeOutput(buf))
+
+	write := func(id, kind string, priority int, lines ...string) {
+		for _, line := range lines {
+			log_agg.WriteMessage(log_agg.Message{Id: id, Type: kind, Priority: priority, Content: line})
+		}
+	}
+	write("api", "java", 2, "Exception in thread \"main\" java.lang.NullPointerException")
+	// other sources don't break up an event
+	write("web", "java", 2, "started")
+	write("api", "java", 4, "\tat App.run(App.java:12)", "\tat App.main(App.java:3)")
+	write("api", "java", 2, "recovered")
+	write("api", "app", 2, "  not combined")
+	// too long for max-bytes
+	write("worker", "go", 2, "panic: oops", "", "goroutine 1 [running]:", "main.main()")
+	time.Sleep(100 * time.Millisecond)
+
+	// events still waiting for lines are flushed on shutdown
+	write("api", "java", 2, "waiting")
+	if pending := log_agg.Drain(time.Second); len(pending) != 0 {
+		t.Errorf("%v failed to drain", pending)
+	}
+
+	var contents []string
+	for {
+		r, err := buf.ReadBytes('\n')
+		if err != nil {
+			break
+		}
+		rMsg := log_agg.Message{}
+		if err = json.Unmarshal(r, &rMsg); err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		contents = append(contents, fmt.Sprintf("%s %d %q", rMsg.Id, rMsg.Priority, rMsg.Content))
+	}
+
+	// events completed by their timeout are written in no particular order
+	expected := []string{
+		`api 2 "  not combined"`,
+		`api 2 "recovered"`,
+		`api 2 "waiting"`,
+		`api 4 "Exception in thread \"main\" java.lang.NullPointerException\n\tat App.run(App.java:12)\n\tat App.main(App.java:3)"`,
+		`web 2 "started"`,
+		`worker 2 "main.main()"`,
+		`worker 2 "panic: oops\n\ngoroutine 1 [running]:"`,
+	}
+	sort.Strings(contents)
+	if strings.Join(contents, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("%q doesn't match expected out", contents)
+	}
+
+	// bad rules should fail to initialize
+	for _, bad := range []config.MultilineConfig{
+		{},
+		{Start: "^a", Continue: "^b"},
+		{Start: "(["},
+		{Start: "^a", Timeout: "soon"},
+		{Start: "^a", Match: map[string]string{"host": "a"}},
+	} {
+		config.Multiline = []config.MultilineConfig{bad}
+		if err := log_agg.Init(); err == nil {
+			t.Errorf("bad multiline %+v is too forgiving", bad)
+		}
+	}
+}
+
 // writeOutput creates a output from an io.Writer
 func writeOutput(writer io.Writer) log_agg.OutputFunc {
 	return func(msg log_agg.Message) {